@@ -0,0 +1,109 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package catalog
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const defaultLocale = "en"
+
+// ====== MESSAGE CATALOG ======
+
+// Localized strings, by locale and then by message key
+type Catalog struct {
+	messages      map[string]map[string]string
+	defaultLocale string
+}
+
+var (
+	loadedCatalog     *Catalog
+	loadedCatalogOnce sync.Once
+)
+
+// Load every '<locale>.json' file of the directory, each one an object of message key to localized string
+func Load(dir string, defaultLocale string) (*Catalog, error) {
+	catalog := &Catalog{
+		messages:      make(map[string]map[string]string),
+		defaultLocale: normalizeLocale(defaultLocale),
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list message catalogs: %w", err)
+	}
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read message catalog %s: %w", file, err)
+		}
+
+		var messages map[string]string
+		if err := json.Unmarshal(content, &messages); err != nil {
+			return nil, fmt.Errorf("failed to parse message catalog %s: %w", file, err)
+		}
+		locale := normalizeLocale(strings.TrimSuffix(filepath.Base(file), ".json"))
+		catalog.messages[locale] = messages
+	}
+	return catalog, nil
+}
+
+// The catalog from NS_MESSAGE_CATALOG_DIR with NS_DEFAULT_LOCALE ("en" if unset), loaded on first use
+// Empty if the directory isn't configured or can't be loaded
+func Default() *Catalog {
+	loadedCatalogOnce.Do(func() {
+		locale := os.Getenv("NS_DEFAULT_LOCALE")
+		if locale == "" {
+			locale = defaultLocale
+		}
+
+		var err error
+		loadedCatalog, err = Load(os.Getenv("NS_MESSAGE_CATALOG_DIR"), locale)
+		if err != nil {
+			log.Printf("failed to load message catalog: %v", err)
+			loadedCatalog = &Catalog{messages: make(map[string]map[string]string), defaultLocale: locale}
+		}
+	})
+	return loadedCatalog
+}
+
+// Returns the message for the key in the requested locale, falling back to the locale's
+// language (e.g. "fr" for "fr-CA") and then to the default locale
+func (catalog *Catalog) Resolve(key string, locale string) (string, error) {
+	locale = normalizeLocale(locale)
+	language, _, _ := strings.Cut(locale, "-")
+
+	for _, candidate := range []string{locale, language, catalog.defaultLocale} {
+		if message, exists := catalog.messages[candidate][key]; exists {
+			return message, nil
+		}
+	}
+	return "", fmt.Errorf("no message '%s' for locale '%s' or the default locale '%s'",
+		key, locale, catalog.defaultLocale)
+}
+
+// "en_US" and "EN-us" both become "en-us"
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+}
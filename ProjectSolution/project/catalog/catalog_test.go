@@ -0,0 +1,75 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package catalog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A catalog directory with the given '<locale>.json' files
+func writeCatalog(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestResolveFallsBackToLanguageThenDefault(t *testing.T) {
+	dir := writeCatalog(t, map[string]string{
+		"en.json":    `{"welcome": "Welcome", "bye": "Goodbye"}`,
+		"fr.json":    `{"welcome": "Bienvenue"}`,
+		"fr_CA.json": `{"welcome": "Bienvenue au Canada"}`,
+	})
+	catalog, err := Load(dir, "en")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		key, locale, expected string
+	}{
+		{"welcome", "fr-CA", "Bienvenue au Canada"},
+		{"welcome", "FR_ca", "Bienvenue au Canada"},
+		{"welcome", "fr-BE", "Bienvenue"},
+		{"bye", "fr-CA", "Goodbye"},
+		{"welcome", "", "Welcome"},
+		{"welcome", "de", "Welcome"},
+	}
+	for _, test := range tests {
+		message, err := catalog.Resolve(test.key, test.locale)
+		if err != nil || message != test.expected {
+			t.Fatalf("%s in %q: expected %q, got %q, %v", test.key, test.locale, test.expected, message, err)
+		}
+	}
+
+	if _, err := catalog.Resolve("missing", "fr"); err == nil {
+		t.Fatalf("expected an error for a key in no locale")
+	}
+}
+
+func TestLoadRejectsMalformedCatalog(t *testing.T) {
+	dir := writeCatalog(t, map[string]string{"en.json": `["not", "an", "object"]`})
+	if _, err := Load(dir, "en"); err == nil {
+		t.Fatalf("expected a malformed catalog to fail loading")
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package config
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ====== CONFIGURATION ======
+
+// Kafka topic of every mode, plus the processed and dead-letter topics
+type Topics struct {
+	Email      string
+	Sms        string
+	Slack      string
+	Webhook    string
+	Processed  string
+	DeadLetter string
+}
+
+// Deployment settings, loaded from the environment with the historical values as defaults
+type Config struct {
+	KafkaBrokers  []string
+	ConsumerGroup string
+	ProducerPort  string
+	Topics        Topics
+}
+
+var (
+	// Read and replaced concurrently, e.g. by tests while consumers run
+	loadedConfig     atomic.Pointer[Config]
+	loadedConfigOnce sync.Once
+)
+
+// Read the configuration from the environment:
+// NS_KAFKA_BROKERS (comma-separated), NS_CONSUMER_GROUP, NS_PRODUCER_PORT (e.g. ":8081") and
+// NS_KAFKA_TOPIC_EMAIL, NS_KAFKA_TOPIC_SMS, NS_KAFKA_TOPIC_SLACK, NS_KAFKA_TOPIC_WEBHOOK, NS_KAFKA_TOPIC_PROCESSED
+// and NS_KAFKA_TOPIC_DEAD_LETTER
+func FromEnv() Config {
+	return Config{
+		KafkaBrokers:  brokersFromEnv("NS_KAFKA_BROKERS", []string{"localhost:9092"}),
+		ConsumerGroup: stringFromEnv("NS_CONSUMER_GROUP", "notifications-group"),
+		ProducerPort:  stringFromEnv("NS_PRODUCER_PORT", ":8080"),
+		Topics: Topics{
+			Email:      stringFromEnv("NS_KAFKA_TOPIC_EMAIL", "email"),
+			Sms:        stringFromEnv("NS_KAFKA_TOPIC_SMS", "sms"),
+			Slack:      stringFromEnv("NS_KAFKA_TOPIC_SLACK", "slack"),
+			Webhook:    stringFromEnv("NS_KAFKA_TOPIC_WEBHOOK", "webhook"),
+			Processed:  stringFromEnv("NS_KAFKA_TOPIC_PROCESSED", "processed"),
+			DeadLetter: stringFromEnv("NS_KAFKA_TOPIC_DEAD_LETTER", "dead-letter"),
+		},
+	}
+}
+
+// The configuration of the process, read from the environment on first use
+func Current() Config {
+	loadedConfigOnce.Do(func() {
+		// Unless it was already replaced
+		fromEnv := FromEnv()
+		loadedConfig.CompareAndSwap(nil, &fromEnv)
+	})
+	return *loadedConfig.Load()
+}
+
+// Replace the configuration of the process, e.g. to point it at another broker in tests
+func SetCurrent(current Config) {
+	loadedConfig.Store(&current)
+}
+
+// The topic notifications of the mode are sent on. Unknown modes map to a topic of the same name
+func (topics Topics) ForMode(mode string) string {
+	switch mode {
+	case "email":
+		return topics.Email
+	case "sms":
+		return topics.Sms
+	case "slack":
+		return topics.Slack
+	case "webhook":
+		return topics.Webhook
+	default:
+		return mode
+	}
+}
+
+func stringFromEnv(envVar string, defaultValue string) string {
+	if value := os.Getenv(envVar); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// Comma-separated list, ignoring blanks around and between the entries
+func brokersFromEnv(envVar string, defaultValue []string) []string {
+	var brokers []string
+	for _, broker := range strings.Split(os.Getenv(envVar), ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	if len(brokers) == 0 {
+		return defaultValue
+	}
+	return brokers
+}
+
+// Duration in the environment variable, e.g. "500ms", or `defaultValue` when it is unset or invalid
+// Zero is a valid value, e.g. to disable a feature, negative durations are not
+func DurationFromEnv(envVar string, defaultValue time.Duration) time.Duration {
+	return durationFromEnv(envVar, defaultValue, 0)
+}
+
+// Like DurationFromEnv(), for durations that have to be over zero, e.g. intervals and timeouts
+func PositiveDurationFromEnv(envVar string, defaultValue time.Duration) time.Duration {
+	return durationFromEnv(envVar, defaultValue, time.Nanosecond)
+}
+
+func durationFromEnv(envVar string, defaultValue time.Duration, minimum time.Duration) time.Duration {
+	value := os.Getenv(envVar)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("ignoring invalid %s %q: %v", envVar, value, err)
+		return defaultValue
+	}
+	if duration < minimum {
+		log.Printf("ignoring invalid %s %q, it is under %s", envVar, value, minimum)
+		return defaultValue
+	}
+	return duration
+}
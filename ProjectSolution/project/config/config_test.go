@@ -0,0 +1,107 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDefaults(t *testing.T) {
+	for _, envVar := range []string{"NS_KAFKA_BROKERS", "NS_CONSUMER_GROUP", "NS_PRODUCER_PORT", "NS_KAFKA_TOPIC_EMAIL",
+		"NS_KAFKA_TOPIC_SMS", "NS_KAFKA_TOPIC_SLACK", "NS_KAFKA_TOPIC_WEBHOOK", "NS_KAFKA_TOPIC_PROCESSED",
+		"NS_KAFKA_TOPIC_DEAD_LETTER"} {
+		t.Setenv(envVar, "")
+	}
+
+	config := FromEnv()
+	if !slices.Equal(config.KafkaBrokers, []string{"localhost:9092"}) || config.ConsumerGroup != "notifications-group" ||
+		config.ProducerPort != ":8080" {
+		t.Fatalf("expected the defaults, got %+v", config)
+	}
+	expected := Topics{Email: "email", Sms: "sms", Slack: "slack", Webhook: "webhook", Processed: "processed",
+		DeadLetter: "dead-letter"}
+	if config.Topics != expected {
+		t.Fatalf("expected the default topics, got %+v", config.Topics)
+	}
+}
+
+func TestOverridesFromEnv(t *testing.T) {
+	t.Setenv("NS_KAFKA_BROKERS", "kafka-1:9092,kafka-2:9092")
+	t.Setenv("NS_CONSUMER_GROUP", "staging-group")
+	t.Setenv("NS_PRODUCER_PORT", ":9090")
+	t.Setenv("NS_KAFKA_TOPIC_SMS", "staging-sms")
+	t.Setenv("NS_KAFKA_TOPIC_DEAD_LETTER", "staging-dlq")
+
+	config := FromEnv()
+	if !slices.Equal(config.KafkaBrokers, []string{"kafka-1:9092", "kafka-2:9092"}) {
+		t.Fatalf("expected both brokers, got %v", config.KafkaBrokers)
+	}
+	if config.ConsumerGroup != "staging-group" || config.ProducerPort != ":9090" {
+		t.Fatalf("expected the overrides, got %+v", config)
+	}
+	if config.Topics.ForMode("sms") != "staging-sms" || config.Topics.DeadLetter != "staging-dlq" {
+		t.Fatalf("expected the topic overrides, got %+v", config.Topics)
+	}
+	if config.Topics.ForMode("email") != "email" {
+		t.Fatalf("expected the topics that aren't overridden to keep their defaults, got %+v", config.Topics)
+	}
+}
+
+func TestBrokersFromEnv(t *testing.T) {
+	tests := map[string][]string{
+		"kafka-1:9092":                  {"kafka-1:9092"},
+		" kafka-1:9092 , kafka-2:9092 ": {"kafka-1:9092", "kafka-2:9092"},
+		"kafka-1:9092,,kafka-3:9092,":   {"kafka-1:9092", "kafka-3:9092"},
+		" , ":                           {"default:9092"},
+		"":                              {"default:9092"},
+	}
+	for value, expected := range tests {
+		t.Setenv("NS_TEST_BROKERS", value)
+		if brokers := brokersFromEnv("NS_TEST_BROKERS", []string{"default:9092"}); !slices.Equal(brokers, expected) {
+			t.Fatalf("%q: expected %v, got %v", value, expected, brokers)
+		}
+	}
+}
+
+func TestForModeUnknownMode(t *testing.T) {
+	if topic := FromEnv().Topics.ForMode("fax"); topic != "fax" {
+		t.Fatalf("expected an unknown mode to map to a topic of the same name, got %q", topic)
+	}
+}
+
+func TestSetCurrentWhileBeingRead(t *testing.T) {
+	previous := Current()
+	t.Cleanup(func() { SetCurrent(previous) })
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			Current()
+		}
+	}()
+	replaced := previous
+	replaced.ProducerPort = ":9999"
+	SetCurrent(replaced)
+	<-done
+
+	if port := Current().ProducerPort; port != ":9999" {
+		t.Fatalf("expected the replaced configuration, got port %q", port)
+	}
+}
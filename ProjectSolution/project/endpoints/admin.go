@@ -0,0 +1,47 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ====== ADMIN AUTH ======
+
+// Guards the admin end-points with the token in NS_ADMIN_TOKEN, sent in the 'X-Admin-Token' header
+// Without a configured token the admin end-points are disabled
+func adminAuth() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		adminToken := os.Getenv("NS_ADMIN_TOKEN")
+		if adminToken == "" {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "Admin end-points are disabled"})
+			return
+		}
+
+		requestToken := ctx.GetHeader("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(requestToken), []byte(adminToken)) != 1 {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Missing or invalid admin token"})
+			return
+		}
+		ctx.Next()
+	}
+}
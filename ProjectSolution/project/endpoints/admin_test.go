@@ -0,0 +1,136 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"example.com/projectsolution/project/models"
+	"example.com/projectsolution/project/services"
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminAuth(t *testing.T) {
+	router := gin.New()
+	router.Group("/admin", adminAuth()).GET("/vars", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+
+	get := func(token string) int {
+		request := httptest.NewRequest(http.MethodGet, "/admin/vars", nil)
+		if token != "" {
+			request.Header.Set("X-Admin-Token", token)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	t.Setenv("NS_ADMIN_TOKEN", "")
+	if code := get("anything"); code != http.StatusForbidden {
+		t.Fatalf("expected admin end-points to be disabled without a token, got %d", code)
+	}
+
+	t.Setenv("NS_ADMIN_TOKEN", "secret")
+	if code := get(""); code != http.StatusUnauthorized {
+		t.Fatalf("expected a missing token to be refused, got %d", code)
+	}
+	if code := get("wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("expected a wrong token to be refused, got %d", code)
+	}
+	if code := get("secret"); code != http.StatusOK {
+		t.Fatalf("expected the admin token to be accepted, got %d", code)
+	}
+}
+
+func TestProviderTestCallsEachModesProvider(t *testing.T) {
+	var called []string
+	for _, mode := range supportedModes {
+		err := services.RegisterProvider(mode, "endpoints-test", services.SenderFunc(func(notification *models.Notification) error {
+			called = append(called, notification.Mode+" "+notification.Recipient)
+			notification.Result.ProviderMessageID = notification.Mode + "-id"
+			return nil
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := gin.New()
+	router.POST("/admin/test/:mode", providerTestHandler())
+
+	recipients := map[string]string{
+		"email":   "ops@example.com",
+		"sms":     "+15555550100",
+		"slack":   "#ops",
+		"webhook": "https://example.com/hook",
+	}
+	for mode, recipient := range recipients {
+		response := postForm(t, router, "/admin/test/"+mode, url.Values{
+			"provider":  {"endpoints-test"},
+			"recipient": {recipient},
+		})
+		if response.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d %s", mode, response.Code, response.Body)
+		}
+
+		var body struct {
+			IsSent bool              `json:"is_sent"`
+			Result models.SendResult `json:"result"`
+		}
+		if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if !body.IsSent || body.Result.ProviderMessageID != mode+"-id" {
+			t.Fatalf("%s: expected the provider's result, got %s", mode, response.Body)
+		}
+	}
+	if len(called) != len(recipients) {
+		t.Fatalf("expected a provider call per mode, got %q", called)
+	}
+}
+
+func TestProviderTestReportsProviderFailure(t *testing.T) {
+	err := services.RegisterProvider("sms", "endpoints-failing", services.SenderFunc(func(*models.Notification) error {
+		return errors.New("invalid credentials")
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.POST("/admin/test/:mode", providerTestHandler())
+
+	response := postForm(t, router, "/admin/test/sms", url.Values{
+		"provider":  {"endpoints-failing"},
+		"recipient": {"+15555550100"},
+	})
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "invalid credentials") {
+		t.Fatalf("expected the provider's error in the result, got %d %s", response.Code, response.Body)
+	}
+
+	if response := postForm(t, router, "/admin/test/fax", nil); response.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown mode to be 404, got %d", response.Code)
+	}
+	response = postForm(t, router, "/admin/test/sms", url.Values{"provider": {"nope"}, "recipient": {"+15555550100"}})
+	if response.Code != http.StatusNotFound {
+		t.Fatalf("expected an unknown provider to be 404, got %d", response.Code)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ====== API KEY AUTH ======
+
+// The API keys in NS_API_KEYS, comma-separated. None means the notification end-points are open
+func apiKeysFromEnv() []string {
+	var keys []string
+	for _, key := range strings.Split(os.Getenv("NS_API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		log.Printf("NS_API_KEYS is not set, the notification end-points don't require an API key")
+	}
+	return keys
+}
+
+// Guards the notification end-points with one of `keys`, sent in the 'X-API-Key' header or as
+// 'Authorization: Bearer <key>'. Without keys every request is let through
+func apiKeyAuth(keys []string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if len(keys) == 0 {
+			ctx.Next()
+			return
+		}
+
+		requestKey := ctx.GetHeader("X-API-Key")
+		if requestKey == "" {
+			requestKey, _ = strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		}
+		if requestKey == "" || !validAPIKey(keys, requestKey) {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Missing or invalid API key"})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// Compares against every key, so the time taken doesn't tell which key, or how much of it, matched
+func validAPIKey(keys []string, requestKey string) bool {
+	valid := 0
+	for _, key := range keys {
+		valid |= subtle.ConstantTimeCompare([]byte(requestKey), []byte(key))
+	}
+	return valid == 1
+}
+
+// End-point handler for liveness checks, open without an API key
+func healthHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// A router with one end-point behind the API keys, answering 200 once through
+func apiKeyRouter(keys []string) *gin.Engine {
+	router := gin.New()
+	router.GET("/health", healthHandler())
+	router.GET("/protected", apiKeyAuth(keys), func(ctx *gin.Context) {
+		ctx.Status(http.StatusOK)
+	})
+	return router
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	router := apiKeyRouter([]string{"key-one", "key-two"})
+	tests := []struct {
+		name     string
+		header   string
+		value    string
+		expected int
+	}{
+		{"valid X-API-Key", "X-API-Key", "key-two", http.StatusOK},
+		{"valid bearer", "Authorization", "Bearer key-one", http.StatusOK},
+		{"missing key", "", "", http.StatusUnauthorized},
+		{"wrong key", "X-API-Key", "key-three", http.StatusUnauthorized},
+		{"prefix of a key", "X-API-Key", "key-", http.StatusUnauthorized},
+		{"bare key in Authorization", "Authorization", "key-one", http.StatusOK},
+		{"wrong bearer", "Authorization", "Bearer key-three", http.StatusUnauthorized},
+		{"empty bearer", "Authorization", "Bearer ", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		request := httptest.NewRequest(http.MethodGet, "/protected", nil)
+		if test.header != "" {
+			request.Header.Set(test.header, test.value)
+		}
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != test.expected {
+			t.Errorf("%s: expected %d, got %d", test.name, test.expected, response.Code)
+		}
+	}
+}
+
+func TestHealthNeedsNoAPIKey(t *testing.T) {
+	response := httptest.NewRecorder()
+	apiKeyRouter([]string{"key-one"}).ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected /health to be open, got %d", response.Code)
+	}
+}
+
+func TestWithoutAPIKeysEverythingIsOpen(t *testing.T) {
+	response := httptest.NewRecorder()
+	apiKeyRouter(nil).ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/protected", nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected no API keys to disable auth, got %d", response.Code)
+	}
+}
+
+func TestAPIKeysFromEnv(t *testing.T) {
+	t.Setenv("NS_API_KEYS", " key-one, ,key-two ,")
+	if keys := apiKeysFromEnv(); !slices.Equal(keys, []string{"key-one", "key-two"}) {
+		t.Fatalf("expected the trimmed, non-empty keys, got %q", keys)
+	}
+	t.Setenv("NS_API_KEYS", "")
+	if keys := apiKeysFromEnv(); len(keys) != 0 {
+		t.Fatalf("expected no keys, got %q", keys)
+	}
+}
+
+func TestValidAPIKey(t *testing.T) {
+	keys := []string{"key-one", "key-two"}
+	for key, expected := range map[string]bool{"key-one": true, "key-two": true, "key-three": false, "key": false, "": false} {
+		if valid := validAPIKey(keys, key); valid != expected {
+			t.Errorf("expected %q to be valid: %v, got %v", key, expected, valid)
+		}
+	}
+}
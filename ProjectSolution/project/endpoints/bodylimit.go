@@ -0,0 +1,59 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"example.com/projectsolution/project/models"
+	"github.com/gin-gonic/gin"
+)
+
+// Room in a request body for everything besides the message: the other fields, the template's vars
+// or a bulk request's recipients
+const requestBodyOverhead = 256 * 1024
+
+// ====== REQUEST BODY LIMIT ======
+
+// Largest accepted request body: a message and a template of up to models.MaxMessageSize each, plus the overhead
+func maxRequestBodySize() int64 {
+	return 2*int64(models.MaxMessageSize) + requestBodyOverhead
+}
+
+// Caps the request body at maxRequestBodySize(), so an oversized one is cut off while it is read
+// instead of being buffered whole. The handler reports it with bodyTooLarge()
+func limitRequestBody() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxRequestBodySize())
+		ctx.Next()
+	}
+}
+
+// Whether reading the body failed on the limitRequestBody() cap. Responds with 413 if it did
+func bodyTooLarge(ctx *gin.Context, err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	if !errors.As(err, &maxBytesErr) {
+		return false
+	}
+	ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{
+		"message": fmt.Sprintf("Request body is too large, the maximum is %d bytes", maxBytesErr.Limit),
+	})
+	return true
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"example.com/projectsolution/project/models"
+	"github.com/gin-gonic/gin"
+)
+
+func limitedRouter() *gin.Engine {
+	router := gin.New()
+	router.POST("/notification", limitRequestBody(), notificationHandler())
+	router.POST("/notifications/bulk", limitRequestBody(), bulkNotificationHandler())
+	return router
+}
+
+func TestOversizedFormBodyIsRejected(t *testing.T) {
+	response := postForm(t, limitedRouter(), "/notification", url.Values{
+		"mode": {"sms"}, "message": {strings.Repeat("a", int(maxRequestBodySize()))},
+	})
+	if response.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d %s", response.Code, response.Body)
+	}
+}
+
+func TestOversizedMultipartBodyIsRejected(t *testing.T) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("mode", "sms")
+	form.WriteField("message", strings.Repeat("a", int(maxRequestBodySize())))
+	form.Close()
+
+	request := httptest.NewRequest(http.MethodPost, "/notification", &body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	response := httptest.NewRecorder()
+	limitedRouter().ServeHTTP(response, request)
+
+	if response.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d %s", response.Code, response.Body)
+	}
+}
+
+func TestOversizedBulkBodyIsRejected(t *testing.T) {
+	body := `{"mode": "sms", "message": "` + strings.Repeat("a", int(maxRequestBodySize())) + `"}`
+	request := httptest.NewRequest(http.MethodPost, "/notifications/bulk", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	limitedRouter().ServeHTTP(response, request)
+
+	if response.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d %s", response.Code, response.Body)
+	}
+}
+
+func TestMessageOverMaxMessageSizeIsRejected(t *testing.T) {
+	oversized := strings.Repeat("a", models.MaxMessageSize+1)
+
+	response := postForm(t, limitedRouter(), "/notification", url.Values{
+		"mode": {"sms"}, "recipient": {"+15550100"}, "message": {oversized},
+	})
+	if response.Code != http.StatusRequestEntityTooLarge || !strings.Contains(response.Body.String(), "Message is too large") {
+		t.Fatalf("expected a 413 for the message, got %d %s", response.Code, response.Body)
+	}
+
+	body := `{"mode": "sms", "recipients": ["+15550100"], "message": "` + oversized + `"}`
+	request := httptest.NewRequest(http.MethodPost, "/notifications/bulk", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	bulkResponse := httptest.NewRecorder()
+	limitedRouter().ServeHTTP(bulkResponse, request)
+	if bulkResponse.Code != http.StatusRequestEntityTooLarge || !strings.Contains(bulkResponse.Body.String(), "Message is too large") {
+		t.Fatalf("expected a 413 for the bulk message, got %d %s", bulkResponse.Code, bulkResponse.Body)
+	}
+}
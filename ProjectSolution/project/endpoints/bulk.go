@@ -0,0 +1,186 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/kafkawrapper"
+	"example.com/projectsolution/project/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const defaultBulkMaxRecipients = 500
+
+// ====== BULK NOTIFICATIONS ======
+
+// Body of a 'notifications/bulk' request: one message for many recipients
+type bulkNotificationRequest struct {
+	Mode             string   `json:"mode"`
+	Message          string   `json:"message"`
+	MaxRetryAttempts *int     `json:"max_retry_attempts"`
+	Recipients       []string `json:"recipients"`
+}
+
+// Cap on the recipients of a single bulk request, configured with NS_BULK_MAX_RECIPIENTS
+func bulkMaxRecipients() int {
+	value := os.Getenv("NS_BULK_MAX_RECIPIENTS")
+	if value == "" {
+		return defaultBulkMaxRecipients
+	}
+
+	maxRecipients, err := strconv.Atoi(value)
+	if err != nil || maxRecipients <= 0 {
+		log.Printf("ignoring invalid NS_BULK_MAX_RECIPIENTS %q", value)
+		return defaultBulkMaxRecipients
+	}
+	return maxRecipients
+}
+
+// End-point handler for 'notifications/bulk' requests
+// Dispatches one notification per recipient and returns their messageIDs right away, without waiting
+// for the results. Clients poll 'notification/:id' for the outcome of each
+func bulkNotificationHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var request bulkNotificationRequest
+		if err := ctx.ShouldBindJSON(&request); err != nil {
+			if bodyTooLarge(ctx, err) {
+				return
+			}
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "Request body is not a valid bulk notification"})
+			return
+		}
+
+		if !slices.Contains(supportedModes, request.Mode) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "Mode is either blank or not one of the supported modes: 'email', 'sms', 'slack' or 'webhook'"})
+			return
+		}
+		if request.Message == "" {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "Message is blank"})
+			return
+		}
+		if err := models.CheckMessageSize(request.Message); err != nil {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Message is too large: " + err.Error()})
+			return
+		}
+
+		maxRetryAttempts, _ := strconv.Atoi(maxNumberDefaultRetries)
+		if request.MaxRetryAttempts != nil {
+			maxRetryAttempts = *request.MaxRetryAttempts
+		}
+
+		if len(request.Recipients) == 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "'recipients' is empty"})
+			return
+		}
+		if maxRecipients := bulkMaxRecipients(); len(request.Recipients) > maxRecipients {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{
+				"message": fmt.Sprintf("Too many recipients, at most %d are allowed per request", maxRecipients),
+			})
+			return
+		}
+		for _, recipient := range request.Recipients {
+			if recipient == "" || (request.Mode == "email" && len(models.SplitRecipients(recipient)) == 0) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": "'recipients' contains a blank recipient"})
+				return
+			}
+			if err := checkRecipient(request.Mode, recipient); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+				return
+			}
+		}
+
+		notifications := make([]models.Notification, 0, len(request.Recipients))
+		for _, recipient := range request.Recipients {
+			notifications = append(notifications, models.Notification{
+				Mode:             request.Mode,
+				Message:          request.Message,
+				MaxRetryAttempts: maxRetryAttempts,
+				Recipient:        recipient,
+			})
+		}
+
+		ctx.JSON(http.StatusAccepted, gin.H{"notifications": dispatchBulkNotifications(notifications)})
+	}
+}
+
+// Add each recipient's notification to the store and send them all for processing with one producer,
+// reporting per recipient its messageID or why it couldn't be dispatched
+func dispatchBulkNotifications(notifications []models.Notification) []gin.H {
+	entries := make([]gin.H, len(notifications))
+	messageIDs := make([]uuid.UUID, 0, len(notifications))
+	accepted := make([]int, 0, len(notifications))
+	stored := make([]models.Notification, 0, len(notifications))
+
+	for i, notification := range notifications {
+		entries[i] = gin.H{"recipient": notification.Recipient}
+
+		messageID, reason := storeBulkNotification(notification)
+		if reason != "" {
+			entries[i]["error"] = reason
+			continue
+		}
+		messageIDs = append(messageIDs, messageID)
+		accepted = append(accepted, i)
+		stored = append(stored, notificationStore.Get(messageID))
+	}
+	if len(stored) == 0 {
+		return entries
+	}
+
+	errs := kafkawrapper.SendKafkaMessages(config.Current().Topics.ForMode(stored[0].Mode), stored)
+	for j, err := range errs {
+		entry, messageID := entries[accepted[j]], messageIDs[j]
+		if err != nil {
+			log.Printf("failed to dispatch bulk notification %s: %v", messageID, err)
+			notificationStore.Delete(messageID)
+			entry["error"] = "Internal server error"
+			continue
+		}
+		notificationsReceived.WithLabelValues(stored[j].Mode).Inc()
+
+		// Nobody waits on the result, keep it queryable for as long as a blocking request would have waited and then some
+		notificationStore.Expire(messageID, hardTimeout*time.Second+resultRetention())
+
+		entry["message_id"] = messageID
+	}
+	return entries
+}
+
+// Charge the throttles for the recipient's notification and add it to the store
+// Returns its messageID, or why it was refused
+func storeBulkNotification(notification models.Notification) (uuid.UUID, string) {
+	// Global throttle across all modes, every recipient counts as a notification, and per recipient of the mode
+	if allowed, reason, _ := allowNotification(notification.Mode, notification.Recipient); !allowed {
+		return uuid.Nil, reason
+	}
+
+	messageID, err := notificationStore.Add(notification)
+	if err != nil {
+		return uuid.Nil, "Internal server error"
+	}
+	return messageID, ""
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// POST the JSON body to the bulk handler and return the recorded response
+func postBulk(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	router := gin.New()
+	router.POST("/notifications/bulk", bulkNotificationHandler())
+
+	request := httptest.NewRequest(http.MethodPost, "/notifications/bulk", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	return response
+}
+
+type bulkEntry struct {
+	Recipient string    `json:"recipient"`
+	MessageID uuid.UUID `json:"message_id"`
+	Error     string    `json:"error"`
+}
+
+func bulkEntries(t *testing.T, response *httptest.ResponseRecorder) []bulkEntry {
+	var body struct {
+		Notifications []bulkEntry `json:"notifications"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return body.Notifications
+}
+
+func TestBulkDispatchesEveryRecipientWithOneProducer(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakeProducer(t)
+
+	start := time.Now()
+	response := postBulk(t, `{"mode": "sms", "message": "Hello", "max_retry_attempts": 2,
+		"recipients": ["+15555550100", "+15555550101", "+15555550102"]}`)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d %s", response.Code, response.Body)
+	}
+	// Nobody waits on the results
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the request to return right away, took %s", elapsed)
+	}
+
+	entries := bulkEntries(t, response)
+	if len(entries) != 3 {
+		t.Fatalf("expected an entry per recipient, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		stored, exists := notificationStore.Lookup(entry.MessageID)
+		if entry.Error != "" || !exists {
+			t.Fatalf("entry %d: expected a stored notification, got %+v", i, entry)
+		}
+		if stored.Recipient != entry.Recipient || stored.MaxRetryAttempts != 2 {
+			t.Fatalf("entry %d: stored notification doesn't match the request: %+v", i, stored)
+		}
+	}
+
+	if opened, closed := producer.Opened(); opened != 1 || closed != 1 {
+		t.Fatalf("expected one producer for the whole request, got %d opened and %d closed", opened, closed)
+	}
+	dispatched := producer.Notifications(config.Current().Topics.Sms)
+	if len(dispatched) != 3 {
+		t.Fatalf("expected 3 notifications on the sms topic, got %d", len(dispatched))
+	}
+	for i, notification := range dispatched {
+		if notification.MessageID != entries[i].MessageID {
+			t.Fatalf("expected the dispatched notifications in the order of the recipients")
+		}
+	}
+}
+
+func TestBulkReportsRecipientsThatCouldNotBeDispatched(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakeProducer(t)
+	producer.TopicErrs[config.Current().Topics.Slack] = errors.New("broker unavailable")
+
+	response := postBulk(t, `{"mode": "slack", "message": "Hello", "recipients": ["#ops", "#dev"]}`)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d %s", response.Code, response.Body)
+	}
+	for _, entry := range bulkEntries(t, response) {
+		if entry.Error == "" || entry.MessageID != uuid.Nil {
+			t.Fatalf("expected the failed dispatch to be reported, got %+v", entry)
+		}
+	}
+}
+
+func TestBulkChecksEveryAddressOfAnEmailRecipient(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakeProducer(t)
+	t.Setenv("NS_EMAIL_ALLOWED_DOMAINS", "allowed.com")
+
+	// The allowed address doesn't let the other one through
+	response := postBulk(t, `{"mode": "email", "message": "Hello", "recipients": ["a@evil.com,b@allowed.com"]}`)
+	if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "evil.com") {
+		t.Fatalf("expected the list to be rejected for evil.com, got %d %s", response.Code, response.Body)
+	}
+	if produced := producer.Messages(config.Current().Topics.Email); len(produced) != 0 {
+		t.Fatalf("expected nothing to be produced, got %d", len(produced))
+	}
+
+	response = postBulk(t, `{"mode": "email", "message": "Hello", "recipients": ["a@allowed.com, b@allowed.com", " , "]}`)
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("expected a list without an address to be rejected, got %d %s", response.Code, response.Body)
+	}
+
+	response = postBulk(t, `{"mode": "email", "message": "Hello", "recipients": ["a@allowed.com, b@allowed.com"]}`)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("expected a list of allowed addresses to be accepted, got %d %s", response.Code, response.Body)
+	}
+}
+
+func TestBulkValidation(t *testing.T) {
+	useMemoryStore(t)
+	useFakeProducer(t)
+	t.Setenv("NS_BULK_MAX_RECIPIENTS", "2")
+
+	tests := map[string]struct {
+		body string
+		code int
+	}{
+		"not json":         {`recipients`, http.StatusBadRequest},
+		"unknown mode":     {`{"mode": "fax", "message": "Hello", "recipients": ["+15555550100"]}`, http.StatusBadRequest},
+		"blank message":    {`{"mode": "sms", "message": "", "recipients": ["+15555550100"]}`, http.StatusBadRequest},
+		"no recipients":    {`{"mode": "sms", "message": "Hello", "recipients": []}`, http.StatusBadRequest},
+		"blank recipient":  {`{"mode": "sms", "message": "Hello", "recipients": ["+15555550100", ""]}`, http.StatusBadRequest},
+		"invalid channel":  {`{"mode": "slack", "message": "Hello", "recipients": ["Not A Channel"]}`, http.StatusBadRequest},
+		"too many":         {`{"mode": "sms", "message": "Hello", "recipients": ["+15555550100", "+15555550101", "+15555550102"]}`, http.StatusRequestEntityTooLarge},
+		"within the limit": {`{"mode": "sms", "message": "Hello", "recipients": ["+15555550100", "+15555550101"]}`, http.StatusAccepted},
+	}
+	for name, test := range tests {
+		if response := postBulk(t, test.body); response.Code != test.code {
+			t.Fatalf("%s: expected %d, got %d %s", name, test.code, response.Code, response.Body)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"sync"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/models"
+	"github.com/google/uuid"
+)
+
+const defaultResultCacheStaleness = time.Second
+
+// ====== RESULT CACHE ======
+
+type cachedNotification struct {
+	notification models.Notification
+	cachedAt     time.Time
+}
+
+// Short-lived in-process cache for status reads, so frequently polled notifications
+// don't hit the backing store on every read. Entries older than `staleness` are never served
+type ResultCache struct {
+	data      map[uuid.UUID]cachedNotification
+	staleness time.Duration
+	// Bumped by every Invalidate(), so a read that raced an update doesn't get cached, see Set()
+	generation uint64
+	mu         sync.Mutex
+}
+
+// Create a result cache. A staleness of 0 disables caching
+func NewResultCache(staleness time.Duration) *ResultCache {
+	return &ResultCache{
+		data:      make(map[uuid.UUID]cachedNotification),
+		staleness: staleness,
+	}
+}
+
+// Staleness configured with NS_RESULT_CACHE_STALENESS, e.g. "500ms". "0" disables the cache
+func resultCacheStaleness() time.Duration {
+	return config.DurationFromEnv("NS_RESULT_CACHE_STALENESS", defaultResultCacheStaleness)
+}
+
+// Returns the cached notification if there is one that isn't stale yet
+func (rc *ResultCache) Get(messageID uuid.UUID) (models.Notification, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	cached, exists := rc.data[messageID]
+	if !exists {
+		return models.Notification{}, false
+	}
+	if time.Since(cached.cachedAt) > rc.staleness {
+		delete(rc.data, messageID)
+		return models.Notification{}, false
+	}
+	return cached.notification, true
+}
+
+// The current generation, to take before reading the store and pass to Set()
+func (rc *ResultCache) Generation() uint64 {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.generation
+}
+
+// Cache a notification read from the store, unless something got invalidated since `generation`
+// was taken: the read may predate an update and caching it would serve the stale value
+func (rc *ResultCache) Set(messageID uuid.UUID, notification models.Notification, generation uint64) {
+	if rc.staleness == 0 {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if generation != rc.generation {
+		return
+	}
+	rc.data[messageID] = cachedNotification{notification: notification, cachedAt: time.Now()}
+}
+
+// Drop the cached notification, e.g. because the store got updated
+func (rc *ResultCache) Invalidate(messageID uuid.UUID) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.data, messageID)
+	rc.generation++
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/models"
+	"example.com/projectsolution/project/store"
+	"github.com/google/uuid"
+)
+
+func TestResultCacheServesUntilStale(t *testing.T) {
+	cache := NewResultCache(50 * time.Millisecond)
+	messageID := uuid.New()
+
+	cache.Set(messageID, models.Notification{Message: "cached"}, cache.Generation())
+	if notification, cached := cache.Get(messageID); !cached || notification.Message != "cached" {
+		t.Fatalf("expected the fresh entry to be served, got %v", cached)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, cached := cache.Get(messageID); cached {
+		t.Fatalf("expected the stale entry not to be served")
+	}
+}
+
+func TestResultCacheDisabled(t *testing.T) {
+	cache := NewResultCache(0)
+	messageID := uuid.New()
+
+	cache.Set(messageID, models.Notification{}, cache.Generation())
+	if _, cached := cache.Get(messageID); cached {
+		t.Fatalf("expected nothing to be cached with a staleness of 0")
+	}
+}
+
+func TestResultCacheDropsReadsThatRacedAnInvalidate(t *testing.T) {
+	cache := NewResultCache(time.Minute)
+	messageID := uuid.New()
+
+	// A read started, then an update invalidated the entry before the read got cached
+	generation := cache.Generation()
+	cache.Invalidate(messageID)
+	cache.Set(messageID, models.Notification{Message: "stale"}, generation)
+
+	if _, cached := cache.Get(messageID); cached {
+		t.Fatalf("expected a read that predates the invalidation not to be cached")
+	}
+}
+
+func TestLookupSeesUpdatesThroughTheCache(t *testing.T) {
+	notifications := newNotificationStore(store.NewMemoryStore())
+	messageID, err := notifications.Add(models.Notification{Mode: "sms", Message: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cached by the first read
+	if notification, exists := notifications.Lookup(messageID); !exists || notification.IsSent {
+		t.Fatalf("expected the unsent notification, got %+v", notification)
+	}
+
+	sent := notifications.Get(messageID)
+	sent.IsSent = true
+	notifications.Update(messageID, sent)
+	if notification, _ := notifications.Lookup(messageID); !notification.IsSent {
+		t.Fatalf("expected the update to invalidate the cached notification")
+	}
+
+	notifications.Delete(messageID)
+	if _, exists := notifications.Lookup(messageID); exists {
+		t.Fatalf("expected the delete to invalidate the cached notification")
+	}
+}
+
+func TestResultCacheStalenessFromEnv(t *testing.T) {
+	t.Setenv("NS_RESULT_CACHE_STALENESS", "250ms")
+	if staleness := resultCacheStaleness(); staleness != 250*time.Millisecond {
+		t.Fatalf("expected 250ms, got %s", staleness)
+	}
+	t.Setenv("NS_RESULT_CACHE_STALENESS", "0")
+	if staleness := resultCacheStaleness(); staleness != 0 {
+		t.Fatalf("expected 0 to disable the cache, got %s", staleness)
+	}
+	t.Setenv("NS_RESULT_CACHE_STALENESS", "soon")
+	if staleness := resultCacheStaleness(); staleness != defaultResultCacheStaleness {
+		t.Fatalf("expected the default for an invalid value, got %s", staleness)
+	}
+}
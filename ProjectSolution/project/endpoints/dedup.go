@@ -0,0 +1,75 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"sync"
+	"time"
+
+	"example.com/projectsolution/project/config"
+)
+
+const defaultDedupWindow = 5 * time.Minute
+
+// ====== DEDUPLICATION ======
+
+// Remembers when a notification carrying a client-provided `dedup_key` was last sent successfully or
+// scheduled, so noisy alert sources repeating the same notification within the window get suppressed
+type DedupStore struct {
+	sentAt map[string]time.Time
+	mu     sync.Mutex
+}
+
+var dedupStore = DedupStore{
+	sentAt: make(map[string]time.Time),
+}
+
+// Window configured with NS_DEDUP_WINDOW, e.g. "10m"
+func dedupWindow() time.Duration {
+	return config.DurationFromEnv("NS_DEDUP_WINDOW", defaultDedupWindow)
+}
+
+// Checks whether a notification with the same key was sent successfully or scheduled within the window
+func (ds *DedupStore) IsDuplicate(dedupKey string, window time.Duration) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	sentAt, exists := ds.sentAt[dedupKey]
+	if !exists {
+		return false
+	}
+	if time.Since(sentAt) > window {
+		delete(ds.sentAt, dedupKey)
+		return false
+	}
+	return true
+}
+
+// Record a successful send, or a notification scheduled, for the key, dropping keys that have expired in the meantime
+func (ds *DedupStore) Record(dedupKey string, window time.Duration) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	now := time.Now()
+	for key, sentAt := range ds.sentAt {
+		if now.Sub(sentAt) > window {
+			delete(ds.sentAt, key)
+		}
+	}
+	ds.sentAt[dedupKey] = now
+}
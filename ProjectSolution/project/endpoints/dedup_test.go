@@ -0,0 +1,112 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDedupStoreWithinWindow(t *testing.T) {
+	dedup := DedupStore{sentAt: make(map[string]time.Time)}
+
+	if dedup.IsDuplicate("disk-full", time.Minute) {
+		t.Fatalf("expected an unseen key not to be a duplicate")
+	}
+	dedup.Record("disk-full", time.Minute)
+	if !dedup.IsDuplicate("disk-full", time.Minute) {
+		t.Fatalf("expected a recorded key to be a duplicate within the window")
+	}
+	if dedup.IsDuplicate("cpu-high", time.Minute) {
+		t.Fatalf("expected another key not to be a duplicate")
+	}
+}
+
+func TestDedupStoreExpiresKeys(t *testing.T) {
+	dedup := DedupStore{sentAt: make(map[string]time.Time)}
+
+	dedup.Record("disk-full", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	if dedup.IsDuplicate("disk-full", 10*time.Millisecond) {
+		t.Fatalf("expected the key to expire after the window")
+	}
+
+	// Recording prunes expired keys
+	dedup.Record("old", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	dedup.Record("new", 10*time.Millisecond)
+	if _, exists := dedup.sentAt["old"]; exists {
+		t.Fatalf("expected the expired key to be pruned")
+	}
+}
+
+func TestNotificationHandlerSuppressesDuplicates(t *testing.T) {
+	dedupStore.Record("test-dedup-key", time.Minute)
+	t.Cleanup(func() {
+		dedupStore.mu.Lock()
+		delete(dedupStore.sentAt, "test-dedup-key")
+		dedupStore.mu.Unlock()
+	})
+
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+	response := postForm(t, router, "/notification", url.Values{
+		"mode": {"sms"}, "message": {"Disk full"}, "recipient": {"+15550100"}, "dedup_key": {"test-dedup-key"},
+	})
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "suppressed as duplicate") {
+		t.Fatalf("expected the notification to be suppressed, got %d %s", response.Code, response.Body)
+	}
+}
+
+func TestScheduledNotificationSuppressesItsRepeats(t *testing.T) {
+	useMemoryStore(t)
+	useFakeProducer(t)
+	scheduler := useScheduler(t)
+	t.Cleanup(func() {
+		dedupStore.mu.Lock()
+		delete(dedupStore.sentAt, "test-scheduled-dedup-key")
+		dedupStore.mu.Unlock()
+	})
+
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+	form := url.Values{
+		"mode": {"sms"}, "message": {"Maintenance tonight"}, "recipient": {"+15550100"},
+		"dedup_key": {"test-scheduled-dedup-key"}, "send_at": {time.Now().Add(time.Hour).Format(time.RFC3339)},
+	}
+	if response := postForm(t, router, "/notification", form); response.Code != http.StatusAccepted {
+		t.Fatalf("expected the notification to be scheduled, got %d %s", response.Code, response.Body)
+	}
+
+	// Sent right away or scheduled again, the repeat is suppressed
+	for _, sendAt := range []string{"", time.Now().Add(2 * time.Hour).Format(time.RFC3339)} {
+		form.Set("send_at", sendAt)
+		response := postForm(t, router, "/notification", form)
+		if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "suppressed as duplicate") {
+			t.Fatalf("send_at %q: expected the repeat to be suppressed, got %d %s", sendAt, response.Code, response.Body)
+		}
+	}
+	if len(scheduler.scheduled()) != 1 {
+		t.Fatalf("expected only the first notification to be scheduled, got %d", len(scheduler.scheduled()))
+	}
+}
@@ -19,97 +19,260 @@ package endpoints
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"example.com/projectsolution/project/catalog"
+	"example.com/projectsolution/project/config"
 	"example.com/projectsolution/project/kafkawrapper"
 	"example.com/projectsolution/project/models"
+	"example.com/projectsolution/project/services"
+	"example.com/projectsolution/project/signing"
+	"example.com/projectsolution/project/store"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
-	ProducerPort            = ":8080"
-	kafkaTopicProcessed     = "processed"
 	maxNumberDefaultRetries = "5"
 	hardTimeout             = 60
+	defaultReplayWindow     = "1h"
+	replayTimeout           = 30
+	defaultResultRetention  = time.Minute
+	shutdownTimeout         = hardTimeout + 5
+	defaultStorePath        = "notifications.db"
 )
 
+var kafkaTopicProcessed = config.Current().Topics.Processed
+
+// Modes a notification can be sent on
+var supportedModes = []string{"email", "sms", "slack", "webhook"}
+
+// Content types an email body can be sent as
+var supportedContentTypes = []string{"text/plain", "text/html"}
+
 // ====== NOTIFICATION STORAGE ======
-type MessageNotification map[uuid.UUID]models.Notification
 
+// The notification store used by the end-points and the 'processed' consumer: any store.Store backend,
+// with recent reads served from the result cache and the Idempotency-Keys of recent requests
+// The result cache and the Idempotency-Keys live in this process only. Instances sharing a backend
+// each dedupe their own requests and may serve a result up to the cache's staleness old
 type NotificationStore struct {
-	data MessageNotification
-	mu   sync.RWMutex
+	backend     store.Store
+	cache       *ResultCache
+	idempotency map[string]idempotencyEntry
+	janitorStop chan struct{}
+	janitorDone chan struct{}
+	mu          sync.Mutex
 }
 
-// Create the 'database' for messages
-var notificationStore = NotificationStore{
-	data: make(MessageNotification),
-}
+// Create the 'database' for messages, replaced by the NS_STORE_BACKEND one when the server starts
+var notificationStore = newNotificationStore(store.NewMemoryStore())
 
-// Loads messages onto the store, while tagging each message with a messageID
-func (ns *NotificationStore) Add(notification models.Notification) (messageID uuid.UUID, err error) {
-	ns.mu.Lock()
-	defer ns.mu.Unlock()
+func newNotificationStore(backend store.Store) *NotificationStore {
+	return &NotificationStore{
+		backend:     backend,
+		cache:       NewResultCache(resultCacheStaleness()),
+		idempotency: make(map[string]idempotencyEntry),
+	}
+}
 
-	maxChecks := 500
-	// Check for duplicates
-	for attempt := 0; attempt <= maxChecks; attempt++ {
-		messageID = uuid.New()
-		if _, exists := ns.data[messageID]; !exists {
-			// Assign timestamp and messageID
-			notification.TimeStamp = time.Now()
-			notification.MessageID = messageID
-			ns.data[messageID] = notification
-			return messageID, nil
+// Backend picked with NS_STORE_BACKEND: "memory" (default) or "bolt", persisted to the NS_STORE_PATH file
+// A backend that can't be opened is an error rather than a silent fall back to memory, which would
+// lose the persistence it was configured for
+func storeFromEnv() (store.Store, error) {
+	switch backend := os.Getenv("NS_STORE_BACKEND"); backend {
+	case "", "memory":
+		return store.NewMemoryStore(), nil
+	case "bolt":
+		path := os.Getenv("NS_STORE_PATH")
+		if path == "" {
+			path = defaultStorePath
 		}
+		boltStore, err := store.OpenBoltStore(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the bolt store: %w", err)
+		}
+		return boltStore, nil
+	default:
+		return nil, fmt.Errorf("unknown NS_STORE_BACKEND %q, expected 'memory' or 'bolt'", backend)
 	}
-	return uuid.UUID{}, fmt.Errorf("Could not find a free key to insert into map")
 }
 
-// Update the store with an updated notification
-func (ns *NotificationStore) Update(messageID uuid.UUID, notification models.Notification) {
-	ns.mu.Lock()
-	defer ns.mu.Unlock()
+// Replace the store backend, e.g. with one shared by several instances
+// Only the backend is shared, see NotificationStore. A BoltStore can't be: its file is locked by one process
+func SetStore(backend store.Store) {
+	notificationStore = newNotificationStore(backend)
+}
 
-	ns.data[messageID] = notification
+// Loads messages onto the store, while tagging each message with a messageID
+func (ns *NotificationStore) Add(notification models.Notification) (uuid.UUID, error) {
+	return ns.backend.Add(notification)
+}
+
+// Update the store with an updated notification
+func (ns *NotificationStore) Update(messageID uuid.UUID, notification models.Notification) error {
+	err := ns.backend.Update(messageID, notification)
+	ns.cache.Invalidate(messageID)
+	return err
 }
 
 // Delete the item from the store
 func (ns *NotificationStore) Delete(messageID uuid.UUID) {
-	ns.mu.Lock()
-	defer ns.mu.Unlock()
+	if err := ns.backend.Delete(messageID); err != nil {
+		log.Printf("%v", err)
+	}
+	ns.cache.Invalidate(messageID)
+}
 
-	if _, exists := ns.data[messageID]; exists {
-		delete(ns.data, messageID)
+// Delete the item from the store once the retention window is over, so its status can still be queried
+// A retention of 0 deletes it right away
+func (ns *NotificationStore) Expire(messageID uuid.UUID, retention time.Duration) {
+	if retention <= 0 {
+		ns.Delete(messageID)
+		return
 	}
+	time.AfterFunc(retention, func() { ns.Delete(messageID) })
+}
+
+// Like Get(), but also reports whether the message is in the store
+func (ns *NotificationStore) Lookup(messageID uuid.UUID) (models.Notification, bool) {
+	if notification, cached := ns.cache.Get(messageID); cached {
+		return notification, true
+	}
+
+	generation := ns.cache.Generation()
+	notification, exists, err := ns.backend.Get(messageID)
+	if err != nil {
+		log.Printf("%v", err)
+		return models.Notification{}, false
+	}
+	if exists {
+		ns.cache.Set(messageID, notification, generation)
+	}
+	return notification, exists
+}
+
+// How long finished notifications stay queryable, configured with NS_RESULT_RETENTION, e.g. "5m"
+func resultRetention() time.Duration {
+	return config.DurationFromEnv("NS_RESULT_RETENTION", defaultResultRetention)
 }
 
 // Retrieves messages from the store, using the messageID to identify the correct message
+// Recent reads are served from the result cache
 func (ns *NotificationStore) Get(messageID uuid.UUID) models.Notification {
-	ns.mu.RLock()
-	defer ns.mu.RUnlock()
-	return ns.data[messageID]
+	notification, _ := ns.Lookup(messageID)
+	return notification
 }
 
+// Serve the end-points until SIGINT or SIGTERM, then drain in-flight requests before returning
 func SetupEndpoints() {
-	gin.SetMode(gin.ReleaseMode)
-	router := gin.Default()
-	router.POST("/notification", notificationHandler())
+	backend, err := storeFromEnv()
+	if err != nil {
+		log.Fatalf("failed to set up the notification store: %v", err)
+	}
+	SetStore(backend)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
-	if err := router.Run(ProducerPort); err != nil {
+	if err := Run(ctx); err != nil {
 		log.Printf("failed to run the server: %v", err)
 	}
 }
 
+// Serve the end-points until `ctx` is done, then shut down gracefully: in-flight requests get up to
+// shutdownTimeout to finish while results keep being consumed from the 'processed' topic
+func Run(ctx context.Context) error {
+	// Continuously get results from the 'processed' topic, until the server has drained
+	consumerCtx, stopConsumer := context.WithCancel(context.WithoutCancel(ctx))
+	defer stopConsumer()
+	kafkawrapper.StartReceivingKafkaMessages(consumerCtx, kafkaTopicProcessed, ReceiveProcessedNotification)
+
+	// Dispatch scheduled notifications as they become due, until Run returns, including the ones
+	// scheduled before a restart. The janitor starts after them so it leaves them alone
+	if err := notificationScheduler.restore(notificationStore.backend); err != nil {
+		log.Printf("%v", err)
+	}
+	schedulerCtx, stopScheduler := context.WithCancel(ctx)
+	schedulerDone := make(chan struct{})
+	go func() {
+		defer close(schedulerDone)
+		notificationScheduler.Run(schedulerCtx)
+	}()
+	defer func() {
+		stopScheduler()
+		<-schedulerDone
+	}()
+
+	// Remove notifications abandoned in the store
+	notificationStore.StartJanitor(janitorInterval(), storeTTL())
+	defer notificationStore.StopJanitor()
+
+	server := &http.Server{
+		Addr:    config.Current().ProducerPort,
+		Handler: newRouter(),
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down the server: %w", err)
+	}
+	return nil
+}
+
+// All the end-points
+func newRouter() *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.Default()
+	router.GET("/health", healthHandler())
+
+	api := router.Group("/", apiKeyAuth(apiKeysFromEnv()))
+	api.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	api.POST("/notification", limitRequestBody(), notificationHandler())
+	api.GET("/notification/:id", notificationStatusHandler())
+	api.POST("/notifications/bulk", limitRequestBody(), bulkNotificationHandler())
+
+	admin := router.Group("/admin", adminAuth())
+	admin.POST("/replay", replayHandler())
+	admin.GET("/consumers", consumerStatusHandler())
+	admin.GET("/vars", gin.WrapH(expvar.Handler()))
+	admin.POST("/test/:mode", providerTestHandler())
+	admin.POST("/consumers/:mode/pause", pauseConsumerHandler())
+	admin.POST("/consumers/:mode/resume", resumeConsumerHandler())
+
+	return router
+}
+
 // Function gets the results from the kafka topics
-func GetResults(ctx context.Context, messageID uuid.UUID, wasSuccessful chan bool) {
+// Sends exactly one result and returns, or returns without sending once `ctx` is done
+func GetResults(ctx context.Context, messageID uuid.UUID, wasSuccessful chan<- bool) {
 
 	// Check every 100ms or until we timeout at the caller
 	ticker := time.NewTicker(time.Millisecond * 100)
@@ -122,50 +285,353 @@ func GetResults(ctx context.Context, messageID uuid.UUID, wasSuccessful chan boo
 			// Check the messageID we expect to receive
 			resultMsg := notificationStore.Get(messageID)
 
-			// Check if our message has been processed
-			if resultMsg.IsSent {
-				wasSuccessful <- true
+			// Not processed yet: neither sent nor a retry failure
+			if !resultMsg.IsSent && resultMsg.FailReason == "" {
+				continue
 			}
 
-			// Check if we have a retry failure
-			if resultMsg.FailReason != "" {
-				wasSuccessful <- false
+			// The caller may have stopped listening in the meantime
+			select {
+			case wasSuccessful <- resultMsg.IsSent:
+			case <-ctx.Done():
 			}
+			return
+		}
+	}
+}
+
+// Wait for a success or failure from our services. Or a hard timeout
+func waitForResult(messageID uuid.UUID) (isSuccess bool, timedOut bool) {
+	return waitForResultWithin(messageID, hardTimeout*time.Second)
+}
+
+// Wait for a success or failure from our services, for at most `timeout`
+func waitForResultWithin(messageID uuid.UUID, timeout time.Duration) (isSuccess bool, timedOut bool) {
+	resultCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Buffered so GetResults never blocks on a result nobody reads
+	wasSuccessfulChan := make(chan bool, 1)
+	go GetResults(resultCtx, messageID, wasSuccessfulChan)
+
+	select {
+	case isSuccess := <-wasSuccessfulChan:
+		return isSuccess, false
+	case <-time.After(timeout):
+		return false, true
+	}
+}
+
+// Updates the Notification Store with all processed notifications, counting their results
+func ReceiveProcessedNotification(receivedNotification *models.Notification) error {
+	recordResultMetrics(receivedNotification)
+	return storeProcessedNotification(receivedNotification)
+}
+
+// Updates the Notification Store with a processed notification, without counting it again
+// Used by replays, whose results were counted when first consumed
+// A failed update is returned, so the message isn't marked as consumed with its result lost
+func storeProcessedNotification(receivedNotification *models.Notification) error {
+	return notificationStore.Update(receivedNotification.MessageID, *receivedNotification)
+}
+
+// End-point handler returning the current state of a notification, so clients can poll instead of
+// blocking on the POST. Finished notifications stay available for the NS_RESULT_RETENTION window
+func notificationStatusHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		messageID, err := uuid.Parse(ctx.Param("id"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "'id' is not a valid notification ID"})
+			return
+		}
+
+		notification, exists := notificationStore.Lookup(messageID)
+		if !exists {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": "Notification not found"})
+			return
+		}
+		ctx.JSON(http.StatusOK, notification)
+	}
+}
+
+// Whether a notification to several recipients reached at least one of them
+func sentToSome(results []models.RecipientResult) bool {
+	for _, result := range results {
+		if result.IsSent {
+			return true
+		}
+	}
+	return false
+}
+
+// ====== RECIPIENT DEFAULTS ======
+
+// Per mode, the env var with the documented default recipient (email address for email, telephone number
+// for sms, channel for slack) and the env var which, when "true", makes the request's 'recipient' mandatory
+var recipientDefaults = map[string]struct {
+	defaultEnv string
+	requireEnv string
+}{
+	"email": {defaultEnv: "NS_EMAIL_DEFAULT_RECIPIENT", requireEnv: "NS_EMAIL_REQUIRE_RECIPIENT"},
+	"sms":   {defaultEnv: "NS_SMS_RECEIVER_TELEPHONE", requireEnv: "NS_SMS_REQUIRE_RECIPIENT"},
+	"slack": {defaultEnv: "NS_SLACK_CHANNEL", requireEnv: "NS_SLACK_REQUIRE_RECIPIENT"},
+}
+
+// Returns the recipient to use for the mode: the one from the request, otherwise the mode's default
+// An error is returned when the mode requires a recipient or when there is no default to fall back to
+func resolveRecipient(mode string, recipient string) (string, error) {
+	if recipient != "" {
+		return recipient, nil
+	}
+
+	defaults, exists := recipientDefaults[mode]
+	if !exists {
+		return "", fmt.Errorf("'recipient' is required for mode '%s'", mode)
+	}
+	if os.Getenv(defaults.requireEnv) == "true" {
+		return "", fmt.Errorf("'recipient' is required for mode '%s'", mode)
+	}
+
+	recipient = os.Getenv(defaults.defaultEnv)
+	if recipient == "" {
+		return "", fmt.Errorf("'recipient' is blank and no default is configured for mode '%s' (%s)",
+			mode, defaults.defaultEnv)
+	}
+	return recipient, nil
+}
+
+// Checks a single recipient is valid for the mode: an allowed email domain, a Slack channel name or ID
+// or a webhook URL
+func checkRecipient(mode string, recipient string) error {
+	switch mode {
+	case "email":
+		// Every address in a comma-separated list has to be allowed, not just the string as a whole
+		for _, single := range models.SplitRecipients(recipient) {
+			if err := checkEmailDomainAllowed(single); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "slack":
+		return services.CheckSlackChannel(recipient)
+	case "webhook":
+		return checkWebhookURL(recipient)
+	}
+	return nil
+}
+
+// A webhook recipient has to be an absolute http(s) URL
+func checkWebhookURL(recipient string) error {
+	webhookURL, err := url.Parse(recipient)
+	if err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+		return fmt.Errorf("'recipient' must be an http or https URL for mode 'webhook'")
+	}
+	return nil
+}
+
+// Checks the recipient's domain against the optional NS_EMAIL_ALLOWED_DOMAINS allowlist (comma-separated)
+// Used to keep test environments from emailing external addresses. No allowlist means every domain is allowed
+func checkEmailDomainAllowed(recipient string) error {
+	allowedDomains := os.Getenv("NS_EMAIL_ALLOWED_DOMAINS")
+	if allowedDomains == "" {
+		return nil
+	}
+
+	at := strings.LastIndex(recipient, "@")
+	if at == -1 {
+		return fmt.Errorf("recipient '%s' is not an email address", recipient)
+	}
+	domain := strings.ToLower(recipient[at+1:])
+
+	for _, allowedDomain := range strings.Split(allowedDomains, ",") {
+		if domain == strings.ToLower(strings.TrimSpace(allowedDomain)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("recipient domain '%s' is not in the allowed email domains", domain)
+}
+
+// Admin end-point handler that rebuilds the store from the 'processed' topic
+// Useful for recovery after the store has been wiped, e.g. by a restart
+func replayHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+
+		// Check if optional parameter 'window' is sent. "0" replays the whole topic
+		replay_window := ctx.PostForm("window")
+		if replay_window == "" {
+			replay_window = defaultReplayWindow
+		}
+		window, err := time.ParseDuration(replay_window)
+		if err != nil || window < 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "'window' is not a valid duration, e.g. '30m' or '2h'"})
+			return
+		}
+
+		replayCtx, cancel := context.WithTimeout(ctx.Request.Context(), replayTimeout*time.Second)
+		defer cancel()
+
+		replayed, err := kafkawrapper.ReplayKafkaTopic(replayCtx, kafkaTopicProcessed, window, storeProcessedNotification)
+		if err != nil {
+			log.Printf("failed to replay the '%s' topic: %v", kafkaTopicProcessed, err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"message":  "Replay did not complete",
+				"replayed": replayed,
+			})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, gin.H{
+			"message":  "Replay completed",
+			"replayed": replayed,
+		})
+	}
+}
+
+// Admin end-point handler sending a synthetic message straight through a mode's provider
+// Returns the raw provider result, for checking credentials without going through Kafka
+func providerTestHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mode := ctx.Param("mode")
+		if !slices.Contains(supportedModes, mode) {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": fmt.Sprintf("Unknown mode '%s'", mode)})
+			return
+		}
+
+		recipient, err := resolveRecipient(mode, ctx.PostForm("recipient"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
 
+		notification, err := services.SendTestNotification(mode, ctx.PostForm("provider"), recipient)
+		if err != nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+			return
+		}
+
+		ctx.JSON(http.StatusOK, gin.H{
+			"is_sent":     notification.IsSent,
+			"fail_reason": notification.FailReason,
+			"result":      notification.Result,
+		})
+	}
+}
+
+// Admin end-point handler reporting which mode consumers are running or paused
+func consumerStatusHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H{"consumers": services.ModeConsumerStatus()})
+	}
+}
+
+// Admin end-point handler pausing a mode's consumer, e.g. during a provider incident
+// Notifications for the mode queue up on its topic until it is resumed
+func pauseConsumerHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mode := ctx.Param("mode")
+		if err := services.PauseMode(mode); err != nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+			return
 		}
+		ctx.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Consumer for mode '%s' paused", mode)})
 	}
 }
 
-// Updates the Notification Store with all processed notifications
-func ReceiveProcessedNotification(receivedNotification *models.Notification) {
-	notificationStore.Update(receivedNotification.MessageID, *receivedNotification)
+// Admin end-point handler resuming a paused mode's consumer
+func resumeConsumerHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		mode := ctx.Param("mode")
+		if err := services.ResumeMode(mode); err != nil {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("Consumer for mode '%s' resumed", mode)})
+	}
 }
 
 // End-point handler for all 'notification' requests
 // Dispatches Kafka messages on the appropriate topics
 func notificationHandler() gin.HandlerFunc {
-
-	// Continuously get results from the 'processed' topic
-	ctx := context.Background()
-	go kafkawrapper.ReceiveKafkaMessage(ctx, kafkaTopicProcessed, ReceiveProcessedNotification)
-
 	return func(ctx *gin.Context) {
+		notificationsInFlight.Inc()
+		defer notificationsInFlight.Dec()
 
 		// Checking the validity of the request
 
+		// Read the form up front, as the field getters hide a body cut off by limitRequestBody()
+		err := ctx.Request.ParseForm()
+		if err == nil {
+			_, err = ctx.MultipartForm()
+		}
+		if bodyTooLarge(ctx, err) {
+			return
+		}
+
+		// Check if optional parameter 'user_id' is sent
+		// The notification then goes to all of the user's channels instead of a single mode and recipient
+		userID := ctx.PostForm("user_id")
+
 		// Check if required parameter 'mode' is sent
 		mode := ctx.PostForm("mode")
-		if mode == "" || (mode != "email" && mode != "sms" && mode != "slack") {
-			ctx.JSON(http.StatusBadRequest, gin.H{"message": "Mode is either blank or not one of the supported modes: 'email', 'sms' or 'slack'"})
+		if userID == "" && !slices.Contains(supportedModes, mode) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "Mode is either blank or not one of the supported modes: 'email', 'sms', 'slack' or 'webhook'"})
 			return
 		}
 
 		// Check if required parameter 'message' is sent
 		message := ctx.PostForm("message")
+
+		// Check if optional parameters 'message_key' and 'locale' are sent
+		// The message is then looked up in the catalog for the locale instead of sent verbatim
+		locale := ctx.PostForm("locale")
+		if messageKey := ctx.PostForm("message_key"); messageKey != "" {
+			localized, err := catalog.Default().Resolve(messageKey, locale)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+				return
+			}
+			message = localized
+		}
+
+		// Check if optional parameters 'template' and 'vars' are sent
+		// The message is then rendered from the template instead of sent verbatim
+		if messageTemplate := ctx.PostForm("template"); messageTemplate != "" {
+			rendered, err := renderMessageTemplate(messageTemplate, ctx.PostForm("vars"))
+			var tooLarge *models.MessageTooLargeError
+			if errors.As(err, &tooLarge) {
+				ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Message is too large: " + tooLarge.Error()})
+				return
+			}
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+				return
+			}
+			message = rendered
+		}
 		if message == "" {
 			ctx.JSON(http.StatusBadRequest, gin.H{"message": "Message is blank"})
 			return
 		}
+		if err := models.CheckMessageSize(message); err != nil {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Message is too large: " + err.Error()})
+			return
+		}
+
+		// Check if optional parameter 'subject' is sent
+		// Overrides the mode's default subject template, for modes with subjects
+		subject := ctx.PostForm("subject")
+		if strings.ContainsAny(subject, "\r\n") {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "'subject' must be a single line"})
+			return
+		}
+
+		// Check if optional parameter 'content_type' is sent
+		// Sends the email body as "text/plain" or "text/html" instead of without a Content-Type
+		contentType := ctx.PostForm("content_type")
+		if contentType != "" && !slices.Contains(supportedContentTypes, contentType) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "'content_type' is not one of 'text/plain' or 'text/html'"})
+			return
+		}
 
 		// Check if optional parameter 'max_retry_attempts' is sent
 		max_retry_attempts := ctx.PostForm("max_retry_attempts")
@@ -179,57 +645,256 @@ func notificationHandler() gin.HandlerFunc {
 		}
 
 		// Check if optional parameter 'recipient' is sent
-		// For now recipient only works for email. Can do a basic regex check for email syntax.
-		recipient := ctx.PostForm("recipient")
-		if mode == "email" && recipient == "" {
-			recipient = os.Getenv("NS_EMAIL_DEFAULT_RECIPIENT")
+		// Can do a basic regex check for email syntax.
+		// Rejected up front when neither the request nor the mode's default provide one
+		var recipient string
+		if userID == "" {
+			recipient, err = resolveRecipient(mode, ctx.PostForm("recipient"))
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+				return
+			}
+			// Email takes a comma-separated list of recipients
+			if mode == "email" {
+				recipients := models.SplitRecipients(recipient)
+				if len(recipients) == 0 {
+					ctx.JSON(http.StatusBadRequest, gin.H{"message": "'recipient' is blank"})
+					return
+				}
+				recipient = strings.Join(recipients, ",")
+			}
+			if err := checkRecipient(mode, recipient); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+				return
+			}
 		}
 
-		// Add it to the store for reference
-		messageID, err := notificationStore.Add(models.Notification{mode, message, maxRetryAttempts,
-			recipient, time.Time{}, uuid.UUID{}, 0, false, ""})
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"message": "Internal server error"})
+		// Check if optional parameter 'provider' is sent
+		// Picks one of the providers configured for the mode, e.g. for A/B testing or cost routing
+		provider := ctx.PostForm("provider")
+		if provider != "" && userID == "" && !slices.Contains(services.ProviderNames(mode), provider) {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"message": fmt.Sprintf("Provider '%s' is not one of the providers configured for mode '%s': %s",
+					provider, mode, strings.Join(services.ProviderNames(mode), ", ")),
+			})
+			return
+		}
+
+		// Check if optional parameter 'analytics_context' is sent
+		// A flat JSON object, e.g. {"campaign_id": "spring-sale", "source": "billing"}
+		var analyticsContext map[string]string
+		if analytics_context := ctx.PostForm("analytics_context"); analytics_context != "" {
+			if err := json.Unmarshal([]byte(analytics_context), &analyticsContext); err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": "'analytics_context' is not a JSON object of strings"})
+				return
+			}
+		}
+
+		// Check if optional parameter 'correlation_id' is sent
+		// The client's own ID, used as the key of the result on the processed topic so external consumers can join on it
+		correlationID := ctx.PostForm("correlation_id")
+
+		// Check if optional parameter 'sign' is sent
+		// Signs the message body so recipients can verify it came from us, needs NS_SIGNING_KEY
+		sign := ctx.PostForm("sign") == "true"
+		if sign && !signing.Configured() {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "Message signing is not configured"})
 			return
 		}
 
-		// Send for Processing
-		kafkaTopic := mode
-		err = kafkawrapper.SendKafkaMessage(kafkaTopic, notificationStore.Get(messageID))
+		// Check if optional parameter 'dedup_key' is sent
+		// Suppress the notification if one with the same key was sent recently
+		dedupKey := ctx.PostForm("dedup_key")
+		if dedupKey != "" && dedupStore.IsDuplicate(dedupKey, dedupWindow()) {
+			ctx.JSON(http.StatusOK, gin.H{
+				"message": "Notification suppressed as duplicate",
+			})
+			return
+		}
+
+		// Check if optional parameter 'send_at' is sent
+		// An RFC3339 time in the future, the notification is then held back and sent at that time
+		var sendAt time.Time
+		if send_at := ctx.PostForm("send_at"); send_at != "" {
+			sendAt, err = time.Parse(time.RFC3339, send_at)
+			if err != nil {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": "'send_at' is not an RFC3339 timestamp"})
+				return
+			}
+			if !sendAt.After(time.Now()) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": "'send_at' is in the past"})
+				return
+			}
+			if userID != "" {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": "'send_at' is not supported with 'user_id'"})
+				return
+			}
+		}
+
+		// Check if optional header 'Idempotency-Key' is sent
+		// A client retrying with the same key gets the original notification's result instead of a second send
+		idempotencyKey := ctx.GetHeader("Idempotency-Key")
+
+		if userID != "" {
+			// Every channel's notification carries the fan-out's ID, so their results can be correlated
+			parentID := uuid.New()
+
+			// Reserved before anything is sent, so a retried fan-out gets the original's response
+			if idempotencyKey != "" {
+				original, duplicate := notificationStore.ReserveIdempotentFanout(idempotencyKey, parentID,
+					idempotencyWindow())
+				if duplicate {
+					respondDuplicateFanout(ctx, original)
+					return
+				}
+			}
+
+			// Global throttle across all modes, consulted only for notifications about to be enqueued
+			if !throttleGlobal(ctx) {
+				if idempotencyKey != "" {
+					notificationStore.ReleaseIdempotencyKey(idempotencyKey)
+				}
+				return
+			}
+
+			fanoutNotification(ctx, userID, models.Notification{
+				Message:          message,
+				Subject:          subject,
+				ContentType:      contentType,
+				MaxRetryAttempts: maxRetryAttempts,
+				Locale:           locale,
+				CorrelationID:    correlationID,
+				Sign:             sign,
+				AnalyticsContext: analyticsContext,
+				ParentID:         parentID,
+			}, ctx.PostForm("stop_on_first_success") == "true", dedupKey, idempotencyKey)
+			return
+		}
+
+		notification := models.Notification{
+			Mode:             mode,
+			Message:          message,
+			Subject:          subject,
+			ContentType:      contentType,
+			MaxRetryAttempts: maxRetryAttempts,
+			Recipient:        recipient,
+			Locale:           locale,
+			Provider:         provider,
+			CorrelationID:    correlationID,
+			Sign:             sign,
+			SendAt:           sendAt,
+			AnalyticsContext: analyticsContext,
+		}
+
+		// Add it to the store for reference
+		start := time.Now()
+		var messageID uuid.UUID
+		duplicate := false
+		if idempotencyKey != "" {
+			messageID, duplicate, err = notificationStore.AddIdempotent(idempotencyKey, notification, idempotencyWindow())
+		} else {
+			messageID, err = notificationStore.Add(notification)
+		}
 		if err != nil {
 			ctx.JSON(http.StatusInternalServerError, gin.H{"message": "Internal server error"})
 			return
 		}
 
-		// Receive the Processing
-		resultCtx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		wasSuccessfulChan := make(chan bool)
-		go GetResults(resultCtx, messageID, wasSuccessfulChan)
+		// Forget a notification that won't be sent after all, so the client can retry with the same key
+		discard := func() {
+			notificationStore.Delete(messageID)
+			if idempotencyKey != "" {
+				notificationStore.ReleaseIdempotencyKey(idempotencyKey)
+			}
+		}
 
-		// Wait for a success or failure from our services. Or a hard timeout
-		select {
-		case isSuccess := <-wasSuccessfulChan:
-			if isSuccess {
-				// Send success
-				ctx.JSON(http.StatusOK, gin.H{
-					"message": "Notification sent successfully!",
-				})
-			} else {
-				// Send failure
-				ctx.JSON(http.StatusRequestTimeout, gin.H{
-					"message": fmt.Sprintf("Notification sending failed after max number of attempts. Notification service error: %s",
-						notificationStore.Get(messageID).FailReason),
+		if duplicate {
+			// The original is kept for the whole window, unless the store lost it
+			original, exists := notificationStore.Lookup(messageID)
+			if !exists {
+				ctx.JSON(http.StatusConflict, gin.H{
+					"message":    "Idempotency-Key was already used for a notification which is no longer available",
+					"message_id": messageID,
 				})
+				return
+			}
+
+			// A scheduled original is acknowledged again, the client polls for its result
+			if !original.SendAt.IsZero() {
+				respondScheduled(ctx, messageID, original.SendAt)
+				return
+			}
+		} else {
+			// Only a new notification counts against the throttles, a client's retry doesn't
+			if !throttleNotification(ctx, mode, recipient) {
+				discard()
+				return
+			}
+
+			// A scheduled notification is stored until its time comes, the client polls for the result
+			// Its repeats are suppressed from now on, like those of one sent right away
+			if !sendAt.IsZero() {
+				notificationScheduler.Schedule(messageID, sendAt)
+				if dedupKey != "" {
+					dedupStore.Record(dedupKey, dedupWindow())
+				}
+				respondScheduled(ctx, messageID, sendAt)
+				return
 			}
-		case <-time.After(hardTimeout * time.Second):
+
+			// Send for Processing
+			kafkaTopic := config.Current().Topics.ForMode(mode)
+			err = kafkawrapper.SendKafkaMessage(kafkaTopic, notificationStore.Get(messageID))
+			if err != nil {
+				discard()
+				ctx.JSON(http.StatusInternalServerError, gin.H{"message": "Internal server error"})
+				return
+			}
+			notificationsReceived.WithLabelValues(mode).Inc()
+		}
+
+		// Receive the Processing, or the original's processing for a duplicate
+		isSuccess, timedOut := waitForResult(messageID)
+		notificationLatency.WithLabelValues(mode).Observe(time.Since(start).Seconds())
+		processed := notificationStore.Get(messageID)
+		response := gin.H{"message_id": messageID, "result": processed.Result}
+		if len(processed.RecipientResults) > 0 {
+			response["recipients"] = processed.RecipientResults
+		}
+		switch {
+		case timedOut:
 			// Send max timeout error
 			ctx.JSON(http.StatusRequestTimeout, gin.H{
-				"message": "Notification sending timed out (" + strconv.FormatUint(hardTimeout, 10) + " seconds)",
+				"message":    "Notification sending timed out (" + strconv.FormatUint(hardTimeout, 10) + " seconds)",
+				"message_id": messageID,
 			})
+		case isSuccess:
+			if dedupKey != "" {
+				dedupStore.Record(dedupKey, dedupWindow())
+			}
+
+			// Send success
+			response["message"] = "Notification sent successfully!"
+			ctx.JSON(http.StatusOK, response)
+		case sentToSome(processed.RecipientResults):
+			// Send partial success
+			response["message"] = fmt.Sprintf("Notification sending partially failed: %s", processed.FailReason)
+			ctx.JSON(http.StatusMultiStatus, response)
+		default:
+			// Send failure
+			response["message"] = fmt.Sprintf(
+				"Notification sending failed after max number of attempts. Notification service error: %s",
+				processed.FailReason)
+			ctx.JSON(http.StatusRequestTimeout, response)
 		}
 
-		notificationStore.Delete(messageID)
+		// The original request owns the notification. Behind a key it stays for the whole idempotency window
+		if !duplicate {
+			retention := resultRetention()
+			if idempotencyKey != "" {
+				retention = max(retention, idempotencyWindow())
+			}
+			notificationStore.Expire(messageID, retention)
+		}
 	}
 }
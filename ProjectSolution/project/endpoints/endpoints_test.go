@@ -0,0 +1,510 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/kafkawrapper"
+	"example.com/projectsolution/project/kafkawrapper/kafkatest"
+	"example.com/projectsolution/project/models"
+	"example.com/projectsolution/project/services"
+	"example.com/projectsolution/project/store"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// POST the form to the handler and return the recorded response
+func postForm(t *testing.T, handler http.Handler, path string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	return response
+}
+
+func TestReplayHandlerRejectsInvalidWindow(t *testing.T) {
+	router := gin.New()
+	router.POST("/admin/replay", replayHandler())
+
+	for _, window := range []string{"soon", "-1h"} {
+		response := postForm(t, router, "/admin/replay", url.Values{"window": {window}})
+		if response.Code != http.StatusBadRequest {
+			t.Fatalf("window %q: expected 400, got %d %s", window, response.Code, response.Body)
+		}
+	}
+}
+
+func TestResolveRecipient(t *testing.T) {
+	for mode, defaults := range recipientDefaults {
+		t.Run(mode, func(t *testing.T) {
+			t.Setenv(defaults.defaultEnv, "")
+			t.Setenv(defaults.requireEnv, "")
+
+			if recipient, err := resolveRecipient(mode, "given"); err != nil || recipient != "given" {
+				t.Fatalf("expected the request's recipient, got %q, %v", recipient, err)
+			}
+			if _, err := resolveRecipient(mode, ""); err == nil || !strings.Contains(err.Error(), defaults.defaultEnv) {
+				t.Fatalf("expected an error naming %s without a default, got %v", defaults.defaultEnv, err)
+			}
+
+			t.Setenv(defaults.defaultEnv, "fallback")
+			if recipient, err := resolveRecipient(mode, ""); err != nil || recipient != "fallback" {
+				t.Fatalf("expected the default recipient, got %q, %v", recipient, err)
+			}
+
+			t.Setenv(defaults.requireEnv, "true")
+			if _, err := resolveRecipient(mode, ""); err == nil {
+				t.Fatalf("expected an error when %s requires a recipient", defaults.requireEnv)
+			}
+			if recipient, err := resolveRecipient(mode, "given"); err != nil || recipient != "given" {
+				t.Fatalf("expected the request's recipient to satisfy %s, got %q, %v", defaults.requireEnv, recipient, err)
+			}
+		})
+	}
+
+	t.Run("webhook", func(t *testing.T) {
+		if _, err := resolveRecipient("webhook", ""); err == nil {
+			t.Fatalf("expected webhook to always require a recipient")
+		}
+	})
+}
+
+func TestNotificationHandlerRejectsMissingRecipient(t *testing.T) {
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	for _, mode := range supportedModes {
+		if defaults, exists := recipientDefaults[mode]; exists {
+			t.Setenv(defaults.defaultEnv, "")
+		}
+		response := postForm(t, router, "/notification", url.Values{"mode": {mode}, "message": {"Hello"}})
+		if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "recipient") {
+			t.Fatalf("mode %s: expected a 400 about the recipient, got %d %s", mode, response.Code, response.Body)
+		}
+	}
+}
+
+func TestCheckEmailDomainAllowed(t *testing.T) {
+	t.Setenv("NS_EMAIL_ALLOWED_DOMAINS", "")
+	if err := checkEmailDomainAllowed("jane@anywhere.org"); err != nil {
+		t.Fatalf("expected every domain to be allowed without an allowlist, got %v", err)
+	}
+
+	t.Setenv("NS_EMAIL_ALLOWED_DOMAINS", "example.com, Corp.Example.org")
+	tests := []struct {
+		recipient string
+		allowed   bool
+	}{
+		{"jane@example.com", true},
+		{"JANE@EXAMPLE.COM", true},
+		{"john@corp.example.org", true},
+		{"jane@example.com.evil.org", false},
+		{"jane@sub.example.com", false},
+		{"@example.org", false},
+		{"not-an-address", false},
+	}
+	for _, test := range tests {
+		if err := checkEmailDomainAllowed(test.recipient); (err == nil) != test.allowed {
+			t.Fatalf("%s: expected allowed=%v, got %v", test.recipient, test.allowed, err)
+		}
+	}
+}
+
+func TestNotificationHandlerRejectsDisallowedEmailDomain(t *testing.T) {
+	t.Setenv("NS_EMAIL_ALLOWED_DOMAINS", "example.com")
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	// Every recipient of a list is checked
+	response := postForm(t, router, "/notification", url.Values{
+		"mode": {"email"}, "message": {"Hello"}, "recipient": {"jane@example.com, john@elsewhere.org"},
+	})
+	if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "elsewhere.org") {
+		t.Fatalf("expected a 400 naming the disallowed domain, got %d %s", response.Code, response.Body)
+	}
+}
+
+func TestPauseAndResumeHandlers(t *testing.T) {
+	router := gin.New()
+	router.POST("/admin/consumers/:mode/pause", pauseConsumerHandler())
+	router.POST("/admin/consumers/:mode/resume", resumeConsumerHandler())
+
+	if response := postForm(t, router, "/admin/consumers/fax/pause", nil); response.Code != http.StatusNotFound {
+		t.Fatalf("expected pausing an unknown mode to be 404, got %d", response.Code)
+	}
+	if response := postForm(t, router, "/admin/consumers/fax/resume", nil); response.Code != http.StatusNotFound {
+		t.Fatalf("expected resuming an unknown mode to be 404, got %d", response.Code)
+	}
+
+	// Resuming a mode that isn't paused does nothing
+	if response := postForm(t, router, "/admin/consumers/webhook/resume", nil); response.Code != http.StatusOK {
+		t.Fatalf("expected resuming a running mode to be 200, got %d", response.Code)
+	}
+}
+
+// A fresh in-memory notification store for the duration of the test
+func useMemoryStore(t *testing.T) {
+	previous := notificationStore
+	SetStore(store.NewMemoryStore())
+	t.Cleanup(func() { notificationStore = previous })
+}
+
+// Records what gets produced for the duration of the test
+func useFakeProducer(t *testing.T) *kafkatest.Producer {
+	producer := kafkatest.NewProducer()
+	previous := kafkawrapper.NewProducer
+	kafkawrapper.NewProducer = producer.Open
+	t.Cleanup(func() { kafkawrapper.NewProducer = previous })
+	return producer
+}
+
+// Stands in for the services for the duration of the test: every notification produced on a mode's
+// topic comes back processed, sent or failed as given for its mode
+func useFakePipeline(t *testing.T, sent map[string]bool) *kafkatest.Producer {
+	return useFakeServices(t, func(notification *models.Notification) {
+		notification.IsSent = sent[notification.Mode]
+		if !notification.IsSent {
+			notification.FailReason = notification.Mode + " provider unavailable"
+		}
+	})
+}
+
+// Stands in for the services for the duration of the test: every notification produced on a mode's
+// topic comes back processed as `process` leaves it
+func useFakeServices(t *testing.T, process func(*models.Notification)) *kafkatest.Producer {
+	producer := useFakeProducer(t)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		<-stopped
+	})
+
+	go func() {
+		defer close(stopped)
+		processed := make(map[string]int)
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			for _, mode := range supportedModes {
+				notifications := producer.Notifications(config.Current().Topics.ForMode(mode))
+				for _, notification := range notifications[processed[mode]:] {
+					process(&notification)
+					ReceiveProcessedNotification(&notification)
+				}
+				processed[mode] = len(notifications)
+			}
+		}
+	}()
+	return producer
+}
+
+func TestProviderResultPropagatesToStatusEndpoint(t *testing.T) {
+	useMemoryStore(t)
+	messageID, err := notificationStore.Add(models.Notification{Mode: "sms", Message: "Hello", Recipient: "+15550100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The services' outcome, as consumed from the processed topic
+	processed := notificationStore.Get(messageID)
+	processed.IsSent = true
+	processed.Result = models.SendResult{ProviderMessageID: "0A0000001", LatencyMillis: 120, Attempts: 2, ResponseCode: "0"}
+	if err := ReceiveProcessedNotification(&processed); err != nil {
+		t.Fatal(err)
+	}
+
+	router := gin.New()
+	router.GET("/notification/:id", notificationStatusHandler())
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/notification/"+messageID.String(), nil))
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", response.Code, response.Body)
+	}
+
+	var status models.Notification
+	if err := json.Unmarshal(response.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.IsSent || status.Result != processed.Result {
+		t.Fatalf("expected the provider result %+v, got %+v", processed.Result, status.Result)
+	}
+}
+
+func TestEmailWithoutRecipientOrDefaultIsRejected(t *testing.T) {
+	t.Setenv("NS_EMAIL_DEFAULT_RECIPIENT", "")
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	response := postForm(t, router, "/notification", url.Values{"mode": {"email"}, "message": {"Hello"}})
+	if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "NS_EMAIL_DEFAULT_RECIPIENT") {
+		t.Fatalf("expected a 400 naming the unset default, got %d %s", response.Code, response.Body)
+	}
+
+	// A list of nothing but separators is no recipient either
+	response = postForm(t, router, "/notification", url.Values{"mode": {"email"}, "message": {"Hello"}, "recipient": {" , ,"}})
+	if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "'recipient' is blank") {
+		t.Fatalf("expected a 400 for the blank recipient list, got %d %s", response.Code, response.Body)
+	}
+}
+
+func TestProviderIsValidatedAgainstTheModesProviders(t *testing.T) {
+	useMemoryStore(t)
+	if err := services.RegisterProvider("sms", "endpoints-secondary", services.SenderFunc(func(*models.Notification) error {
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	form := url.Values{
+		"mode":      {"sms"},
+		"message":   {"Hello"},
+		"recipient": {"+15555550100"},
+		"send_at":   {time.Now().Add(time.Hour).Format(time.RFC3339)},
+		"provider":  {"nope"},
+	}
+	response := postForm(t, router, "/notification", form)
+	if response.Code != http.StatusBadRequest || !strings.Contains(response.Body.String(), "endpoints-secondary") {
+		t.Fatalf("expected a 400 listing the configured providers, got %d %s", response.Code, response.Body)
+	}
+
+	form.Set("provider", "endpoints-secondary")
+	response = postForm(t, router, "/notification", form)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("expected a configured provider to be accepted, got %d %s", response.Code, response.Body)
+	}
+	var body struct {
+		MessageID uuid.UUID `json:"message_id"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if provider := notificationStore.Get(body.MessageID).Provider; provider != "endpoints-secondary" {
+		t.Fatalf("expected the provider to travel with the notification, got %q", provider)
+	}
+}
+
+func TestMultiLineSubjectIsRejected(t *testing.T) {
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	for _, subject := range []string{"Hello\r\nBcc: someone@example.com", "Hello\nBcc: someone@example.com", "Hello\r"} {
+		response := postForm(t, router, "/notification", url.Values{
+			"mode":      {"email"},
+			"message":   {"Hello"},
+			"recipient": {"ops@example.com"},
+			"subject":   {subject},
+		})
+		if response.Code != http.StatusBadRequest {
+			t.Fatalf("expected a 400 for the subject %q, got %d %s", subject, response.Code, response.Body)
+		}
+	}
+}
+
+func TestSubjectAndContentTypeTravelWithTheNotification(t *testing.T) {
+	useMemoryStore(t)
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	form := url.Values{
+		"mode":         {"email"},
+		"message":      {"<p>Hello</p>"},
+		"recipient":    {"ops@example.com"},
+		"subject":      {"Your invoice"},
+		"content_type": {"text/markdown"},
+		"send_at":      {time.Now().Add(time.Hour).Format(time.RFC3339)},
+	}
+	if response := postForm(t, router, "/notification", form); response.Code != http.StatusBadRequest {
+		t.Fatalf("expected a 400 for an unsupported content type, got %d", response.Code)
+	}
+
+	form.Set("content_type", "text/html")
+	response := postForm(t, router, "/notification", form)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("expected the email to be scheduled, got %d %s", response.Code, response.Body)
+	}
+	var body struct {
+		MessageID uuid.UUID `json:"message_id"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	stored := notificationStore.Get(body.MessageID)
+	if stored.Subject != "Your invoice" || stored.ContentType != "text/html" {
+		t.Fatalf("expected the subject and content type on the notification, got %q %q", stored.Subject, stored.ContentType)
+	}
+}
+
+func TestStoreFromEnv(t *testing.T) {
+	t.Setenv("NS_STORE_BACKEND", "")
+	if backend, err := storeFromEnv(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := backend.(*store.MemoryStore); !ok {
+		t.Fatalf("expected the memory store by default, got %T", backend)
+	}
+
+	t.Setenv("NS_STORE_BACKEND", "bolt")
+	t.Setenv("NS_STORE_PATH", filepath.Join(t.TempDir(), "notifications.db"))
+	backend, err := storeFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	boltStore, ok := backend.(*store.BoltStore)
+	if !ok {
+		t.Fatalf("expected the bolt store, got %T", backend)
+	}
+	boltStore.Close()
+
+	// Fails fast rather than quietly tracking notifications in memory
+	t.Setenv("NS_STORE_PATH", filepath.Join(t.TempDir(), "missing", "notifications.db"))
+	if _, err := storeFromEnv(); err == nil {
+		t.Fatalf("expected a bolt store that can't be opened to be an error")
+	}
+	t.Setenv("NS_STORE_BACKEND", "redis")
+	if _, err := storeFromEnv(); err == nil {
+		t.Fatalf("expected an unknown backend to be an error")
+	}
+}
+
+func TestPartialSuccessIsReportedPerRecipient(t *testing.T) {
+	useMemoryStore(t)
+	useFakeServices(t, func(notification *models.Notification) {
+		for _, recipient := range models.SplitRecipients(notification.Recipient) {
+			sent := recipient != "bad@example.com"
+			notification.RecipientResults = append(notification.RecipientResults,
+				models.RecipientResult{Recipient: recipient, IsSent: sent})
+		}
+		notification.FailReason = "failed to send to 1 of 2 recipients: bad@example.com"
+	})
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	response := postForm(t, router, "/notification", url.Values{
+		"mode":      {"email"},
+		"message":   {"Hello"},
+		"recipient": {"ok@example.com, bad@example.com"},
+	})
+	if response.Code != http.StatusMultiStatus {
+		t.Fatalf("expected 207 for a partial success, got %d %s", response.Code, response.Body)
+	}
+
+	var body struct {
+		Recipients []models.RecipientResult `json:"recipients"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Recipients) != 2 || !body.Recipients[0].IsSent || body.Recipients[1].IsSent {
+		t.Fatalf("expected which recipients succeeded and which failed, got %s", response.Body)
+	}
+}
+
+func TestWebhookRecipientMustBeAnHTTPURL(t *testing.T) {
+	valid := []string{"https://example.com/hook", "http://10.0.0.1:8080/notify?source=ns"}
+	invalid := []string{"example.com/hook", "ftp://example.com/hook", "https://", "/hook", "not a url"}
+	for _, recipient := range valid {
+		if err := checkRecipient("webhook", recipient); err != nil {
+			t.Fatalf("%q: expected a valid webhook URL, got %v", recipient, err)
+		}
+	}
+	for _, recipient := range invalid {
+		if err := checkRecipient("webhook", recipient); err == nil {
+			t.Fatalf("%q: expected an invalid webhook URL", recipient)
+		}
+	}
+}
+
+func TestRunServesUntilTheContextIsDone(t *testing.T) {
+	useMemoryStore(t)
+	useFakeProducer(t)
+	t.Cleanup(func() { gin.SetMode(gin.TestMode) })
+
+	// A free address nobody listens on yet
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	// Without a broker the processed consumer keeps failing to join meanwhile
+	previous := config.Current()
+	current := previous
+	current.ProducerPort = address
+	current.KafkaBrokers = []string{"127.0.0.1:1"}
+	config.SetCurrent(current)
+	t.Cleanup(func() { config.SetCurrent(previous) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	returned := make(chan error, 1)
+	go func() { returned <- Run(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		response, err := http.Get("http://" + address + "/health")
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("expected /health to be 200, got %d", response.StatusCode)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the server to come up: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatalf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Run to return once its context was done")
+	}
+	if !kafkawrapper.WaitForConsumers(5 * time.Second) {
+		t.Fatalf("expected the processed consumer to have stopped")
+	}
+	if _, err := http.Get("http://" + address + "/health"); err == nil {
+		t.Fatalf("expected the server to be closed")
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/kafkawrapper"
+	"example.com/projectsolution/project/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ====== USER FAN-OUT ======
+
+// The longest a fan-out tried until the first success waits on its channels altogether
+var fanoutTimeout = hardTimeout * time.Second
+
+// Send the notification to every channel of the user that they haven't opted out of, and report
+// the outcome per channel. All channels are dispatched before waiting so they get processed in parallel
+// With `stopOnFirstSuccess` the channels are instead tried one at a time, and the remaining ones
+// are cancelled as soon as one succeeds
+// Behind an Idempotency-Key, reserved by the caller, the response is kept for the requests retrying the
+// fan-out, unless nothing was sent, which releases the key so the client can retry
+func fanoutNotification(ctx *gin.Context, userID string, notification models.Notification,
+	stopOnFirstSuccess bool, dedupKey string, idempotencyKey string) {
+
+	respond := func(code int, body gin.H) {
+		if idempotencyKey != "" {
+			notificationStore.CompleteIdempotentFanout(idempotencyKey, code, body)
+		}
+		ctx.JSON(code, body)
+	}
+	refuse := func(code int, body gin.H) {
+		if idempotencyKey != "" {
+			notificationStore.ReleaseIdempotencyKey(idempotencyKey)
+		}
+		ctx.JSON(code, body)
+	}
+
+	profile, exists := userProfiles.Get(userID)
+	if !exists {
+		refuse(http.StatusNotFound, gin.H{"message": fmt.Sprintf("Unknown user '%s'", userID)})
+		return
+	}
+
+	targets, err := userTargets(profile)
+	if err != nil {
+		refuse(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	for _, target := range targets {
+		if err := checkRecipient(target.mode, target.recipient); err != nil {
+			refuse(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		}
+	}
+
+	var channels []gin.H
+	var sentCount int
+	if stopOnFirstSuccess {
+		channels, sentCount, err = sendUntilFirstSuccess(notification, targets)
+	} else {
+		channels, sentCount, err = sendToAllChannels(notification, targets)
+	}
+	if err != nil {
+		log.Printf("failed to fan out notification %s: %v", notification.ParentID, err)
+		refuse(http.StatusInternalServerError, gin.H{"message": "Internal server error"})
+		return
+	}
+
+	if sentCount == 0 {
+		respond(http.StatusRequestTimeout, gin.H{
+			"message":   "Notification sending failed on every channel",
+			"parent_id": notification.ParentID,
+			"channels":  channels,
+		})
+		return
+	}
+
+	if dedupKey != "" {
+		dedupStore.Record(dedupKey, dedupWindow())
+	}
+	respond(http.StatusOK, gin.H{
+		"message":   fmt.Sprintf("Notification sent on %d of %d channels", sentCount, len(targets)),
+		"parent_id": notification.ParentID,
+		"channels":  channels,
+	})
+}
+
+// Dispatch every channel, then wait for all of their results
+func sendToAllChannels(notification models.Notification, targets []fanoutTarget) ([]gin.H, int, error) {
+	channels := make([]gin.H, len(targets))
+	messageIDs := make([]uuid.UUID, len(targets))
+	defer func() {
+		for _, messageID := range messageIDs {
+			if messageID != uuid.Nil {
+				notificationStore.Expire(messageID, resultRetention())
+			}
+		}
+	}()
+
+	// Send for Processing
+	for i, target := range targets {
+		messageID, err := dispatchChannel(notification, target)
+		if errors.Is(err, errRecipientThrottled) {
+			channels[i] = throttledChannel(target)
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		messageIDs[i] = messageID
+	}
+
+	// Receive the Processing of every dispatched channel
+	sentCount := 0
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		if messageIDs[i] == uuid.Nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			isSuccess, timedOut := waitForResult(messageIDs[i])
+			channels[i] = channelResult(target, messageIDs[i], isSuccess, timedOut)
+			if isSuccess {
+				mu.Lock()
+				sentCount++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return channels, sentCount, nil
+}
+
+// Try the channels in order, one at a time, cancelling the remaining ones once a channel succeeds
+// The fan-out as a whole waits no longer than fanoutTimeout, shared by the channels still to be tried,
+// so a channel that never answers leaves the others their turn
+func sendUntilFirstSuccess(notification models.Notification, targets []fanoutTarget) ([]gin.H, int, error) {
+	deadline := time.Now().Add(fanoutTimeout)
+	channels := make([]gin.H, 0, len(targets))
+	for i, target := range targets {
+		messageID, err := dispatchChannel(notification, target)
+		if errors.Is(err, errRecipientThrottled) {
+			channels = append(channels, throttledChannel(target))
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		share := time.Until(deadline) / time.Duration(len(targets)-i)
+		isSuccess, timedOut := waitForResultWithin(messageID, share)
+		channels = append(channels, channelResult(target, messageID, isSuccess, timedOut))
+		notificationStore.Expire(messageID, resultRetention())
+
+		if isSuccess {
+			for _, cancelled := range targets[i+1:] {
+				channels = append(channels, gin.H{
+					"mode":      cancelled.mode,
+					"recipient": cancelled.recipient,
+					"status":    "cancelled",
+				})
+			}
+			return channels, 1, nil
+		}
+	}
+	return channels, 0, nil
+}
+
+// A channel left out of the fan-out because its recipient has had too many notifications
+var errRecipientThrottled = errors.New("recipient rate limit exceeded")
+
+// Add the channel's notification to the store and send it for processing
+// Every channel counts against its recipient's limit, the fan-out as a whole against the global one
+func dispatchChannel(notification models.Notification, target fanoutTarget) (uuid.UUID, error) {
+	notification.Mode = target.mode
+	notification.Recipient = target.recipient
+
+	if allowed, _ := allowRecipients(target.mode, target.recipient); !allowed {
+		return uuid.UUID{}, errRecipientThrottled
+	}
+
+	messageID, err := notificationStore.Add(notification)
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+
+	err = kafkawrapper.SendKafkaMessage(config.Current().Topics.ForMode(target.mode), notificationStore.Get(messageID))
+	if err != nil {
+		notificationStore.Delete(messageID)
+		return uuid.UUID{}, err
+	}
+	notificationsReceived.WithLabelValues(target.mode).Inc()
+	return messageID, nil
+}
+
+// The outcome of a channel that wasn't dispatched for its recipient's rate limit
+func throttledChannel(target fanoutTarget) gin.H {
+	return gin.H{
+		"mode":        target.mode,
+		"recipient":   target.recipient,
+		"status":      "throttled",
+		"fail_reason": "Recipient rate limit exceeded",
+	}
+}
+
+// The outcome of one channel of a fan-out
+func channelResult(target fanoutTarget, messageID uuid.UUID, isSuccess bool, timedOut bool) gin.H {
+	notification := notificationStore.Get(messageID)
+	status := "sent"
+	switch {
+	case timedOut:
+		status = "timed out"
+	case !isSuccess:
+		status = "failed"
+	}
+
+	return gin.H{
+		"mode":        target.mode,
+		"recipient":   target.recipient,
+		"message_id":  messageID,
+		"status":      status,
+		"fail_reason": notification.FailReason,
+		"result":      notification.Result,
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/models"
+	"github.com/gin-gonic/gin"
+)
+
+// Fan out to a user on email, sms and slack and return the response
+func fanoutToAllChannels(t *testing.T, form url.Values) (int, fanoutResponse) {
+	useUserProfiles(t, map[string]models.UserProfile{
+		"alice": {Channels: map[string]string{"email": "alice@example.com", "sms": "+15555550100", "slack": "#alice"}},
+	})
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	form.Set("user_id", "alice")
+	form.Set("message", "Hello")
+	response := postForm(t, router, "/notification", form)
+	var body fanoutResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return response.Code, body
+}
+
+func channelStatuses(body fanoutResponse) map[string]string {
+	statuses := make(map[string]string)
+	for _, channel := range body.Channels {
+		statuses[channel.Mode] = channel.Status
+	}
+	return statuses
+}
+
+func TestFirstSuccessCancelsTheRemainingChannels(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakePipeline(t, map[string]bool{"email": false, "sms": true, "slack": true})
+
+	code, body := fanoutToAllChannels(t, url.Values{"stop_on_first_success": {"true"}})
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+
+	expected := map[string]string{"email": "failed", "sms": "sent", "slack": "cancelled"}
+	if statuses := channelStatuses(body); !maps.Equal(statuses, expected) {
+		t.Fatalf("expected %v, got %v", expected, statuses)
+	}
+	if len(producer.Messages(config.Current().Topics.Slack)) != 0 {
+		t.Fatalf("expected the cancelled channel never to be sent")
+	}
+}
+
+func TestUnansweredChannelLeavesTheOthersTheirTurn(t *testing.T) {
+	useMemoryStore(t)
+	previous := fanoutTimeout
+	fanoutTimeout = 600 * time.Millisecond
+	t.Cleanup(func() { fanoutTimeout = previous })
+	// Email never answers
+	useFakeServices(t, func(notification *models.Notification) {
+		notification.IsSent = notification.Mode != "email"
+	})
+
+	start := time.Now()
+	code, body := fanoutToAllChannels(t, url.Values{"stop_on_first_success": {"true"}})
+	if elapsed := time.Since(start); elapsed > fanoutTimeout {
+		t.Fatalf("expected the fan-out to be over within %s, took %s", fanoutTimeout, elapsed)
+	}
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	expected := map[string]string{"email": "timed out", "sms": "sent", "slack": "cancelled"}
+	if statuses := channelStatuses(body); !maps.Equal(statuses, expected) {
+		t.Fatalf("expected %v, got %v", expected, statuses)
+	}
+}
+
+func TestWithoutStopOnFirstSuccessEveryChannelIsSent(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakePipeline(t, map[string]bool{"email": true, "sms": true, "slack": true})
+
+	code, body := fanoutToAllChannels(t, url.Values{})
+	if code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", code)
+	}
+	for mode, status := range channelStatuses(body) {
+		if status != "sent" {
+			t.Fatalf("expected every channel to be sent, %s was %s", mode, status)
+		}
+	}
+	topics := config.Current().Topics
+	for _, topic := range []string{topics.Email, topics.Sms, topics.Slack} {
+		if len(producer.Messages(topic)) != 1 {
+			t.Fatalf("expected a notification on %s", topic)
+		}
+	}
+}
+
+func TestStopOnFirstSuccessWhenEveryChannelFails(t *testing.T) {
+	useMemoryStore(t)
+	useFakePipeline(t, map[string]bool{})
+
+	code, body := fanoutToAllChannels(t, url.Values{"stop_on_first_success": {"true"}})
+	if code != http.StatusRequestTimeout {
+		t.Fatalf("expected every channel failing to be a failure, got %d", code)
+	}
+	for mode, status := range channelStatuses(body) {
+		if status != "failed" {
+			t.Fatalf("expected every channel to be tried and fail, %s was %s", mode, status)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const defaultIdempotencyWindow = 10 * time.Minute
+
+// ====== IDEMPOTENCY KEYS ======
+
+// The notification a client's Idempotency-Key was first used for, or the parent ID of the fan-out
+type idempotencyEntry struct {
+	messageID uuid.UUID
+	expiresAt time.Time
+	// The fan-out's response, nil for a single notification
+	fanout *fanoutOutcome
+}
+
+// The response to a fan-out, for the requests retrying it. `done` is closed once it is known, or once
+// the key is released, which leaves `body` nil
+type fanoutOutcome struct {
+	done chan struct{}
+	code int
+	body gin.H
+}
+
+// Window configured with NS_IDEMPOTENCY_WINDOW, e.g. "1h"
+func idempotencyWindow() time.Duration {
+	return config.PositiveDurationFromEnv("NS_IDEMPOTENCY_WINDOW", defaultIdempotencyWindow)
+}
+
+// Add the notification unless the key was already used within the window, in which case the messageID
+// of the original notification is returned with `duplicate` set. Checking and adding happen under the
+// same lock, so of two racing requests with the same key exactly one adds its notification
+func (ns *NotificationStore) AddIdempotent(idempotencyKey string, notification models.Notification,
+	window time.Duration) (messageID uuid.UUID, duplicate bool, err error) {
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	// Expired keys are only removed by the janitor, until then they count as unused
+	now := time.Now()
+	if entry, exists := ns.idempotency[idempotencyKey]; exists && now.Before(entry.expiresAt) {
+		return entry.messageID, true, nil
+	}
+
+	messageID, err = ns.backend.Add(notification)
+	if err != nil {
+		return uuid.UUID{}, false, err
+	}
+	ns.idempotency[idempotencyKey] = idempotencyEntry{messageID: messageID, expiresAt: now.Add(window)}
+	return messageID, false, nil
+}
+
+// Reserve the key for the fan-out unless it was already used within the window, in which case the
+// entry it was used for is returned with `duplicate` set. Complete or release the reservation once
+// the fan-out is over
+func (ns *NotificationStore) ReserveIdempotentFanout(idempotencyKey string, parentID uuid.UUID,
+	window time.Duration) (original idempotencyEntry, duplicate bool) {
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	now := time.Now()
+	if entry, exists := ns.idempotency[idempotencyKey]; exists && now.Before(entry.expiresAt) {
+		return entry, true
+	}
+	ns.idempotency[idempotencyKey] = idempotencyEntry{
+		messageID: parentID,
+		expiresAt: now.Add(window),
+		fanout:    &fanoutOutcome{done: make(chan struct{})},
+	}
+	return idempotencyEntry{}, false
+}
+
+// Keep the fan-out's response for the requests retrying it with the key
+func (ns *NotificationStore) CompleteIdempotentFanout(idempotencyKey string, code int, body gin.H) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if entry, exists := ns.idempotency[idempotencyKey]; exists && entry.fanout != nil {
+		entry.fanout.finish(code, body)
+	}
+}
+
+// Forget the key, e.g. because its notification could not be dispatched and the client should retry
+func (ns *NotificationStore) ReleaseIdempotencyKey(idempotencyKey string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	if entry, exists := ns.idempotency[idempotencyKey]; exists && entry.fanout != nil {
+		entry.fanout.finish(0, nil)
+	}
+	delete(ns.idempotency, idempotencyKey)
+}
+
+// Remove the keys whose window is over. Called by the janitor, so requests don't scan every key
+func (ns *NotificationStore) expireIdempotencyKeys(now time.Time) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	for key, entry := range ns.idempotency {
+		if now.After(entry.expiresAt) {
+			delete(ns.idempotency, key)
+		}
+	}
+}
+
+// Set the response and wake the requests waiting for it. Only the first call counts. Callers hold ns.mu
+func (outcome *fanoutOutcome) finish(code int, body gin.H) {
+	select {
+	case <-outcome.done:
+	default:
+		outcome.code, outcome.body = code, body
+		close(outcome.done)
+	}
+}
+
+// Respond to a retried fan-out with the original's response, waiting for it while it is in progress
+func respondDuplicateFanout(ctx *gin.Context, original idempotencyEntry) {
+	if original.fanout == nil {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"message":    "Idempotency-Key was already used for a notification without 'user_id'",
+			"message_id": original.messageID,
+		})
+		return
+	}
+
+	select {
+	case <-original.fanout.done:
+	case <-time.After(hardTimeout * time.Second):
+		ctx.JSON(http.StatusRequestTimeout, gin.H{
+			"message":   "Notification sending timed out (" + strconv.FormatUint(hardTimeout, 10) + " seconds)",
+			"parent_id": original.messageID,
+		})
+		return
+	}
+	if original.fanout.body == nil {
+		ctx.JSON(http.StatusConflict, gin.H{
+			"message":   "The notification first sent with this Idempotency-Key was not sent, retry it",
+			"parent_id": original.messageID,
+		})
+		return
+	}
+	ctx.JSON(original.fanout.code, original.fanout.body)
+}
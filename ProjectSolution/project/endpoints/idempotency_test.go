@@ -0,0 +1,220 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// POST the form with an Idempotency-Key, returning the response code and its message_id
+func postWithIdempotencyKey(t *testing.T, handler http.Handler, key string, form url.Values) (int, uuid.UUID) {
+	request := httptest.NewRequest(http.MethodPost, "/notification", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Idempotency-Key", key)
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+
+	var body struct {
+		MessageID uuid.UUID `json:"message_id"`
+	}
+	json.Unmarshal(response.Body.Bytes(), &body)
+	return response.Code, body.MessageID
+}
+
+func TestConcurrentDuplicatesAddOneNotification(t *testing.T) {
+	useMemoryStore(t)
+
+	const requests = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	added := 0
+	messageIDs := make(map[uuid.UUID]bool)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			messageID, duplicate, err := notificationStore.AddIdempotent("order-1234",
+				models.Notification{Mode: "sms", Message: "Shipped", Recipient: "+15550100"}, time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !duplicate {
+				added++
+			}
+			messageIDs[messageID] = true
+		}()
+	}
+	wg.Wait()
+
+	if added != 1 || len(messageIDs) != 1 {
+		t.Fatalf("expected exactly one notification for the key, got %d added under %d message IDs",
+			added, len(messageIDs))
+	}
+}
+
+func TestExpiredKeyAddsANewNotification(t *testing.T) {
+	useMemoryStore(t)
+	notification := models.Notification{Mode: "sms", Message: "Shipped", Recipient: "+15550100"}
+
+	first, _, err := notificationStore.AddIdempotent("order-1234", notification, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	second, duplicate, err := notificationStore.AddIdempotent("order-1234", notification, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if duplicate || second == first {
+		t.Fatalf("expected an expired key to add a new notification, got %s again", second)
+	}
+
+	// And the new one holds the key for its own window
+	if third, duplicate, _ := notificationStore.AddIdempotent("order-1234", notification, time.Minute); !duplicate || third != second {
+		t.Fatalf("expected the key to return %s within the window, got %s", second, third)
+	}
+}
+
+func TestReleasedKeyCanBeReused(t *testing.T) {
+	useMemoryStore(t)
+	notification := models.Notification{Mode: "sms", Message: "Shipped", Recipient: "+15550100"}
+
+	first, _, _ := notificationStore.AddIdempotent("order-1234", notification, time.Minute)
+	notificationStore.ReleaseIdempotencyKey("order-1234")
+	if second, duplicate, _ := notificationStore.AddIdempotent("order-1234", notification, time.Minute); duplicate || second == first {
+		t.Fatalf("expected a released key to add a new notification")
+	}
+}
+
+func TestHandlerDispatchesConcurrentDuplicatesOnce(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakePipeline(t, map[string]bool{"sms": true})
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	form := url.Values{"mode": {"sms"}, "message": {"Shipped"}, "recipient": {"+15550100"}}
+	const requests = 10
+	codes := make([]int, requests)
+	messageIDs := make([]uuid.UUID, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i], messageIDs[i] = postWithIdempotencyKey(t, router, "order-1234", form)
+		}()
+	}
+	wg.Wait()
+
+	for i := range codes {
+		if codes[i] != http.StatusOK || messageIDs[i] != messageIDs[0] {
+			t.Fatalf("expected every request to get the original's result, got %d for %s (original %s)",
+				codes[i], messageIDs[i], messageIDs[0])
+		}
+	}
+	if dispatched := producer.Messages(config.Current().Topics.Sms); len(dispatched) != 1 {
+		t.Fatalf("expected the notification to be dispatched once, got %d", len(dispatched))
+	}
+}
+
+func TestRetriedFanoutGetsTheOriginalResponse(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakePipeline(t, map[string]bool{"email": true, "sms": true, "slack": true})
+	useUserProfiles(t, map[string]models.UserProfile{
+		"alice": {Channels: map[string]string{"email": "alice@example.com", "sms": "+15555550100"}},
+	})
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	post := func() (int, string) {
+		request := httptest.NewRequest(http.MethodPost, "/notification",
+			strings.NewReader(url.Values{"user_id": {"alice"}, "message": {"Hello"}}.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.Header.Set("Idempotency-Key", "welcome-alice")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+
+		var body fanoutResponse
+		json.Unmarshal(response.Body.Bytes(), &body)
+		return response.Code, body.ParentID
+	}
+
+	code, parentID := post()
+	if code != http.StatusOK || parentID == "" {
+		t.Fatalf("expected the fan-out to be sent, got %d", code)
+	}
+	if retried, retriedParentID := post(); retried != http.StatusOK || retriedParentID != parentID {
+		t.Fatalf("expected the original response for %s, got %d for %s", parentID, retried, retriedParentID)
+	}
+
+	topics := config.Current().Topics
+	for _, topic := range []string{topics.Email, topics.Sms} {
+		if dispatched := producer.Messages(topic); len(dispatched) != 1 {
+			t.Fatalf("expected the fan-out to be dispatched once on %s, got %d", topic, len(dispatched))
+		}
+	}
+}
+
+func TestUnknownUserReleasesTheKey(t *testing.T) {
+	useMemoryStore(t)
+	useUserProfiles(t, nil)
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	form := url.Values{"user_id": {"bob"}, "message": {"Hello"}}
+	for i := 0; i < 2; i++ {
+		if code, _ := postWithIdempotencyKey(t, router, "welcome-bob", form); code != http.StatusNotFound {
+			t.Fatalf("expected every attempt to be 404 rather than a duplicate, got %d", code)
+		}
+	}
+}
+
+func TestJanitorExpiresIdempotencyKeys(t *testing.T) {
+	useMemoryStore(t)
+	notification := models.Notification{Mode: "sms", Message: "Shipped", Recipient: "+15550100"}
+	notificationStore.AddIdempotent("order-1234", notification, time.Millisecond)
+	notificationStore.AddIdempotent("order-5678", notification, time.Hour)
+	time.Sleep(5 * time.Millisecond)
+
+	notificationStore.sweep(time.Now().Add(-time.Hour))
+
+	notificationStore.mu.Lock()
+	defer notificationStore.mu.Unlock()
+	if _, exists := notificationStore.idempotency["order-1234"]; exists {
+		t.Fatalf("expected the expired key to be removed")
+	}
+	if _, exists := notificationStore.idempotency["order-5678"]; !exists {
+		t.Fatalf("expected the key within its window to be kept")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"log"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultJanitorInterval = time.Minute
+	defaultStoreTTL        = time.Hour
+)
+
+// ====== STORE JANITOR ======
+
+// Sweep the store every `interval`, removing notifications whose TimeStamp is older than `ttl`, e.g. ones
+// whose result never arrived and nobody was waiting on. Notifications still scheduled are kept
+// Starting it again replaces the running janitor
+func (ns *NotificationStore) StartJanitor(interval time.Duration, ttl time.Duration) {
+	ns.StopJanitor()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	ns.mu.Lock()
+	ns.janitorStop, ns.janitorDone = stop, done
+	ns.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ns.sweep(time.Now().Add(-ttl))
+			}
+		}
+	}()
+}
+
+// Stop the janitor and wait for a sweep in progress to finish. A no-op if it isn't running
+func (ns *NotificationStore) StopJanitor() {
+	ns.mu.Lock()
+	stop, done := ns.janitorStop, ns.janitorDone
+	ns.janitorStop, ns.janitorDone = nil, nil
+	ns.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+// Remove the notifications older than `cutoff` that aren't waiting to be dispatched, and the
+// expired idempotency keys
+func (ns *NotificationStore) sweep(cutoff time.Time) {
+	ns.expireIdempotencyKeys(time.Now())
+
+	scheduled := notificationScheduler.scheduled()
+	deleted, err := ns.backend.DeleteOlderThan(cutoff, func(messageID uuid.UUID) bool {
+		return scheduled[messageID]
+	})
+	if err != nil {
+		log.Printf("%v", err)
+		return
+	}
+
+	for _, messageID := range deleted {
+		ns.cache.Invalidate(messageID)
+	}
+	if len(deleted) > 0 {
+		log.Printf("janitor removed %d abandoned notifications", len(deleted))
+	}
+}
+
+// How often the janitor sweeps, configured with NS_STORE_JANITOR_INTERVAL, e.g. "30s"
+func janitorInterval() time.Duration {
+	return config.PositiveDurationFromEnv("NS_STORE_JANITOR_INTERVAL", defaultJanitorInterval)
+}
+
+// Age at which the janitor removes a notification, configured with NS_STORE_TTL, e.g. "24h"
+// Kept over the longest a notification can legitimately stay in the store
+func storeTTL() time.Duration {
+	ttl := config.PositiveDurationFromEnv("NS_STORE_TTL", defaultStoreTTL)
+	if minimum := hardTimeout*time.Second + max(resultRetention(), idempotencyWindow()); ttl < minimum {
+		log.Printf("raising NS_STORE_TTL %s to %s, the longest a result is kept", ttl, minimum)
+		return minimum
+	}
+	return ttl
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/models"
+	"github.com/google/uuid"
+)
+
+// Add a notification stamped `age` ago
+func addAgedNotification(t *testing.T, age time.Duration) uuid.UUID {
+	t.Helper()
+	messageID, err := notificationStore.Add(models.Notification{Mode: "sms", Message: "Hello", Recipient: "+15550100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification := notificationStore.Get(messageID)
+	notification.TimeStamp = time.Now().Add(-age)
+	notificationStore.Update(messageID, notification)
+	return messageID
+}
+
+func TestJanitorReapsOnlyStaleNotifications(t *testing.T) {
+	useMemoryStore(t)
+	scheduler := useScheduler(t)
+
+	stale := addAgedNotification(t, 2*time.Hour)
+	fresh := addAgedNotification(t, time.Minute)
+	staleScheduled := addAgedNotification(t, 2*time.Hour)
+	scheduler.Schedule(staleScheduled, time.Now().Add(time.Hour))
+
+	// Read through the cache, a reaped notification must not be served from it afterwards
+	if _, exists := notificationStore.Lookup(stale); !exists {
+		t.Fatalf("expected the stale notification before the sweep")
+	}
+
+	notificationStore.StartJanitor(5*time.Millisecond, time.Hour)
+	defer notificationStore.StopJanitor()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, exists := notificationStore.Lookup(stale); !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the stale notification to be reaped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, exists := notificationStore.Lookup(fresh); !exists {
+		t.Fatalf("expected the fresh notification to be kept")
+	}
+	if _, exists := notificationStore.Lookup(staleScheduled); !exists {
+		t.Fatalf("expected a notification still scheduled to be kept however old")
+	}
+}
+
+func TestStopJanitorStopsSweeping(t *testing.T) {
+	useMemoryStore(t)
+	useScheduler(t)
+
+	notificationStore.StartJanitor(5*time.Millisecond, time.Hour)
+	// Starting it again replaces the running one
+	notificationStore.StartJanitor(5*time.Millisecond, time.Hour)
+	notificationStore.StopJanitor()
+	// And stopping it twice is harmless
+	notificationStore.StopJanitor()
+
+	stale := addAgedNotification(t, 2*time.Hour)
+	time.Sleep(50 * time.Millisecond)
+	if _, exists := notificationStore.Lookup(stale); !exists {
+		t.Fatalf("expected nothing to be reaped once the janitor stopped")
+	}
+}
+
+func TestStoreTTLIsKeptOverTheLongestRetention(t *testing.T) {
+	t.Setenv("NS_RESULT_RETENTION", "")
+	t.Setenv("NS_IDEMPOTENCY_WINDOW", "2h")
+	t.Setenv("NS_STORE_TTL", "1m")
+	if ttl, minimum := storeTTL(), hardTimeout*time.Second+2*time.Hour; ttl != minimum {
+		t.Fatalf("expected the TTL to be raised to %s, got %s", minimum, ttl)
+	}
+
+	t.Setenv("NS_STORE_TTL", "24h")
+	if ttl := storeTTL(); ttl != 24*time.Hour {
+		t.Fatalf("expected a long enough TTL to be kept, got %s", ttl)
+	}
+}
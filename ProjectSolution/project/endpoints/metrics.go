@@ -0,0 +1,65 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"example.com/projectsolution/project/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// ====== PROMETHEUS METRICS ======
+
+// Served at /metrics, behind the API key like the notification end-points (scrape it with the key as a
+// bearer token). Labelled by mode only, never by recipient or message ID, so cardinality stays bounded
+var (
+	notificationsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_received_total",
+		Help: "Notifications accepted for sending, by mode.",
+	}, []string{"mode"})
+
+	notificationsSucceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_succeeded_total",
+		Help: "Notifications whose result was a successful send, by mode.",
+	}, []string{"mode"})
+
+	notificationsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifications_failed_total",
+		Help: "Notifications whose result was a failed send, by mode.",
+	}, []string{"mode"})
+
+	notificationLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "notification_handler_latency_seconds",
+		Help:    "Time from storing a notification to its result or timeout in the handler, by mode.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60},
+	}, []string{"mode"})
+
+	notificationsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "notifications_in_flight",
+		Help: "Notification requests currently being handled.",
+	})
+)
+
+// Count the result of a processed notification
+func recordResultMetrics(notification *models.Notification) {
+	if notification.IsSent {
+		notificationsSucceeded.WithLabelValues(notification.Mode).Inc()
+	} else {
+		notificationsFailed.WithLabelValues(notification.Mode).Inc()
+	}
+}
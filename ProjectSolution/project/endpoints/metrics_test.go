@@ -0,0 +1,136 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"example.com/projectsolution/project/models"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Scrape /metrics with the API key, returning the exposition text
+func scrapeMetrics(t *testing.T, router http.Handler) string {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	request.Header.Set("Authorization", "Bearer metrics-key")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected the scrape to be 200, got %d", response.Code)
+	}
+	return response.Body.String()
+}
+
+// The value of the sample `series`, e.g. `notifications_received_total{mode="sms"}`, 0 if it isn't exported yet
+func metricValue(t *testing.T, scrape string, series string) float64 {
+	t.Helper()
+	scanner := bufio.NewScanner(strings.NewReader(scrape))
+	for scanner.Scan() {
+		value, found := strings.CutPrefix(scanner.Text(), series+" ")
+		if !found {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			t.Fatalf("unparseable sample %q: %v", scanner.Text(), err)
+		}
+		return parsed
+	}
+	return 0
+}
+
+func TestMetricsCountNotificationsByMode(t *testing.T) {
+	t.Setenv("NS_API_KEYS", "metrics-key")
+	t.Cleanup(func() { gin.SetMode(gin.TestMode) })
+	router := newRouter()
+	useMemoryStore(t)
+	useFakePipeline(t, map[string]bool{"sms": true, "email": false})
+
+	series := []string{
+		`notifications_received_total{mode="sms"}`,
+		`notifications_succeeded_total{mode="sms"}`,
+		`notifications_received_total{mode="email"}`,
+		`notifications_failed_total{mode="email"}`,
+		`notification_handler_latency_seconds_count{mode="sms"}`,
+		`notification_handler_latency_seconds_count{mode="email"}`,
+	}
+	before := scrapeMetrics(t, router)
+
+	post := func(form url.Values) {
+		request := httptest.NewRequest(http.MethodPost, "/notification", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.Header.Set("X-API-Key", "metrics-key")
+		router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+	post(url.Values{"mode": {"sms"}, "message": {"Hello"}, "recipient": {"+15550100"}})
+	post(url.Values{"mode": {"email"}, "message": {"Hello"}, "recipient": {"ops@example.com"}})
+
+	after := scrapeMetrics(t, router)
+	for _, series := range series {
+		if moved := metricValue(t, after, series) - metricValue(t, before, series); moved != 1 {
+			t.Errorf("expected %s to move by 1, moved by %v", series, moved)
+		}
+	}
+	if inFlight := metricValue(t, after, "notifications_in_flight"); inFlight != 0 {
+		t.Errorf("expected no requests in flight after they returned, got %v", inFlight)
+	}
+
+	// Labelled by mode only
+	if strings.Contains(after, "+15550100") || strings.Contains(after, "ops@example.com") {
+		t.Errorf("expected no recipient in the metric labels")
+	}
+}
+
+func TestReplayedResultsAreNotCountedAgain(t *testing.T) {
+	useMemoryStore(t)
+	messageID, err := notificationStore.Add(models.Notification{Mode: "sms", Message: "Hello", Recipient: "+15550100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	notification := notificationStore.Get(messageID)
+	notification.IsSent = true
+
+	succeeded := notificationsSucceeded.WithLabelValues("sms")
+	before := testutil.ToFloat64(succeeded)
+	storeProcessedNotification(&notification)
+	if testutil.ToFloat64(succeeded) != before {
+		t.Fatalf("expected a replayed result not to be counted")
+	}
+	ReceiveProcessedNotification(&notification)
+	if testutil.ToFloat64(succeeded) != before+1 {
+		t.Fatalf("expected a consumed result to be counted")
+	}
+}
+
+func TestMetricsRequireTheAPIKey(t *testing.T) {
+	t.Setenv("NS_API_KEYS", "metrics-key")
+	t.Cleanup(func() { gin.SetMode(gin.TestMode) })
+	response := httptest.NewRecorder()
+	newRouter().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if response.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a scrape without the key to be 401, got %d", response.Code)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/kafkawrapper"
+	"example.com/projectsolution/project/kafkawrapper/kafkatest"
+	"example.com/projectsolution/project/models"
+	"example.com/projectsolution/project/store"
+	"github.com/IBM/sarama"
+	"github.com/google/uuid"
+)
+
+// Wait for the number of goroutines to come back down to at most `expected`
+func waitForGoroutines(t *testing.T, expected int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > expected {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("expected at most %d goroutines, %d are left:\n%s",
+				expected, runtime.NumGoroutine(), buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A notification already processed, as the store shows it on every following tick
+func addProcessedNotification(t *testing.T, isSent bool) uuid.UUID {
+	messageID, err := notificationStore.Add(models.Notification{Mode: "sms", Message: "Hello", Recipient: "+15555550100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	processed := notificationStore.Get(messageID)
+	processed.IsSent = isSent
+	if !isSent {
+		processed.FailReason = "provider unavailable"
+	}
+	notificationStore.Update(messageID, processed)
+	return messageID
+}
+
+func TestWaitingForResultsLeavesNoGoroutinesBehind(t *testing.T) {
+	useMemoryStore(t)
+	before := runtime.NumGoroutine()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		messageID := addProcessedNotification(t, i%2 == 0)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			isSuccess, timedOut := waitForResult(messageID)
+			if timedOut || isSuccess != (i%2 == 0) {
+				t.Errorf("expected the stored result, got success=%v timed out=%v", isSuccess, timedOut)
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitForGoroutines(t, before)
+}
+
+func TestGetResultsSendsExactlyOneResult(t *testing.T) {
+	useMemoryStore(t)
+	messageID := addProcessedNotification(t, true)
+
+	wasSuccessful := make(chan bool, 2)
+	done := make(chan struct{})
+	go func() {
+		GetResults(context.Background(), messageID, wasSuccessful)
+		close(done)
+	}()
+
+	// Returns after the first result, though the store keeps showing it on every tick
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected GetResults to return after sending its result")
+	}
+	if len(wasSuccessful) != 1 || !<-wasSuccessful {
+		t.Fatalf("expected exactly one successful result")
+	}
+}
+
+func TestGetResultsReturnsWhenNobodyReads(t *testing.T) {
+	useMemoryStore(t)
+	before := runtime.NumGoroutine()
+
+	var wg sync.WaitGroup
+	getResults := func(messageID uuid.UUID, wasSuccessful chan bool) {
+		ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+		t.Cleanup(cancel)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			GetResults(ctx, messageID, wasSuccessful)
+		}()
+	}
+
+	// The caller gave up: the result is ready but the unbuffered channel is never read
+	for i := 0; i < 50; i++ {
+		getResults(addProcessedNotification(t, true), make(chan bool))
+	}
+	// Nor when no result ever comes
+	for i := 0; i < 50; i++ {
+		messageID, _ := notificationStore.Add(models.Notification{Mode: "sms", Message: "Hello"})
+		getResults(messageID, make(chan bool, 1))
+	}
+
+	// Other tests' goroutines winding down can hide one of these in the count, so wait on them too
+	returned := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected every GetResults to return once its context was done")
+	}
+	waitForGoroutines(t, before)
+}
+
+// A store whose updates fail until `failures` of them did, or always if negative
+type failingStore struct {
+	store.Store
+	failures int
+	mu       sync.Mutex
+}
+
+func (fs *failingStore) Update(messageID uuid.UUID, notification models.Notification) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.failures == 0 {
+		return fs.Store.Update(messageID, notification)
+	}
+	fs.failures--
+	return errors.New("failed to update notification: disk full")
+}
+
+// Consume the processed notification through a Consumer with the processed topic's callback
+func consumeProcessed(t *testing.T, notification models.Notification) *kafkatest.Session {
+	value, err := json.Marshal(notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := kafkatest.NewSession(context.Background())
+	claim := kafkatest.NewClaim(kafkaTopicProcessed, &sarama.ConsumerMessage{Offset: 3, Value: value})
+	if err := kafkawrapper.NewConsumer(ReceiveProcessedNotification).ConsumeClaim(session, claim); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestProcessedNotificationIsMarkedOnceStored(t *testing.T) {
+	useMemoryStore(t)
+	useFakeProducer(t)
+	failing := &failingStore{Store: store.NewMemoryStore(), failures: 1}
+	SetStore(failing)
+
+	messageID, _ := notificationStore.Add(models.Notification{Mode: "sms", Message: "Hello"})
+	processed := notificationStore.Get(messageID)
+	processed.IsSent = true
+
+	// Redelivered after the failed update instead of being marked with its result lost
+	session := consumeProcessed(t, processed)
+	if marked := session.Marked(); len(marked) != 1 {
+		t.Fatalf("expected the message to be marked once stored, got %v", marked)
+	}
+	if !notificationStore.Get(messageID).IsSent {
+		t.Fatalf("expected the redelivered result to be stored")
+	}
+}
+
+func TestProcessedNotificationIsNotMarkedWhenTheStoreFails(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakeProducer(t)
+	producer.TopicErrs[kafkawrapper.DeadLetterTopic] = sarama.ErrNotLeaderForPartition
+	previous := kafkawrapper.ConsumerErrorPolicy
+	kafkawrapper.ConsumerErrorPolicy = kafkawrapper.ErrorPolicyDLQ
+	t.Cleanup(func() { kafkawrapper.ConsumerErrorPolicy = previous })
+	SetStore(&failingStore{Store: store.NewMemoryStore(), failures: -1})
+
+	messageID, _ := notificationStore.Add(models.Notification{Mode: "sms", Message: "Hello"})
+	processed := notificationStore.Get(messageID)
+	processed.IsSent = true
+
+	// Neither stored nor dead-lettered, so it must be consumed again
+	if marked := consumeProcessed(t, processed).Marked(); len(marked) != 0 {
+		t.Fatalf("expected the message to stay unmarked, got %v", marked)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/kafkawrapper"
+	"example.com/projectsolution/project/models"
+	"example.com/projectsolution/project/store"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ====== SCHEDULED NOTIFICATIONS ======
+
+// A stored notification waiting for its 'send_at' time
+type scheduledNotification struct {
+	sendAt    time.Time
+	messageID uuid.UUID
+}
+
+// Min-heap on sendAt, so the next notification due is always at the top
+type scheduleQueue []scheduledNotification
+
+func (queue scheduleQueue) Len() int           { return len(queue) }
+func (queue scheduleQueue) Less(i, j int) bool { return queue[i].sendAt.Before(queue[j].sendAt) }
+func (queue scheduleQueue) Swap(i, j int)      { queue[i], queue[j] = queue[j], queue[i] }
+func (queue *scheduleQueue) Push(item any)     { *queue = append(*queue, item.(scheduledNotification)) }
+func (queue *scheduleQueue) Pop() any {
+	old := *queue
+	item := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return item
+}
+
+// Dispatches stored notifications to Kafka once their time comes. Every due notification is
+// dispatched on each wake up, so any number of them can share the same instant
+type Scheduler struct {
+	queue scheduleQueue
+	mu    sync.Mutex
+	// Wakes the run loop when a notification is scheduled, it may be due before the one it sleeps for
+	wake chan struct{}
+}
+
+var notificationScheduler = &Scheduler{
+	wake: make(chan struct{}, 1),
+}
+
+// Dispatch the stored notification at `sendAt`
+func (scheduler *Scheduler) Schedule(messageID uuid.UUID, sendAt time.Time) {
+	scheduler.mu.Lock()
+	heap.Push(&scheduler.queue, scheduledNotification{sendAt: sendAt, messageID: messageID})
+	scheduler.mu.Unlock()
+
+	select {
+	case scheduler.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Schedule the stored notifications not dispatched yet, e.g. by an instance restarted before their time
+// came. dispatchScheduled() moves the TimeStamp to the send time, so those are still timestamped before
+// their SendAt. Ones that became due in the meantime are dispatched right away
+func (scheduler *Scheduler) restore(backend store.Store) error {
+	pending, err := backend.Find(func(notification models.Notification) bool {
+		return notification.TimeStamp.Before(notification.SendAt)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to find the scheduled notifications: %w", err)
+	}
+
+	scheduled := scheduler.scheduled()
+	restored := 0
+	for _, notification := range pending {
+		if !scheduled[notification.MessageID] {
+			scheduler.Schedule(notification.MessageID, notification.SendAt)
+			restored++
+		}
+	}
+	if restored > 0 {
+		log.Printf("restored %d scheduled notifications from the store", restored)
+	}
+	return nil
+}
+
+// Dispatch notifications as they become due, until `ctx` is done
+// Notifications still scheduled then are not dispatched, restore() picks them up on the next start
+// unless the store was in memory
+func (scheduler *Scheduler) Run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		for _, messageID := range scheduler.due(time.Now()) {
+			dispatchScheduled(messageID)
+		}
+
+		select {
+		case <-ctx.Done():
+			scheduler.mu.Lock()
+			if len(scheduler.queue) > 0 {
+				log.Printf("shutting down with %d scheduled notifications not dispatched", len(scheduler.queue))
+			}
+			scheduler.mu.Unlock()
+			return
+		case <-scheduler.wake:
+		case <-timer.C:
+		}
+		timer.Reset(scheduler.untilNext(time.Now()))
+	}
+}
+
+// Remove and return every notification due at `now`
+func (scheduler *Scheduler) due(now time.Time) []uuid.UUID {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	var due []uuid.UUID
+	for len(scheduler.queue) > 0 && !scheduler.queue[0].sendAt.After(now) {
+		due = append(due, heap.Pop(&scheduler.queue).(scheduledNotification).messageID)
+	}
+	return due
+}
+
+// The messageIDs of the notifications still waiting to be dispatched
+func (scheduler *Scheduler) scheduled() map[uuid.UUID]bool {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	scheduled := make(map[uuid.UUID]bool, len(scheduler.queue))
+	for _, item := range scheduler.queue {
+		scheduled[item.messageID] = true
+	}
+	return scheduled
+}
+
+// Time until the next notification is due, or an hour to check back in if there is none
+func (scheduler *Scheduler) untilNext(now time.Time) time.Duration {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	if len(scheduler.queue) == 0 {
+		return time.Hour
+	}
+	return max(scheduler.queue[0].sendAt.Sub(now), 0)
+}
+
+// Send a scheduled notification for processing. Nobody waits on the result, it stays queryable
+// for as long as a blocking request would have waited and then some
+func dispatchScheduled(messageID uuid.UUID) {
+	notification, exists := notificationStore.Lookup(messageID)
+	if !exists {
+		return
+	}
+
+	// The retry deadline counts from the TimeStamp, which has to be the send time rather than the request's
+	notification.TimeStamp = time.Now()
+	if err := notificationStore.Update(messageID, notification); err != nil {
+		log.Printf("failed to update scheduled notification %s: %v", messageID, err)
+	}
+
+	err := kafkawrapper.SendKafkaMessage(config.Current().Topics.ForMode(notification.Mode), notification)
+	if err != nil {
+		log.Printf("failed to dispatch scheduled notification %s: %v", messageID, err)
+		notification.FailReason = "failed to dispatch scheduled notification"
+		if err := notificationStore.Update(messageID, notification); err != nil {
+			log.Printf("failed to update scheduled notification %s: %v", messageID, err)
+		}
+	} else {
+		notificationsReceived.WithLabelValues(notification.Mode).Inc()
+	}
+	notificationStore.Expire(messageID, hardTimeout*time.Second+resultRetention())
+}
+
+// Acknowledge a scheduled notification, the client polls for its result
+func respondScheduled(ctx *gin.Context, messageID uuid.UUID, sendAt time.Time) {
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"message":    "Notification scheduled",
+		"message_id": messageID,
+		"send_at":    sendAt,
+	})
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// A fresh scheduler for the duration of the test
+func useScheduler(t *testing.T) *Scheduler {
+	previous := notificationScheduler
+	notificationScheduler = &Scheduler{wake: make(chan struct{}, 1)}
+	t.Cleanup(func() { notificationScheduler = previous })
+	return notificationScheduler
+}
+
+func TestSchedulerPopsInTimeOrder(t *testing.T) {
+	scheduler := useScheduler(t)
+	now := time.Now()
+	first, second, later := uuid.New(), uuid.New(), uuid.New()
+	scheduler.Schedule(later, now.Add(time.Hour))
+	scheduler.Schedule(second, now.Add(-time.Second))
+	scheduler.Schedule(first, now.Add(-time.Minute))
+
+	due := scheduler.due(now)
+	if len(due) != 2 || due[0] != first || due[1] != second {
+		t.Fatalf("expected the two due notifications in time order, got %v", due)
+	}
+	if scheduled := scheduler.scheduled(); len(scheduled) != 1 || !scheduled[later] {
+		t.Fatalf("expected only the later notification to stay scheduled, got %v", scheduled)
+	}
+	if wait := scheduler.untilNext(now); wait != time.Hour {
+		t.Fatalf("expected to wake up for the later notification in an hour, got %s", wait)
+	}
+}
+
+func TestSchedulerDispatchesEverythingDueAtTheSameInstant(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakeProducer(t)
+	scheduler := useScheduler(t)
+
+	const count = 200
+	sendAt := time.Now().Add(50 * time.Millisecond)
+	for i := 0; i < count; i++ {
+		messageID, err := notificationStore.Add(models.Notification{Mode: "sms", Message: "Reminder", Recipient: "+15550100"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		scheduler.Schedule(messageID, sendAt)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		scheduler.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+
+	topic := config.Current().Topics.Sms
+	deadline := time.Now().Add(5 * time.Second)
+	for len(producer.Messages(topic)) < count && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	dispatched := producer.Notifications(topic)
+	if len(dispatched) != count {
+		t.Fatalf("expected all %d notifications to be dispatched, got %d", count, len(dispatched))
+	}
+	if dispatched[0].TimeStamp.Before(sendAt) {
+		t.Fatalf("expected nothing to be dispatched before %s, got one at %s", sendAt, dispatched[0].TimeStamp)
+	}
+	if scheduled := scheduler.scheduled(); len(scheduled) != 0 {
+		t.Fatalf("expected nothing left scheduled, got %d", len(scheduled))
+	}
+}
+
+func TestHandlerSchedulesFutureSendAt(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakeProducer(t)
+	scheduler := useScheduler(t)
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	form := url.Values{"mode": {"sms"}, "message": {"Reminder"}, "recipient": {"+15550100"}}
+	form.Set("send_at", time.Now().Add(-time.Minute).Format(time.RFC3339))
+	if response := postForm(t, router, "/notification", form); response.Code != http.StatusBadRequest {
+		t.Fatalf("expected a send_at in the past to be 400, got %d", response.Code)
+	}
+	form.Set("send_at", "tomorrow")
+	if response := postForm(t, router, "/notification", form); response.Code != http.StatusBadRequest {
+		t.Fatalf("expected a send_at that isn't RFC3339 to be 400, got %d", response.Code)
+	}
+
+	// Acknowledged right away, not dispatched until it's due
+	form.Set("send_at", time.Now().Add(2*time.Hour).Format(time.RFC3339))
+	if response := postForm(t, router, "/notification", form); response.Code != http.StatusAccepted {
+		t.Fatalf("expected a future send_at to be 202, got %d %s", response.Code, response.Body)
+	}
+	if len(scheduler.scheduled()) != 1 {
+		t.Fatalf("expected the notification to be scheduled")
+	}
+	if dispatched := producer.Messages(config.Current().Topics.Sms); len(dispatched) != 0 {
+		t.Fatalf("expected nothing dispatched before send_at, got %d", len(dispatched))
+	}
+}
+
+func TestSchedulerRestoresTheNotificationsNotDispatchedYet(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakeProducer(t)
+	now := time.Now()
+	stored := map[string]models.Notification{
+		"pending": {SendAt: now.Add(time.Hour), TimeStamp: now.Add(-time.Minute)},
+		// Due while nobody was running
+		"overdue":    {SendAt: now.Add(-time.Second), TimeStamp: now.Add(-time.Minute)},
+		"dispatched": {SendAt: now.Add(-time.Second), TimeStamp: now},
+		"unplanned":  {TimeStamp: now.Add(-time.Minute)},
+	}
+	messageIDs := make(map[string]uuid.UUID)
+	for name, notification := range stored {
+		notification.MessageID = uuid.New()
+		notification.Mode, notification.Message, notification.Recipient = "sms", name, "+15550100"
+		if err := notificationStore.backend.Update(notification.MessageID, notification); err != nil {
+			t.Fatal(err)
+		}
+		messageIDs[name] = notification.MessageID
+	}
+
+	// A restarted instance picks them up, once however often it is asked to
+	scheduler := useScheduler(t)
+	for range 2 {
+		if err := scheduler.restore(notificationStore.backend); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(scheduler.queue) != 2 || !scheduler.scheduled()[messageIDs["pending"]] ||
+		!scheduler.scheduled()[messageIDs["overdue"]] {
+		t.Fatalf("expected the pending and overdue notifications to be scheduled once, got %v", scheduler.queue)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		scheduler.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+
+	topic := config.Current().Topics.Sms
+	deadline := time.Now().Add(5 * time.Second)
+	for len(producer.Messages(topic)) < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if dispatched := producer.Notifications(topic); len(dispatched) != 1 || dispatched[0].Message != "overdue" {
+		t.Fatalf("expected the overdue notification to be dispatched right away, got %+v", dispatched)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"example.com/projectsolution/project/models"
+)
+
+// A printf verb's flags, width and precision, e.g. "%-08.3"
+var printfWidthPattern = regexp.MustCompile(`%[-+# 0]*(\*|[0-9]*)(?:\.(\*|[0-9]*))?`)
+
+// Builtins a template could use to allocate far more than it outputs, replaced by bounded versions
+var boundedTemplateFuncs = template.FuncMap{
+	"printf": boundedPrintf,
+}
+
+// Most range iterations and template calls a render may take, so "{{range 100000000}}{{end}}" can't
+// keep the server busy for seconds while writing nothing
+const maxTemplateSteps = 100000
+
+// The func counting the steps, called at the start of every template and range iteration
+const templateStepFunc = "templateStep"
+
+// The call to templateStepFunc put into the parsed templates, see countTemplateSteps()
+var templateStepNode = template.Must(template.New("step").
+	Funcs(template.FuncMap{templateStepFunc: func() string { return "" }}).
+	Parse("{{" + templateStepFunc + "}}")).Tree.Root.Nodes[0]
+
+// ====== MESSAGE TEMPLATES ======
+
+// Render a 'template' form field, e.g. "Hi {{.Name}}, your order {{.OrderID}} shipped.", against the
+// JSON object of the 'vars' form field and the built-in variables. A variable the template uses but
+// neither has is an error, so a half-rendered message never gets sent
+func renderMessageTemplate(messageTemplate string, varsJSON string) (string, error) {
+	vars := map[string]any{}
+	if varsJSON != "" {
+		if err := json.Unmarshal([]byte(varsJSON), &vars); err != nil {
+			return "", fmt.Errorf("'vars' is not a JSON object: %w", err)
+		}
+	}
+	for name, value := range builtinTemplateVars() {
+		vars[name] = value
+	}
+
+	steps := 0
+	countStep := func() (string, error) {
+		if steps++; steps > maxTemplateSteps {
+			return "", fmt.Errorf("rendering takes more than %d steps", maxTemplateSteps)
+		}
+		return "", nil
+	}
+
+	parsed, err := template.New("message").Option("missingkey=error").Funcs(boundedTemplateFuncs).
+		Funcs(template.FuncMap{templateStepFunc: countStep}).Parse(messageTemplate)
+	if err != nil {
+		return "", fmt.Errorf("'template' is not a valid template: %w", err)
+	}
+	countTemplateSteps(parsed)
+
+	// Rendering stops as soon as the message is over the maximum size
+	message := cappedBuilder{limit: models.MaxMessageSize}
+	if err := parsed.Execute(&message, vars); err != nil {
+		return "", fmt.Errorf("failed to render 'template' with 'vars': %w", err)
+	}
+	return message.String(), nil
+}
+
+// Have every template, including the ones it defines, and every range iteration call templateStepFunc first
+// Loops and recursion are the only ways a render can take long, so their steps bound its time
+func countTemplateSteps(parsed *template.Template) {
+	for _, defined := range parsed.Templates() {
+		if defined.Tree == nil || defined.Tree.Root == nil {
+			continue
+		}
+		countRangeSteps(defined.Tree.Root)
+		defined.Tree.Root.Nodes = append([]parse.Node{templateStepNode}, defined.Tree.Root.Nodes...)
+	}
+}
+
+// Put the call to templateStepFunc first in the body of every range within the list
+func countRangeSteps(list *parse.ListNode) {
+	if list == nil {
+		return
+	}
+	for _, node := range list.Nodes {
+		switch node := node.(type) {
+		case *parse.RangeNode:
+			countRangeSteps(node.List)
+			countRangeSteps(node.ElseList)
+			node.List.Nodes = append([]parse.Node{templateStepNode}, node.List.Nodes...)
+		case *parse.IfNode:
+			countRangeSteps(node.List)
+			countRangeSteps(node.ElseList)
+		case *parse.WithNode:
+			countRangeSteps(node.List)
+			countRangeSteps(node.ElseList)
+		case *parse.ListNode:
+			countRangeSteps(node)
+		}
+	}
+}
+
+// The system context every message template can use without the client supplying it, over any 'vars'
+// of the same name: Env, the environment name set with NS_ENVIRONMENT (e.g. "staging"), Host, the
+// server's hostname, and Now, the time of rendering in UTC (e.g. {{.Now.Format "2006-01-02 15:04"}})
+func builtinTemplateVars() map[string]any {
+	host, err := os.Hostname()
+	if err != nil {
+		log.Printf("failed to get the hostname for message templates: %v", err)
+	}
+	return map[string]any{
+		"Env":  os.Getenv("NS_ENVIRONMENT"),
+		"Host": host,
+		"Now":  time.Now().UTC(),
+	}
+}
+
+// A strings.Builder refusing to grow past `limit` bytes
+type cappedBuilder struct {
+	strings.Builder
+	limit int
+}
+
+func (builder *cappedBuilder) Write(p []byte) (int, error) {
+	if size := builder.Len() + len(p); size > builder.limit {
+		return 0, &models.MessageTooLargeError{Size: size}
+	}
+	return builder.Builder.Write(p)
+}
+
+// printf without '*' widths and with widths and precisions no larger than a message can be,
+// so "%0999999999d" can't make the server allocate a gigabyte
+func boundedPrintf(format string, args ...any) (string, error) {
+	for _, verb := range printfWidthPattern.FindAllStringSubmatch(format, -1) {
+		for _, size := range verb[1:] {
+			if size == "*" {
+				return "", fmt.Errorf("printf widths and precisions from arguments are not allowed")
+			}
+			if n, err := strconv.Atoi(size); size != "" && (err != nil || n > models.MaxMessageSize) {
+				return "", fmt.Errorf("printf width or precision %s is over the maximum message size", size)
+			}
+		}
+	}
+	return fmt.Sprintf(format, args...), nil
+}
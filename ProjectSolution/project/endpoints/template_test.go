@@ -0,0 +1,166 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/models"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestRenderMessageTemplate(t *testing.T) {
+	message, err := renderMessageTemplate("Hi {{.Name}}, your order {{.OrderID}} shipped.", `{"Name": "Ada", "OrderID": 1042}`)
+	if err != nil || message != "Hi Ada, your order 1042 shipped." {
+		t.Fatalf("expected the rendered message, got %q, %v", message, err)
+	}
+
+	invalid := map[string][2]string{
+		"bad syntax":       {"Hi {{.Name", `{"Name": "Ada"}`},
+		"missing variable": {"Hi {{.Name}}, your order {{.OrderID}} shipped.", `{"Name": "Ada"}`},
+		"vars not json":    {"Hi {{.Name}}", `Name=Ada`},
+		"vars not object":  {"Hi {{.Name}}", `["Ada"]`},
+		"unbounded printf": {`{{printf "%0999999999d" 1}}`, ``},
+		"argument width":   {`{{printf "%*d" 999999999 1}}`, ``},
+	}
+	for name, test := range invalid {
+		if message, err := renderMessageTemplate(test[0], test[1]); err == nil {
+			t.Fatalf("%s: expected an error, got %q", name, message)
+		}
+	}
+}
+
+func TestBuiltinTemplateVariables(t *testing.T) {
+	t.Setenv("NS_ENVIRONMENT", "staging")
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := time.Now().UTC().Truncate(time.Second)
+	message, err := renderMessageTemplate(`{{.Env}} {{.Host}} {{.Now.Format "2006-01-02T15:04:05Z07:00"}}`, ``)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(message)
+	if len(fields) != 3 || fields[0] != "staging" || fields[1] != host {
+		t.Fatalf("expected the environment and hostname, got %q", message)
+	}
+	now, err := time.Parse(time.RFC3339, fields[2])
+	if err != nil || now.Before(before) || now.After(time.Now().UTC()) || now.Location() != time.UTC {
+		t.Fatalf("expected the time of rendering in UTC, got %q", fields[2])
+	}
+
+	// The client can't pass off its own system context
+	message, err = renderMessageTemplate(`{{.Env}}: {{.Name}}`, `{"Env": "production", "Name": "Ada"}`)
+	if err != nil || message != "staging: Ada" {
+		t.Fatalf("expected the built-in environment next to the client's vars, got %q, %v", message, err)
+	}
+}
+
+func TestTemplateRenderingStopsAtTheMaximumSize(t *testing.T) {
+	_, err := renderMessageTemplate(`{{range .Items}}{{.}}{{end}}`,
+		`{"Items": ["`+strings.Repeat("a", models.MaxMessageSize/2)+`", "`+strings.Repeat("b", models.MaxMessageSize)+`"]}`)
+	var tooLarge *models.MessageTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected the rendering to be cut off as too large, got %v", err)
+	}
+}
+
+func TestTemplateRenderingIsBoundedInSteps(t *testing.T) {
+	expensive := map[string]string{
+		"long range":    `{{range 100000000}}{{end}}`,
+		"nested ranges": `{{range 1000}}{{range 1000}}{{end}}{{end}}`,
+		"recursion": `{{define "twice"}}{{if .}}{{template "twice" slice . 1}}{{template "twice" slice . 1}}{{end}}{{end}}` +
+			`{{template "twice" .Items}}`,
+	}
+	for name, messageTemplate := range expensive {
+		start := time.Now()
+		_, err := renderMessageTemplate(messageTemplate, `{"Items": [`+strings.Repeat("1,", 39)+`1]}`)
+		if err == nil || !strings.Contains(err.Error(), "steps") {
+			t.Fatalf("%s: expected the rendering to be stopped, got %v", name, err)
+		}
+		// Unbounded, any of these would run for hours, so leave the race detector room
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Fatalf("%s: expected the rendering to be stopped quickly, took %s", name, elapsed)
+		}
+	}
+
+	// Within the steps, ranges and defined templates render as usual
+	message, err := renderMessageTemplate(`{{define "item"}}[{{.}}]{{end}}{{range .Items}}{{template "item" .}}{{end}}`,
+		`{"Items": ["a", "b"]}`)
+	if err != nil || message != "[a][b]" {
+		t.Fatalf("expected the rendered message, got %q, %v", message, err)
+	}
+}
+
+// POST a scheduled sms through the handler, returning the response and the stored message
+func postScheduledSms(t *testing.T, form url.Values) (int, string) {
+	useMemoryStore(t)
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	form.Set("mode", "sms")
+	form.Set("recipient", "+15555550100")
+	form.Set("send_at", time.Now().Add(time.Hour).Format(time.RFC3339))
+	response := postForm(t, router, "/notification", form)
+	if response.Code != http.StatusAccepted {
+		return response.Code, ""
+	}
+
+	var body struct {
+		MessageID uuid.UUID `json:"message_id"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	return response.Code, notificationStore.Get(body.MessageID).Message
+}
+
+func TestHandlerRendersTheTemplate(t *testing.T) {
+	code, message := postScheduledSms(t, url.Values{
+		"template": {"Hi {{.Name}}, your order {{.OrderID}} shipped."},
+		"vars":     {`{"Name": "Ada", "OrderID": "A-1"}`},
+	})
+	if code != http.StatusAccepted || message != "Hi Ada, your order A-1 shipped." {
+		t.Fatalf("expected the rendered message to be stored, got %d %q", code, message)
+	}
+
+	// The plain message path is unchanged
+	code, message = postScheduledSms(t, url.Values{"message": {"Hi {{.Name}}"}})
+	if code != http.StatusAccepted || message != "Hi {{.Name}}" {
+		t.Fatalf("expected a plain message to be sent verbatim, got %d %q", code, message)
+	}
+}
+
+func TestHandlerRejectsTemplatesThatDontRender(t *testing.T) {
+	if code, _ := postScheduledSms(t, url.Values{"template": {"Hi {{.Name"}}); code != http.StatusBadRequest {
+		t.Fatalf("expected bad template syntax to be a 400, got %d", code)
+	}
+	if code, _ := postScheduledSms(t, url.Values{"template": {"Hi {{.Name}}"}, "vars": {`{}`}}); code != http.StatusBadRequest {
+		t.Fatalf("expected a missing variable to be a 400, got %d", code)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/projectsolution/project/models"
+	"example.com/projectsolution/project/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// ====== GLOBAL THROTTLE ======
+
+// Cap on notifications per second across all modes, protecting shared infrastructure. Configured with
+// NS_GLOBAL_RATE_LIMIT (per second) and NS_GLOBAL_RATE_BURST. nil, the default, means unlimited
+var globalLimiter = globalLimiterFromEnv()
+
+func globalLimiterFromEnv() *ratelimit.TokenBucket {
+	value := os.Getenv("NS_GLOBAL_RATE_LIMIT")
+	if value == "" {
+		return nil
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate <= 0 {
+		log.Printf("global rate limit disabled, invalid NS_GLOBAL_RATE_LIMIT %q", value)
+		return nil
+	}
+
+	burst := int(math.Ceil(rate))
+	if value := os.Getenv("NS_GLOBAL_RATE_BURST"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("ignoring invalid NS_GLOBAL_RATE_BURST %q", value)
+		} else {
+			burst = parsed
+		}
+	}
+	return ratelimit.NewTokenBucket(rate, burst, nil)
+}
+
+// ====== RECIPIENT THROTTLE ======
+
+// Cap on notifications per minute to the same recipient, per mode, so a misbehaving client can't flood
+// someone. Configured with NS_<MODE>_RECIPIENT_RATE_LIMIT (per minute) and NS_<MODE>_RECIPIENT_RATE_BURST
+// A mode without a limit, the default, is unlimited
+var recipientLimiters = recipientLimitersFromEnv()
+
+func recipientLimitersFromEnv() map[string]*ratelimit.KeyedLimiter {
+	limiters := make(map[string]*ratelimit.KeyedLimiter)
+	for _, mode := range supportedModes {
+		prefix := "NS_" + strings.ToUpper(mode) + "_RECIPIENT_RATE_"
+		value := os.Getenv(prefix + "LIMIT")
+		if value == "" {
+			continue
+		}
+		perMinute, err := strconv.ParseFloat(value, 64)
+		if err != nil || perMinute <= 0 {
+			log.Printf("%s recipient rate limit disabled, invalid %sLIMIT %q", mode, prefix, value)
+			continue
+		}
+
+		burst := int(math.Ceil(perMinute))
+		if value := os.Getenv(prefix + "BURST"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 {
+				log.Printf("ignoring invalid %sBURST %q", prefix, value)
+			} else {
+				burst = parsed
+			}
+		}
+		limiters[mode] = ratelimit.NewKeyedLimiter(perMinute/60, burst, nil)
+	}
+	return limiters
+}
+
+// Take a send to each of the recipients, comma-separated for email, from the mode's limiter, or to none
+// of them. Otherwise returns false and how long until the recipient that ran out gets the next one
+func allowRecipients(mode string, recipient string) (bool, time.Duration) {
+	limiter, limited := recipientLimiters[mode]
+	if !limited {
+		return true, 0
+	}
+
+	recipients := []string{recipient}
+	if mode == "email" {
+		recipients = models.SplitRecipients(recipient)
+	}
+	for i, single := range recipients {
+		if allowed, wait := limiter.Allow(single); !allowed {
+			for _, taken := range recipients[:i] {
+				limiter.Refund(taken)
+			}
+			return false, wait
+		}
+	}
+	return true, 0
+}
+
+// Take a send from the global limiter and to each recipient from the mode's limiter, or nothing at all,
+// so a refused notification doesn't use up a limit it wasn't refused by
+// Otherwise returns why it was refused and how long until it can be sent
+func allowNotification(mode string, recipient string) (bool, string, time.Duration) {
+	if globalLimiter != nil {
+		if allowed, wait := globalLimiter.Allow(); !allowed {
+			return false, "Global notification rate limit exceeded", wait
+		}
+	}
+	if allowed, wait := allowRecipients(mode, recipient); !allowed {
+		if globalLimiter != nil {
+			globalLimiter.Refund()
+		}
+		return false, "Recipient rate limit exceeded", wait
+	}
+	return true, "", 0
+}
+
+// Take a send from the global and recipient limiters. Otherwise responds with 429 and returns false
+func throttleNotification(ctx *gin.Context, mode string, recipient string) bool {
+	if allowed, reason, wait := allowNotification(mode, recipient); !allowed {
+		ctx.Header("Retry-After", strconv.Itoa(ratelimit.RetryAfterSeconds(wait)))
+		ctx.JSON(http.StatusTooManyRequests, gin.H{"message": reason})
+		return false
+	}
+	return true
+}
+
+// Take a send from the global limiter. Otherwise responds with 429 and returns false
+func throttleGlobal(ctx *gin.Context) bool {
+	if globalLimiter == nil {
+		return true
+	}
+	if allowed, wait := globalLimiter.Allow(); !allowed {
+		ctx.Header("Retry-After", strconv.Itoa(ratelimit.RetryAfterSeconds(wait)))
+		ctx.JSON(http.StatusTooManyRequests, gin.H{"message": "Global notification rate limit exceeded"})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// Replaces the global limiter for the duration of the test
+func useGlobalLimiter(t *testing.T, limiter *ratelimit.TokenBucket) {
+	previous := globalLimiter
+	globalLimiter = limiter
+	t.Cleanup(func() { globalLimiter = previous })
+}
+
+func TestGlobalLimiterIsUnlimitedByDefault(t *testing.T) {
+	t.Setenv("NS_GLOBAL_RATE_LIMIT", "")
+	if limiter := globalLimiterFromEnv(); limiter != nil {
+		t.Fatalf("expected no global limit by default")
+	}
+	t.Setenv("NS_GLOBAL_RATE_LIMIT", "lots")
+	if limiter := globalLimiterFromEnv(); limiter != nil {
+		t.Fatalf("expected an invalid global limit to be ignored")
+	}
+}
+
+func TestGlobalThrottleAcrossModes(t *testing.T) {
+	useMemoryStore(t)
+	now := time.Now()
+	useGlobalLimiter(t, ratelimit.NewTokenBucket(1, 2, func() time.Time { return now }))
+
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	// Scheduled, so they are accepted as soon as they pass the throttles
+	sendAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	post := func(mode string, recipient string) int {
+		response := postForm(t, router, "/notification", url.Values{
+			"mode":      {mode},
+			"message":   {"Hello"},
+			"recipient": {recipient},
+			"send_at":   {sendAt},
+		})
+		if response.Code == http.StatusTooManyRequests && response.Header().Get("Retry-After") == "" {
+			t.Fatalf("expected a Retry-After with the 429")
+		}
+		return response.Code
+	}
+
+	if code := post("email", "ops@example.com"); code != http.StatusAccepted {
+		t.Fatalf("expected the first notification to be accepted, got %d", code)
+	}
+	if code := post("sms", "+15555550100"); code != http.StatusAccepted {
+		t.Fatalf("expected the second notification to be accepted, got %d", code)
+	}
+	// The burst is used up, whichever mode comes next
+	if code := post("slack", "#ops"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the third notification to be throttled, got %d", code)
+	}
+	if code := post("webhook", "https://example.com/hook"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected the fourth notification to be throttled, got %d", code)
+	}
+
+	now = now.Add(time.Second)
+	if code := post("slack", "#ops"); code != http.StatusAccepted {
+		t.Fatalf("expected a notification to be accepted once the bucket refilled, got %d", code)
+	}
+}
+
+// Replaces the recipient limiters for the duration of the test
+func useRecipientLimiters(t *testing.T, limiters map[string]*ratelimit.KeyedLimiter) {
+	previous := recipientLimiters
+	recipientLimiters = limiters
+	t.Cleanup(func() { recipientLimiters = previous })
+}
+
+func TestRecipientLimitersFromEnv(t *testing.T) {
+	t.Setenv("NS_SMS_RECIPIENT_RATE_LIMIT", "6")
+	t.Setenv("NS_SMS_RECIPIENT_RATE_BURST", "2")
+	t.Setenv("NS_EMAIL_RECIPIENT_RATE_LIMIT", "often")
+	limiters := recipientLimitersFromEnv()
+	if _, limited := limiters["email"]; limited {
+		t.Fatalf("expected an invalid email limit to be ignored")
+	}
+	if _, limited := limiters["slack"]; limited {
+		t.Fatalf("expected slack to be unlimited by default")
+	}
+
+	sms := limiters["sms"]
+	if sms == nil {
+		t.Fatalf("expected an sms recipient limiter")
+	}
+	sms.Allow("+15550100")
+	sms.Allow("+15550100")
+	// 6 per minute, so the next send is 10 seconds away
+	if allowed, wait := sms.Allow("+15550100"); allowed || wait > 10*time.Second || wait < 9*time.Second {
+		t.Fatalf("expected the third send to wait about 10s, got %v after %s", allowed, wait)
+	}
+}
+
+func TestRecipientThrottleIsNotEnqueued(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakePipeline(t, map[string]bool{"sms": true})
+	now := time.Now()
+	useRecipientLimiters(t, map[string]*ratelimit.KeyedLimiter{
+		"sms": ratelimit.NewKeyedLimiter(1.0/60, 1, func() time.Time { return now }),
+	})
+
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+	post := func(recipient string) *httptest.ResponseRecorder {
+		return postForm(t, router, "/notification", url.Values{
+			"mode": {"sms"}, "message": {"Hello"}, "recipient": {recipient},
+		})
+	}
+
+	if response := post("+15550100"); response.Code != http.StatusOK {
+		t.Fatalf("expected the first sms to be sent, got %d %s", response.Code, response.Body)
+	}
+	response := post("+15550100")
+	if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") != "60" {
+		t.Fatalf("expected a 429 with Retry-After: 60, got %d %q", response.Code, response.Header().Get("Retry-After"))
+	}
+	if response := post("+15550101"); response.Code != http.StatusOK {
+		t.Fatalf("expected another recipient to be sent, got %d", response.Code)
+	}
+
+	if dispatched := producer.Messages(config.Current().Topics.Sms); len(dispatched) != 2 {
+		t.Fatalf("expected only the allowed sends on Kafka, got %d", len(dispatched))
+	}
+}
+
+func TestEveryEmailRecipientCountsAgainstItsLimit(t *testing.T) {
+	useMemoryStore(t)
+	now := time.Now()
+	useRecipientLimiters(t, map[string]*ratelimit.KeyedLimiter{
+		"email": ratelimit.NewKeyedLimiter(1.0/60, 1, func() time.Time { return now }),
+	})
+
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+	sendAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	post := func(recipient string) int {
+		return postForm(t, router, "/notification", url.Values{
+			"mode": {"email"}, "message": {"Hello"}, "recipient": {recipient}, "send_at": {sendAt},
+		}).Code
+	}
+
+	if code := post("a@example.com,b@example.com"); code != http.StatusAccepted {
+		t.Fatalf("expected the first list to be accepted, got %d", code)
+	}
+	// Listing b@example.com with someone else doesn't make it a new recipient
+	if code := post("c@example.com, b@example.com"); code != http.StatusTooManyRequests {
+		t.Fatalf("expected a list with a throttled recipient to be refused, got %d", code)
+	}
+	// Nor does the refusal use up c@example.com's limit
+	if code := post("c@example.com"); code != http.StatusAccepted {
+		t.Fatalf("expected c@example.com to be accepted, got %d", code)
+	}
+}
+
+func TestRefusedNotificationDoesNotUseUpTheOtherLimit(t *testing.T) {
+	useMemoryStore(t)
+	now := time.Now()
+	clock := func() time.Time { return now }
+	global := ratelimit.NewTokenBucket(1, 1, clock)
+	useGlobalLimiter(t, global)
+	useRecipientLimiters(t, map[string]*ratelimit.KeyedLimiter{
+		"sms": ratelimit.NewKeyedLimiter(1.0/60, 1, clock),
+	})
+
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+	sendAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	post := func(recipient string) *httptest.ResponseRecorder {
+		return postForm(t, router, "/notification", url.Values{
+			"mode": {"sms"}, "message": {"Hello"}, "recipient": {recipient}, "send_at": {sendAt},
+		})
+	}
+
+	if response := post("+15555550100"); response.Code != http.StatusAccepted {
+		t.Fatalf("expected the first sms to be accepted, got %d", response.Code)
+	}
+	// Refused by the global limit, the recipient keeps its send
+	now = now.Add(time.Minute)
+	global.Allow()
+	if response := post("+15555550101"); response.Code != http.StatusTooManyRequests ||
+		!strings.Contains(response.Body.String(), "Global") {
+		t.Fatalf("expected the global limit to refuse, got %d %s", response.Code, response.Body)
+	}
+	now = now.Add(time.Second)
+	if response := post("+15555550101"); response.Code != http.StatusAccepted {
+		t.Fatalf("expected the recipient's send to be left, got %d %s", response.Code, response.Body)
+	}
+
+	// Refused by the recipient limit, the global send is given back
+	now = now.Add(time.Second)
+	if response := post("+15555550101"); response.Code != http.StatusTooManyRequests ||
+		!strings.Contains(response.Body.String(), "Recipient") {
+		t.Fatalf("expected the recipient limit to refuse, got %d %s", response.Code, response.Body)
+	}
+	if allowed, _ := global.Allow(); !allowed {
+		t.Fatalf("expected the global send to be given back")
+	}
+}
+
+func TestFanoutChannelsCountAgainstTheirRecipientsLimit(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakePipeline(t, map[string]bool{"email": true, "sms": true, "slack": true})
+	now := time.Now()
+	useRecipientLimiters(t, map[string]*ratelimit.KeyedLimiter{
+		"sms": ratelimit.NewKeyedLimiter(1.0/60, 1, func() time.Time { return now }),
+	})
+
+	if code, body := fanoutToAllChannels(t, url.Values{}); code != http.StatusOK || channelStatuses(body)["sms"] != "sent" {
+		t.Fatalf("expected the first fan-out to send sms, got %d %v", code, channelStatuses(body))
+	}
+	code, body := fanoutToAllChannels(t, url.Values{})
+	expected := map[string]string{"email": "sent", "sms": "throttled", "slack": "sent"}
+	if statuses := channelStatuses(body); code != http.StatusOK || !maps.Equal(statuses, expected) {
+		t.Fatalf("expected %v, got %d %v", expected, code, statuses)
+	}
+	if dispatched := producer.Messages(config.Current().Topics.Sms); len(dispatched) != 1 {
+		t.Fatalf("expected only the first sms on Kafka, got %d", len(dispatched))
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+
+	"example.com/projectsolution/project/models"
+)
+
+// ====== USER PROFILES ======
+
+type UserProfileStore struct {
+	profiles map[string]models.UserProfile
+	mu       sync.RWMutex
+}
+
+// Profiles loaded from the JSON file in NS_USER_PROFILES_FILE, an object of user ID to profile
+var userProfiles = loadUserProfiles(os.Getenv("NS_USER_PROFILES_FILE"))
+
+func loadUserProfiles(path string) *UserProfileStore {
+	store := &UserProfileStore{profiles: make(map[string]models.UserProfile)}
+	if path == "" {
+		return store
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("failed to read user profiles: %v", err)
+		return store
+	}
+	if err := json.Unmarshal(content, &store.profiles); err != nil {
+		log.Printf("failed to parse user profiles: %v", err)
+	}
+	return store
+}
+
+// Retrieves a user's profile
+func (ups *UserProfileStore) Get(userID string) (models.UserProfile, bool) {
+	ups.mu.RLock()
+	defer ups.mu.RUnlock()
+	profile, exists := ups.profiles[userID]
+	return profile, exists
+}
+
+// Add or replace a user's profile
+func (ups *UserProfileStore) Set(userID string, profile models.UserProfile) {
+	ups.mu.Lock()
+	defer ups.mu.Unlock()
+	ups.profiles[userID] = profile
+}
+
+// A channel to notify and the recipient on it
+type fanoutTarget struct {
+	mode      string
+	recipient string
+}
+
+// The user's channels that are supported and not opted out of, in a stable order
+func userTargets(profile models.UserProfile) ([]fanoutTarget, error) {
+	var targets []fanoutTarget
+	for mode, recipient := range profile.Channels {
+		if !slices.Contains(supportedModes, mode) {
+			continue
+		}
+		if recipient == "" || slices.Contains(profile.OptOut, mode) {
+			continue
+		}
+		targets = append(targets, fanoutTarget{mode: mode, recipient: recipient})
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("user has no channels to notify, or opted out of all of them")
+	}
+
+	slices.SortFunc(targets, func(a, b fanoutTarget) int {
+		return slices.Index(supportedModes, a.mode) - slices.Index(supportedModes, b.mode)
+	})
+	return targets, nil
+}
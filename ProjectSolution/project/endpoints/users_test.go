@@ -0,0 +1,143 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package endpoints
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/models"
+	"github.com/gin-gonic/gin"
+)
+
+// Replaces the user profiles for the duration of the test
+func useUserProfiles(t *testing.T, profiles map[string]models.UserProfile) {
+	previous := userProfiles
+	userProfiles = loadUserProfiles("")
+	for userID, profile := range profiles {
+		userProfiles.Set(userID, profile)
+	}
+	t.Cleanup(func() { userProfiles = previous })
+}
+
+// The modes of the channels in a fan-out response, with their status
+type fanoutResponse struct {
+	ParentID string `json:"parent_id"`
+	Channels []struct {
+		Mode   string `json:"mode"`
+		Status string `json:"status"`
+	} `json:"channels"`
+}
+
+func TestLoadUserProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	content := `{"alice": {"channels": {"email": "alice@example.com", "sms": "+15555550100"}, "opt_out": ["sms"]}}`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	profiles := loadUserProfiles(path)
+	profile, exists := profiles.Get("alice")
+	if !exists || profile.Channels["email"] != "alice@example.com" || len(profile.OptOut) != 1 {
+		t.Fatalf("expected alice's profile, got %+v", profile)
+	}
+	if _, exists := profiles.Get("bob"); exists {
+		t.Fatalf("expected no profile for an unknown user")
+	}
+}
+
+func TestUserTargetsHonorOptOuts(t *testing.T) {
+	targets, err := userTargets(models.UserProfile{
+		Channels: map[string]string{
+			"slack":   "#alice",
+			"email":   "alice@example.com",
+			"sms":     "+15555550100",
+			"webhook": "",
+			"fax":     "+15555550199",
+		},
+		OptOut: []string{"sms"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opted out, blank and unsupported channels are left out, the rest is in the modes' order
+	expected := []fanoutTarget{{"email", "alice@example.com"}, {"slack", "#alice"}}
+	if len(targets) != len(expected) || targets[0] != expected[0] || targets[1] != expected[1] {
+		t.Fatalf("expected %v, got %v", expected, targets)
+	}
+
+	if _, err := userTargets(models.UserProfile{Channels: map[string]string{"sms": "+15555550100"}, OptOut: []string{"sms"}}); err == nil {
+		t.Fatalf("expected a user opted out of every channel to be rejected")
+	}
+}
+
+func TestUserIDExpandsToTheUsersChannels(t *testing.T) {
+	useMemoryStore(t)
+	producer := useFakePipeline(t, map[string]bool{"email": true, "sms": true, "slack": true})
+	useUserProfiles(t, map[string]models.UserProfile{
+		"alice": {
+			Channels: map[string]string{"email": "alice@example.com", "sms": "+15555550100", "slack": "#alice"},
+			OptOut:   []string{"slack"},
+		},
+	})
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	response := postForm(t, router, "/notification", url.Values{"user_id": {"alice"}, "message": {"Hello"}})
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %s", response.Code, response.Body)
+	}
+	var body fanoutResponse
+	if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Channels) != 2 || body.Channels[0].Mode != "email" || body.Channels[1].Mode != "sms" {
+		t.Fatalf("expected the email and sms channels, got %s", response.Body)
+	}
+
+	topics := config.Current().Topics
+	if len(producer.Messages(topics.Slack)) != 0 {
+		t.Fatalf("expected nothing to be sent on the opted out channel")
+	}
+	email, sms := producer.Notifications(topics.Email), producer.Notifications(topics.Sms)
+	if len(email) != 1 || len(sms) != 1 || email[0].Recipient != "alice@example.com" || sms[0].Recipient != "+15555550100" {
+		t.Fatalf("expected one notification per channel to the user's recipients, got %v and %v", email, sms)
+	}
+	// Correlated by the fan-out's ID
+	if email[0].ParentID.String() != body.ParentID || sms[0].ParentID != email[0].ParentID {
+		t.Fatalf("expected both channels to carry the parent ID %s", body.ParentID)
+	}
+}
+
+func TestUnknownUserID(t *testing.T) {
+	useMemoryStore(t)
+	useUserProfiles(t, nil)
+	router := gin.New()
+	router.POST("/notification", notificationHandler())
+
+	response := postForm(t, router, "/notification", url.Values{"user_id": {"nobody"}, "message": {"Hello"}})
+	if response.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d %s", response.Code, response.Body)
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package kafkawrapper
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+
+	"example.com/projectsolution/project/models"
+	"github.com/IBM/sarama"
+)
+
+// Prefix of the Kafka headers carrying a notification's analytics context
+const analyticsHeaderPrefix = "analytics."
+
+// Receives the analytics context of every consumed notification that has one
+// Purely informational, it never affects delivery. Logs a JSON line by default
+var AnalyticsSink = func(topic string, notification *models.Notification) {
+	analyticsJSON, err := json.Marshal(notification.AnalyticsContext)
+	if err != nil {
+		log.Printf("failed to marshal analytics context: %v", err)
+		return
+	}
+	log.Printf("analytics topic=%s mode=%s message_id=%s context=%s",
+		topic, notification.Mode, notification.MessageID, analyticsJSON)
+}
+
+// Kafka headers for the notification's analytics context
+func analyticsHeaders(notification models.Notification) []sarama.RecordHeader {
+	headers := make([]sarama.RecordHeader, 0, len(notification.AnalyticsContext))
+	for key, value := range notification.AnalyticsContext {
+		headers = append(headers, sarama.RecordHeader{
+			Key:   []byte(analyticsHeaderPrefix + key),
+			Value: []byte(value),
+		})
+	}
+	return headers
+}
+
+// Rebuild the analytics context from the consumed message's Kafka headers
+func analyticsContextFromHeaders(headers []*sarama.RecordHeader) map[string]string {
+	var analyticsContext map[string]string
+	for _, header := range headers {
+		key, found := strings.CutPrefix(string(header.Key), analyticsHeaderPrefix)
+		if !found {
+			continue
+		}
+		if analyticsContext == nil {
+			analyticsContext = make(map[string]string)
+		}
+		analyticsContext[key] = string(header.Value)
+	}
+	return analyticsContext
+}
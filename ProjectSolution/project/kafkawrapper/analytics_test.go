@@ -0,0 +1,74 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package kafkawrapper
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"example.com/projectsolution/project/kafkawrapper/kafkatest"
+	"example.com/projectsolution/project/models"
+	"github.com/IBM/sarama"
+)
+
+func TestAnalyticsContextRoundTripsThroughHeaders(t *testing.T) {
+	notification := validNotification()
+	notification.AnalyticsContext = map[string]string{"campaign_id": "spring-sale", "source": "billing"}
+
+	msg, err := producerMessage("email", notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := make([]*sarama.RecordHeader, 0, len(msg.Headers))
+	for i := range msg.Headers {
+		headers = append(headers, &msg.Headers[i])
+	}
+	// Headers of other origins are left out
+	headers = append(headers, &sarama.RecordHeader{Key: []byte("traceparent"), Value: []byte("00-abc")})
+
+	analyticsContext := analyticsContextFromHeaders(headers)
+	if len(analyticsContext) != 2 || analyticsContext["campaign_id"] != "spring-sale" || analyticsContext["source"] != "billing" {
+		t.Fatalf("expected the analytics context back from the headers, got %v", analyticsContext)
+	}
+
+	// Never part of the notification JSON
+	value, _ := msg.Value.Encode()
+	if strings.Contains(string(value), "spring-sale") {
+		t.Fatalf("expected the analytics context to stay out of the message value, got %s", value)
+	}
+}
+
+func TestConsumerHandsAnalyticsContextToTheSink(t *testing.T) {
+	defer func(sink func(string, *models.Notification)) { AnalyticsSink = sink }(AnalyticsSink)
+	var sunk map[string]string
+	AnalyticsSink = func(topic string, notification *models.Notification) {
+		sunk = notification.AnalyticsContext
+	}
+
+	var delivered map[string]string
+	header := &sarama.RecordHeader{Key: []byte("analytics.campaign_id"), Value: []byte("spring-sale")}
+	consumeClaim(t, context.Background(), func(notification *models.Notification) error {
+		delivered = notification.AnalyticsContext
+		return nil
+	}, kafkatest.NewClaim("email", consumerMessage(t, 0, validNotification(), header)))
+
+	if sunk["campaign_id"] != "spring-sale" || delivered["campaign_id"] != "spring-sale" {
+		t.Fatalf("expected the sink and the callback to get the analytics context, got %v and %v", sunk, delivered)
+	}
+}
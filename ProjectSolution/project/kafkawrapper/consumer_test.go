@@ -0,0 +1,204 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package kafkawrapper
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/kafkawrapper/kafkatest"
+	"example.com/projectsolution/project/models"
+	"github.com/IBM/sarama"
+	"github.com/google/uuid"
+)
+
+// A consumed message carrying the notification
+func consumerMessage(t *testing.T, offset int64, notification models.Notification,
+	headers ...*sarama.RecordHeader) *sarama.ConsumerMessage {
+
+	value, err := notificationEncoder(t, notification).Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sarama.ConsumerMessage{Offset: offset, Value: value, Headers: headers}
+}
+
+// Run the claim through a Consumer with the callback, returning the session once every message was handled
+func consumeClaim(t *testing.T, ctx context.Context, callback msgCallback, claim *kafkatest.Claim) *kafkatest.Session {
+	session := kafkatest.NewSession(ctx)
+	consumer := NewConsumer(callback)
+	if err := consumer.ConsumeClaim(session, claim); err != nil {
+		t.Fatalf("ConsumeClaim failed: %v", err)
+	}
+	return session
+}
+
+func TestMessageIsMarkedOnlyAfterItsCallbackUpdatedTheStore(t *testing.T) {
+	notifications := []models.Notification{validNotification(), validNotification(), validNotification()}
+	var msgs []*sarama.ConsumerMessage
+	for offset, notification := range notifications {
+		msgs = append(msgs, consumerMessage(t, int64(offset), notification))
+	}
+
+	stored := make(map[int64]bool)
+	session := kafkatest.NewSession(context.Background())
+	session.OnMark = func(msg *sarama.ConsumerMessage) {
+		if !stored[msg.Offset] {
+			t.Errorf("offset %d was marked before its callback updated the store", msg.Offset)
+		}
+	}
+	consumer := NewConsumer(func(notification *models.Notification) error {
+		for offset, consumed := range notifications {
+			if consumed.MessageID != notification.MessageID {
+				continue
+			}
+			if slices.Contains(session.Marked(), int64(offset)) {
+				t.Errorf("offset %d was marked before its callback ran", offset)
+			}
+			stored[int64(offset)] = true
+		}
+		return nil
+	})
+	if err := consumer.ConsumeClaim(session, kafkatest.NewClaim("processed", msgs...)); err != nil {
+		t.Fatal(err)
+	}
+
+	if marked := session.Marked(); !slices.Equal(marked, []int64{0, 1, 2}) {
+		t.Fatalf("expected every message to be marked in order once handled, got %v", marked)
+	}
+}
+
+func TestMessagesAfterTheSessionEndedAreLeftToTheNextOne(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	called := false
+	session := consumeClaim(t, ctx, func(*models.Notification) error {
+		called = true
+		return nil
+	}, kafkatest.NewClaim("email", consumerMessage(t, 0, validNotification())))
+
+	if called || len(session.Marked()) != 0 {
+		t.Fatalf("expected the message to be neither handled nor marked, got called=%v marked=%v",
+			called, session.Marked())
+	}
+}
+
+func TestCleanupCommitsTheMarkedOffsets(t *testing.T) {
+	session := kafkatest.NewSession(context.Background())
+	if err := (&Consumer{}).Cleanup(session); err != nil {
+		t.Fatal(err)
+	}
+	if session.Commits() != 1 {
+		t.Fatalf("expected the marked offsets to be committed before a rebalance, got %d commits", session.Commits())
+	}
+}
+
+func TestPanickingCallbackDoesNotKillTheConsumer(t *testing.T) {
+	useErrorPolicy(t, ErrorPolicySkip)
+	panicsBefore := errorMetric("callback_panics")
+
+	bad := validNotification()
+	good := validNotification()
+	var handled []uuid.UUID
+	session := consumeClaim(t, context.Background(), func(notification *models.Notification) error {
+		if notification.MessageID == bad.MessageID {
+			panic("store update failed")
+		}
+		handled = append(handled, notification.MessageID)
+		return nil
+	}, kafkatest.NewClaim("processed", consumerMessage(t, 0, bad), consumerMessage(t, 1, good)))
+
+	if len(handled) != 1 || handled[0] != good.MessageID {
+		t.Fatalf("expected the message after the panic to be handled, got %v", handled)
+	}
+	if marked := session.Marked(); len(marked) != 2 {
+		t.Fatalf("expected both messages to be marked, got %v", marked)
+	}
+	if panics := errorMetric("callback_panics") - panicsBefore; panics != 1 {
+		t.Fatalf("expected the panic to be counted once, got %d", panics)
+	}
+}
+
+func TestPanicIsReportedAsAnError(t *testing.T) {
+	notification := validNotification()
+	err := invokeCallback(func(*models.Notification) error { panic("boom") }, &notification)
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("expected the panic as an error, got %v", err)
+	}
+}
+
+func TestConsumerJoinsOnceTheBrokerComesUp(t *testing.T) {
+	// A free address nobody listens on yet
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	previous := config.Current()
+	current := previous
+	current.KafkaBrokers = []string{address}
+	config.SetCurrent(current)
+	t.Cleanup(func() { config.SetCurrent(previous) })
+
+	retriesBefore := errorMetric("join_retried")
+	ctx, cancel := context.WithCancel(context.Background())
+	StartReceivingKafkaMessages(ctx, "late-broker", func(*models.Notification) error { return nil })
+	t.Cleanup(func() {
+		cancel()
+		if !WaitForConsumers(10 * time.Second) {
+			t.Errorf("expected the consumer to stop")
+		}
+	})
+
+	waitFor(t, "the join to fail while the broker is down", func() bool {
+		return errorMetric("join_retried") > retriesBefore
+	})
+	if ConsumerReady("late-broker") {
+		t.Fatalf("expected the consumer not to be ready without a broker")
+	}
+
+	broker := sarama.NewMockBrokerAddr(t, 1, address)
+	t.Cleanup(broker.Close)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("late-broker", 0, broker.BrokerID()),
+	})
+
+	waitFor(t, "the consumer to join", func() bool { return ConsumerReady("late-broker") })
+}
+
+// Poll the condition until it holds, failing after a while
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package kafkawrapper
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/models"
+	"github.com/IBM/sarama"
+)
+
+// What the consumer does with a message it fails to process
+type ErrorPolicy string
+
+const (
+	// Redeliver to a failing callback with backoff, then route to the dead-letter topic once out of attempts
+	// A message that can't be decoded would fail the same way again, it goes straight to the dead-letter topic
+	ErrorPolicyRetry ErrorPolicy = "retry"
+	// Log and move on, the message is lost
+	ErrorPolicySkip ErrorPolicy = "skip"
+	// Route the raw message to the dead-letter topic for later inspection
+	ErrorPolicyDLQ ErrorPolicy = "dlq"
+)
+
+// Where messages and notifications that can't be processed end up, NS_KAFKA_TOPIC_DEAD_LETTER
+var DeadLetterTopic = config.Current().Topics.DeadLetter
+
+const (
+	maxMessageRetries = 3
+	baseRetryBackoff  = 100 * time.Millisecond
+	maxRetryBackoff   = 5 * time.Second
+)
+
+// Consumer error policy, configured with NS_KAFKA_ERROR_POLICY (retry, skip or dlq). Defaults to retry,
+// so a failing callback is redelivered and nothing is lost without a trace
+var ConsumerErrorPolicy = errorPolicyFromEnv()
+
+// Counts of every consumer error outcome, published with expvar under "kafka_consumer_errors"
+var ConsumerErrorMetrics = expvar.NewMap("kafka_consumer_errors")
+
+func errorPolicyFromEnv() ErrorPolicy {
+	policy := ErrorPolicy(os.Getenv("NS_KAFKA_ERROR_POLICY"))
+	switch policy {
+	case ErrorPolicyRetry, ErrorPolicySkip, ErrorPolicyDLQ:
+		return policy
+	case "":
+		return ErrorPolicyRetry
+	default:
+		log.Printf("ignoring unknown NS_KAFKA_ERROR_POLICY %q", policy)
+		return ErrorPolicyRetry
+	}
+}
+
+// Exponential backoff for the n-th retry (starting at 1), capped at maxRetryBackoff
+func retryBackoff(attempt int) time.Duration {
+	backoff := baseRetryBackoff
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRetryBackoff)
+}
+
+// Turn a consumed message into a notification, rejecting anything the services can't handle
+func decodeMessage(msg *sarama.ConsumerMessage) (models.Notification, error) {
+	var notification models.Notification
+	if err := json.Unmarshal(msg.Value, &notification); err != nil {
+		return notification, fmt.Errorf("failed to unmarshal notification: %w", err)
+	}
+	// Should have been stopped at the producer, don't hand it to the services
+	if err := models.CheckMessageSize(notification.Message); err != nil {
+		return notification, fmt.Errorf("notification %s rejected: %w", notification.MessageID, err)
+	}
+	return notification, nil
+}
+
+// Hand the notification to the callback. With the retry policy a failing callback gets the message
+// redelivered with backoff, so it doesn't hot-loop, and after maxMessageRetries redeliveries it is
+// dead-lettered. The skip and dlq policies give up on the first failure
+// Only callbacks doing their work inline get anything out of this, the mode topics' callbacks hand
+// the notification off to the services, which retry the send and dead-letter it themselves
+// Returns false if `ctx` ended before the message was either processed or given up on, or if it
+// couldn't be dead-lettered
+func deliverWithRedelivery(ctx context.Context, messageCallbackFunction msgCallback, msg *sarama.ConsumerMessage,
+	notification *models.Notification) bool {
+
+	redeliveries := 0
+	if ConsumerErrorPolicy == ErrorPolicyRetry {
+		redeliveries = maxMessageRetries
+	}
+
+	consumed := *notification
+	err := invokeCallback(messageCallbackFunction, notification)
+	for attempt := 1; err != nil && attempt <= redeliveries; attempt++ {
+		ConsumerErrorMetrics.Add("redelivered", 1)
+		backoff := retryBackoff(attempt)
+		log.Printf("callback failed for notification %s, redelivering in %s (attempt %d of %d): %v",
+			notification.MessageID, backoff, attempt, redeliveries, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+
+		// Every attempt gets the notification as it was consumed, not as a failed callback left it
+		redelivered := consumed
+		err = invokeCallback(messageCallbackFunction, &redelivered)
+	}
+	if err == nil {
+		return true
+	}
+
+	return giveUpOnMessage(msg, fmt.Errorf("callback failed after %d redeliveries: %w", redeliveries, err))
+}
+
+// Skip or dead-letter a message that can't be processed, as the error policy says
+// Returns false if the message couldn't be dead-lettered, it must then stay unmarked so it isn't lost
+func giveUpOnMessage(msg *sarama.ConsumerMessage, cause error) bool {
+	// Dead-lettering a message consumed from the dead-letter topic would loop forever
+	if ConsumerErrorPolicy == ErrorPolicySkip || msg.Topic == DeadLetterTopic {
+		ConsumerErrorMetrics.Add("skipped", 1)
+		log.Printf("skipping message at %s/%d/%d: %v", msg.Topic, msg.Partition, msg.Offset, cause)
+		return true
+	}
+
+	if dlqErr := sendToDeadLetter(msg, cause); dlqErr != nil {
+		ConsumerErrorMetrics.Add("dead_letter_failed", 1)
+		log.Printf("failed to dead-letter message at %s/%d/%d (%v): %v",
+			msg.Topic, msg.Partition, msg.Offset, cause, dlqErr)
+		return false
+	}
+	ConsumerErrorMetrics.Add("dead_lettered", 1)
+	log.Printf("dead-lettered message at %s/%d/%d: %v", msg.Topic, msg.Partition, msg.Offset, cause)
+	return true
+}
+
+// Publish a notification the services gave up on to the dead-letter topic, with its number of
+// attempts and last error also in the headers so tools can filter without decoding the value
+func SendNotificationToDeadLetter(notification models.Notification) error {
+	producer, err := NewProducer()
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	notificationJSON, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	headers := append(analyticsHeaders(notification),
+		sarama.RecordHeader{Key: []byte("dlq.original-topic"), Value: []byte(config.Current().Topics.ForMode(notification.Mode))},
+		sarama.RecordHeader{Key: []byte("dlq.attempts"), Value: []byte(strconv.Itoa(notification.NumOfRepetitions))},
+		sarama.RecordHeader{Key: []byte("dlq.error"), Value: []byte(notification.FailReason)},
+	)
+
+	_, _, err = producer.SendMessage(&sarama.ProducerMessage{
+		Topic:   DeadLetterTopic,
+		Key:     sarama.StringEncoder(notification.MessageID.String()),
+		Value:   sarama.ByteEncoder(notificationJSON),
+		Headers: headers,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to sent on kafka topic: %w", err)
+	}
+	return nil
+}
+
+// Consume the dead-letter topic until `ctx` is done, e.g. for a tool retrying dead-lettered notifications
+// Raw messages dead-lettered because they couldn't be decoded are skipped, they have no notification to hand over
+func ReceiveDeadLetters(ctx context.Context, messageCallbackFunction msgCallback) {
+	ReceiveKafkaMessage(ctx, DeadLetterTopic, messageCallbackFunction)
+}
+
+// Forward the raw message to the dead-letter topic, recording where it came from and why
+func sendToDeadLetter(msg *sarama.ConsumerMessage, cause error) error {
+	producer, err := NewProducer()
+	if err != nil {
+		return err
+	}
+	defer producer.Close()
+
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers)+2)
+	for _, header := range msg.Headers {
+		headers = append(headers, *header)
+	}
+	headers = append(headers,
+		sarama.RecordHeader{Key: []byte("dlq.original-topic"), Value: []byte(msg.Topic)},
+		sarama.RecordHeader{Key: []byte("dlq.error"), Value: []byte(cause.Error())},
+	)
+
+	_, _, err = producer.SendMessage(&sarama.ProducerMessage{
+		Topic:   DeadLetterTopic,
+		Key:     sarama.ByteEncoder(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to sent on kafka topic: %w", err)
+	}
+	return nil
+}
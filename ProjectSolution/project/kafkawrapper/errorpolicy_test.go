@@ -0,0 +1,304 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package kafkawrapper
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/kafkawrapper/kafkatest"
+	"example.com/projectsolution/project/models"
+	"github.com/IBM/sarama"
+)
+
+// Apply the error policy for the duration of the test
+func useErrorPolicy(t *testing.T, policy ErrorPolicy) {
+	previous := ConsumerErrorPolicy
+	ConsumerErrorPolicy = policy
+	t.Cleanup(func() { ConsumerErrorPolicy = previous })
+}
+
+func errorMetric(name string) int64 {
+	if value, ok := ConsumerErrorMetrics.Get(name).(*expvar.Int); ok {
+		return value.Value()
+	}
+	return 0
+}
+
+func TestErrorPolicyFromEnv(t *testing.T) {
+	tests := map[string]ErrorPolicy{
+		"":       ErrorPolicyRetry,
+		"retry":  ErrorPolicyRetry,
+		"skip":   ErrorPolicySkip,
+		"dlq":    ErrorPolicyDLQ,
+		"ignore": ErrorPolicyRetry,
+	}
+	for value, expected := range tests {
+		t.Setenv("NS_KAFKA_ERROR_POLICY", value)
+		if policy := errorPolicyFromEnv(); policy != expected {
+			t.Fatalf("%q: expected %s, got %s", value, expected, policy)
+		}
+	}
+}
+
+func TestUndecodableMessagePolicies(t *testing.T) {
+	tests := []struct {
+		policy       ErrorPolicy
+		deadLettered bool
+	}{
+		// Decoding again would fail the same way, retry dead-letters right away
+		{ErrorPolicyRetry, true},
+		{ErrorPolicyDLQ, true},
+		{ErrorPolicySkip, false},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			useErrorPolicy(t, test.policy)
+			producer := useFakeProducer(t)
+			skipped, deadLettered := errorMetric("skipped"), errorMetric("dead_lettered")
+
+			session := consumeClaim(t, context.Background(), func(*models.Notification) error {
+				t.Fatal("callback called for an undecodable message")
+				return nil
+			}, kafkatest.NewClaim("email", &sarama.ConsumerMessage{Offset: 7, Value: []byte("not json")}))
+
+			if marked := session.Marked(); len(marked) != 1 || marked[0] != 7 {
+				t.Fatalf("expected the message to be marked either way, got %v", marked)
+			}
+
+			dlq := producer.Messages(DeadLetterTopic)
+			if !test.deadLettered {
+				if len(dlq) != 0 || errorMetric("skipped") != skipped+1 {
+					t.Fatalf("expected the message to be skipped, got %d dead-lettered", len(dlq))
+				}
+				return
+			}
+			if len(dlq) != 1 || errorMetric("dead_lettered") != deadLettered+1 {
+				t.Fatalf("expected the message to be dead-lettered once, got %d", len(dlq))
+			}
+			if topic, _ := kafkatest.Header(dlq[0], "dlq.original-topic"); topic != "email" {
+				t.Fatalf("expected the original topic in the header, got %q", topic)
+			}
+			if value, _ := dlq[0].Value.Encode(); string(value) != "not json" {
+				t.Fatalf("expected the raw message to be dead-lettered, got %q", value)
+			}
+		})
+	}
+}
+
+func TestCallbackFailurePolicies(t *testing.T) {
+	tests := []struct {
+		policy       ErrorPolicy
+		calls        int32
+		deadLettered bool
+	}{
+		{ErrorPolicyRetry, 1 + maxMessageRetries, true},
+		{ErrorPolicyDLQ, 1, true},
+		{ErrorPolicySkip, 1, false},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			useErrorPolicy(t, test.policy)
+			producer := useFakeProducer(t)
+
+			var calls atomic.Int32
+			session := consumeClaim(t, context.Background(), func(*models.Notification) error {
+				calls.Add(1)
+				return errors.New("store unavailable")
+			}, kafkatest.NewClaim("email", consumerMessage(t, 3, validNotification())))
+
+			if calls.Load() != test.calls {
+				t.Fatalf("expected %d callback calls, got %d", test.calls, calls.Load())
+			}
+			if marked := session.Marked(); len(marked) != 1 {
+				t.Fatalf("expected the given up message to be marked, got %v", marked)
+			}
+			if dlq := producer.Messages(DeadLetterTopic); (len(dlq) == 1) != test.deadLettered {
+				t.Fatalf("expected dead-lettered=%v, got %d dead-letter messages", test.deadLettered, len(dlq))
+			}
+		})
+	}
+}
+
+func TestDeadLetterTopicIsNeverDeadLettered(t *testing.T) {
+	useErrorPolicy(t, ErrorPolicyDLQ)
+	producer := useFakeProducer(t)
+
+	consumeClaim(t, context.Background(), func(*models.Notification) error {
+		return errors.New("still failing")
+	}, kafkatest.NewClaim(DeadLetterTopic,
+		&sarama.ConsumerMessage{Offset: 0, Value: []byte("not json")},
+		consumerMessage(t, 1, validNotification())))
+
+	if dlq := producer.Messages(DeadLetterTopic); len(dlq) != 0 {
+		t.Fatalf("expected dead-letter messages to be skipped, got %d dead-lettered again", len(dlq))
+	}
+}
+
+func TestFailedDeadLetteringIsCounted(t *testing.T) {
+	useErrorPolicy(t, ErrorPolicyDLQ)
+	producer := useFakeProducer(t)
+	producer.TopicErrs[DeadLetterTopic] = sarama.ErrNotLeaderForPartition
+	failed := errorMetric("dead_letter_failed")
+
+	start := time.Now()
+	session := consumeClaim(t, context.Background(), func(*models.Notification) error { return nil },
+		kafkatest.NewClaim("email", &sarama.ConsumerMessage{Value: []byte("not json")}))
+
+	if errorMetric("dead_letter_failed") != failed+1 {
+		t.Fatalf("expected the failed dead-lettering to be counted")
+	}
+	if marked := session.Marked(); len(marked) != 0 {
+		t.Fatalf("expected the message to stay unmarked, got %v", marked)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("expected no retries for an undecodable message")
+	}
+}
+
+func TestMessageThatCannotBeDeadLetteredStaysUnmarked(t *testing.T) {
+	useErrorPolicy(t, ErrorPolicyDLQ)
+	producer := useFakeProducer(t)
+	producer.TopicErrs[DeadLetterTopic] = sarama.ErrNotLeaderForPartition
+
+	session := consumeClaim(t, context.Background(), func(*models.Notification) error {
+		return errors.New("store unavailable")
+	}, kafkatest.NewClaim("processed",
+		consumerMessage(t, 4, validNotification()),
+		consumerMessage(t, 5, validNotification())))
+
+	// Consumed again by the next session instead of being lost
+	if marked := session.Marked(); len(marked) != 0 {
+		t.Fatalf("expected no message to be marked, got %v", marked)
+	}
+}
+
+func TestRetryBackoffIsExponentialAndCapped(t *testing.T) {
+	expected := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}
+	for i, backoff := range expected {
+		if got := retryBackoff(i + 1); got != backoff {
+			t.Fatalf("attempt %d: expected %s, got %s", i+1, backoff, got)
+		}
+	}
+	if got := retryBackoff(50); got != maxRetryBackoff {
+		t.Fatalf("expected the backoff to be capped at %s, got %s", maxRetryBackoff, got)
+	}
+}
+
+func TestPersistentlyFailingMessageIsRedeliveredWithBackoffThenDeadLettered(t *testing.T) {
+	useErrorPolicy(t, ErrorPolicyRetry)
+	producer := useFakeProducer(t)
+	redeliveredBefore := errorMetric("redelivered")
+
+	var calls []time.Time
+	consumed := validNotification()
+	session := consumeClaim(t, context.Background(), func(notification *models.Notification) error {
+		calls = append(calls, time.Now())
+		if notification.Message != consumed.Message {
+			t.Errorf("expected every attempt to get the notification as consumed, got %q", notification.Message)
+		}
+		// A failing callback leaving its changes behind
+		notification.Message = "changed by a failed attempt"
+		return errors.New("store unavailable")
+	}, kafkatest.NewClaim("email", consumerMessage(t, 7, consumed)))
+
+	if len(calls) != 1+maxMessageRetries {
+		t.Fatalf("expected %d attempts, got %d", 1+maxMessageRetries, len(calls))
+	}
+	for i := 1; i < len(calls); i++ {
+		if gap := calls[i].Sub(calls[i-1]); gap < retryBackoff(i) {
+			t.Fatalf("expected redelivery %d to back off %s, got %s", i, retryBackoff(i), gap)
+		}
+	}
+	if redelivered := errorMetric("redelivered") - redeliveredBefore; redelivered != maxMessageRetries {
+		t.Fatalf("expected %d redeliveries counted, got %d", maxMessageRetries, redelivered)
+	}
+	if dlq := producer.Messages(DeadLetterTopic); len(dlq) != 1 {
+		t.Fatalf("expected the message to be dead-lettered once out of attempts, got %d", len(dlq))
+	}
+	if marked := session.Marked(); len(marked) != 1 || marked[0] != 7 {
+		t.Fatalf("expected the dead-lettered message to be marked, got %v", marked)
+	}
+}
+
+func TestShutdownDuringBackoffLeavesTheMessageUnmarked(t *testing.T) {
+	useErrorPolicy(t, ErrorPolicyRetry)
+	producer := useFakeProducer(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	session := consumeClaim(t, ctx, func(*models.Notification) error {
+		cancel()
+		return errors.New("store unavailable")
+	}, kafkatest.NewClaim("email", consumerMessage(t, 8, validNotification())))
+
+	// Consumed again after the restart instead
+	if marked := session.Marked(); len(marked) != 0 {
+		t.Fatalf("expected the message to stay unmarked, got %v", marked)
+	}
+	if dlq := producer.Messages(DeadLetterTopic); len(dlq) != 0 {
+		t.Fatalf("expected nothing to be dead-lettered on shutdown, got %d", len(dlq))
+	}
+}
+
+func TestGivenUpNotificationIsDeadLetteredWithItsAttemptsAndError(t *testing.T) {
+	producer := useFakeProducer(t)
+	notification := validNotification()
+	notification.Mode = "sms"
+	notification.NumOfRepetitions = 3
+	notification.FailReason = "Too many failed attempts. Last attempt failed with: provider unavailable"
+
+	if err := SendNotificationToDeadLetter(notification); err != nil {
+		t.Fatal(err)
+	}
+
+	dlq := producer.Messages(DeadLetterTopic)
+	if len(dlq) != 1 {
+		t.Fatalf("expected one dead-letter message, got %d", len(dlq))
+	}
+	expected := map[string]string{
+		"dlq.original-topic": config.Current().Topics.Sms,
+		"dlq.attempts":       "3",
+		"dlq.error":          notification.FailReason,
+	}
+	for key, value := range expected {
+		if header, _ := kafkatest.Header(dlq[0], key); header != value {
+			t.Fatalf("expected header %s to be %q, got %q", key, value, header)
+		}
+	}
+	if key, _ := dlq[0].Key.Encode(); string(key) != notification.MessageID.String() {
+		t.Fatalf("expected the message to be keyed by its messageID, got %q", key)
+	}
+	if dead := producer.Notifications(DeadLetterTopic); len(dead) != 1 || dead[0].FailReason != notification.FailReason {
+		t.Fatalf("expected the notification itself as the value, got %+v", dead)
+	}
+}
+
+func TestFailedDeadLetteringIsReturned(t *testing.T) {
+	producer := useFakeProducer(t)
+	producer.TopicErrs[DeadLetterTopic] = sarama.ErrNotLeaderForPartition
+	if err := SendNotificationToDeadLetter(validNotification()); err == nil {
+		t.Fatalf("expected the failure to be returned")
+	}
+}
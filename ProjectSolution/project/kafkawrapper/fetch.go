@@ -0,0 +1,87 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package kafkawrapper
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// Consumer fetch tuning applied to the consumer group of a single topic
+type FetchConfig struct {
+	MinBytes     int32
+	DefaultBytes int32
+	MaxBytes     int32
+	MaxWaitTime  time.Duration
+}
+
+// Fetch presets by priority. High priority topics return as soon as anything is available,
+// low priority ones wait to batch up more data per request. "normal" keeps sarama's defaults
+var FetchPriorities = map[string]FetchConfig{
+	"high":   {MinBytes: 1, DefaultBytes: 1024 * 1024, MaxBytes: 0, MaxWaitTime: 10 * time.Millisecond},
+	"normal": {MinBytes: 1, DefaultBytes: 1024 * 1024, MaxBytes: 0, MaxWaitTime: 500 * time.Millisecond},
+	"low":    {MinBytes: 64 * 1024, DefaultBytes: 1024 * 1024, MaxBytes: 0, MaxWaitTime: 2 * time.Second},
+}
+
+var (
+	topicFetchConfig   = map[string]FetchConfig{}
+	topicFetchConfigMu sync.RWMutex
+)
+
+// Override the fetch tuning of a topic. Takes effect the next time a consumer for the topic is created
+func SetTopicFetchConfig(topic string, fetch FetchConfig) {
+	topicFetchConfigMu.Lock()
+	defer topicFetchConfigMu.Unlock()
+	topicFetchConfig[topic] = fetch
+}
+
+// Returns the fetch tuning of a topic: an explicit override if set, otherwise the preset named by
+// NS_KAFKA_FETCH_PRIORITY_<TOPIC> (high, normal or low), otherwise "normal"
+func TopicFetchConfig(topic string) FetchConfig {
+	topicFetchConfigMu.RLock()
+	fetch, exists := topicFetchConfig[topic]
+	topicFetchConfigMu.RUnlock()
+	if exists {
+		return fetch
+	}
+
+	envVar := "NS_KAFKA_FETCH_PRIORITY_" + strings.ToUpper(strings.ReplaceAll(topic, "-", "_"))
+	priority := os.Getenv(envVar)
+	if priority == "" {
+		priority = "normal"
+	}
+	fetch, exists = FetchPriorities[priority]
+	if !exists {
+		log.Printf("ignoring unknown %s %q", envVar, priority)
+		return FetchPriorities["normal"]
+	}
+	return fetch
+}
+
+// Apply the fetch tuning onto a sarama config
+func (fetch FetchConfig) apply(config *sarama.Config) {
+	config.Consumer.Fetch.Min = fetch.MinBytes
+	config.Consumer.Fetch.Default = fetch.DefaultBytes
+	config.Consumer.Fetch.Max = fetch.MaxBytes
+	config.Consumer.MaxWaitTime = fetch.MaxWaitTime
+}
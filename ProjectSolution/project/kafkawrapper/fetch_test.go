@@ -0,0 +1,72 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package kafkawrapper
+
+import (
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+func TestTopicFetchConfigFromPriority(t *testing.T) {
+	tests := []struct {
+		priority string
+		expected FetchConfig
+	}{
+		{"", FetchPriorities["normal"]},
+		{"high", FetchPriorities["high"]},
+		{"low", FetchPriorities["low"]},
+		{"urgent", FetchPriorities["normal"]},
+	}
+
+	for _, test := range tests {
+		t.Setenv("NS_KAFKA_FETCH_PRIORITY_DEAD_LETTER", test.priority)
+		if fetch := TopicFetchConfig("dead-letter"); fetch != test.expected {
+			t.Fatalf("priority %q: expected %+v, got %+v", test.priority, test.expected, fetch)
+		}
+	}
+}
+
+func TestSetTopicFetchConfigOverridesPriority(t *testing.T) {
+	t.Setenv("NS_KAFKA_FETCH_PRIORITY_OVERRIDDEN", "low")
+	override := FetchConfig{MinBytes: 10, DefaultBytes: 20, MaxBytes: 30, MaxWaitTime: 40}
+	SetTopicFetchConfig("overridden", override)
+	t.Cleanup(func() {
+		topicFetchConfigMu.Lock()
+		delete(topicFetchConfig, "overridden")
+		topicFetchConfigMu.Unlock()
+	})
+
+	if fetch := TopicFetchConfig("overridden"); fetch != override {
+		t.Fatalf("expected the override %+v, got %+v", override, fetch)
+	}
+}
+
+func TestFetchConfigApply(t *testing.T) {
+	high := FetchPriorities["high"]
+	saramaConfig := sarama.NewConfig()
+	high.apply(saramaConfig)
+
+	if saramaConfig.Consumer.Fetch.Min != high.MinBytes || saramaConfig.Consumer.Fetch.Default != high.DefaultBytes ||
+		saramaConfig.Consumer.Fetch.Max != high.MaxBytes || saramaConfig.Consumer.MaxWaitTime != high.MaxWaitTime {
+		t.Fatalf("expected the high priority tuning on the sarama config, got %+v", saramaConfig.Consumer)
+	}
+	if err := saramaConfig.Validate(); err != nil {
+		t.Fatalf("expected a valid sarama config, got %v", err)
+	}
+}
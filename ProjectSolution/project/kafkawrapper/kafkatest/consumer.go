@@ -0,0 +1,99 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package kafkatest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// A sarama.ConsumerGroupSession recording what gets marked and committed
+type Session struct {
+	// Called as a message is marked, if set
+	OnMark func(*sarama.ConsumerMessage)
+
+	ctx     context.Context
+	marked  []int64
+	commits int
+	mu      sync.Mutex
+}
+
+func NewSession(ctx context.Context) *Session {
+	return &Session{ctx: ctx}
+}
+
+func (session *Session) Claims() map[string][]int32 { return nil }
+func (session *Session) MemberID() string           { return "member" }
+func (session *Session) GenerationID() int32        { return 1 }
+func (session *Session) Context() context.Context   { return session.ctx }
+
+func (session *Session) MarkOffset(string, int32, int64, string)  {}
+func (session *Session) ResetOffset(string, int32, int64, string) {}
+
+func (session *Session) Commit() {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.commits++
+}
+
+func (session *Session) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	if session.OnMark != nil {
+		session.OnMark(msg)
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.marked = append(session.marked, msg.Offset)
+}
+
+// The offsets of the marked messages, in the order they were marked
+func (session *Session) Marked() []int64 {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return append([]int64(nil), session.marked...)
+}
+
+func (session *Session) Commits() int {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.commits
+}
+
+// A sarama.ConsumerGroupClaim handing out the given messages
+type Claim struct {
+	topic    string
+	messages chan *sarama.ConsumerMessage
+}
+
+// The messages are set to the topic and the claim ends after the last of them
+func NewClaim(topic string, msgs ...*sarama.ConsumerMessage) *Claim {
+	claim := &Claim{topic: topic, messages: make(chan *sarama.ConsumerMessage, len(msgs))}
+	for _, msg := range msgs {
+		msg.Topic = topic
+		claim.messages <- msg
+	}
+	close(claim.messages)
+	return claim
+}
+
+func (claim *Claim) Topic() string                            { return claim.topic }
+func (claim *Claim) Partition() int32                         { return 0 }
+func (claim *Claim) InitialOffset() int64                     { return 0 }
+func (claim *Claim) HighWaterMarkOffset() int64               { return int64(cap(claim.messages)) }
+func (claim *Claim) Messages() <-chan *sarama.ConsumerMessage { return claim.messages }
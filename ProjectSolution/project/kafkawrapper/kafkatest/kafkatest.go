@@ -0,0 +1,137 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+// Fakes of the Kafka producer and consumer, for testing the packages producing and consuming
+// notifications without a broker
+package kafkatest
+
+import (
+	"encoding/json"
+	"sync"
+
+	"example.com/projectsolution/project/models"
+	"github.com/IBM/sarama"
+)
+
+// A sarama.SyncProducer recording the messages it is given instead of producing them
+// Use Open as kafkawrapper.NewProducer. Only the sending methods are implemented
+type Producer struct {
+	sarama.SyncProducer
+
+	// Returned by Open instead of the producer, if set
+	OpenErr error
+	// Returned for every message to these topics, if set
+	TopicErrs map[string]error
+
+	messages []*sarama.ProducerMessage
+	opened   int
+	closed   int
+	mu       sync.Mutex
+}
+
+func NewProducer() *Producer {
+	return &Producer{TopicErrs: make(map[string]error)}
+}
+
+// Hands out the fake, as kafkawrapper.NewProducer does a real producer
+func (producer *Producer) Open() (sarama.SyncProducer, error) {
+	producer.mu.Lock()
+	defer producer.mu.Unlock()
+	if producer.OpenErr != nil {
+		return nil, producer.OpenErr
+	}
+	producer.opened++
+	return producer, nil
+}
+
+func (producer *Producer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	producer.mu.Lock()
+	defer producer.mu.Unlock()
+	if err := producer.TopicErrs[msg.Topic]; err != nil {
+		return 0, 0, err
+	}
+	producer.messages = append(producer.messages, msg)
+	return 0, int64(len(producer.messages) - 1), nil
+}
+
+func (producer *Producer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	var errs sarama.ProducerErrors
+	for _, msg := range msgs {
+		if _, _, err := producer.SendMessage(msg); err != nil {
+			errs = append(errs, &sarama.ProducerError{Msg: msg, Err: err})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (producer *Producer) Close() error {
+	producer.mu.Lock()
+	defer producer.mu.Unlock()
+	producer.closed++
+	return nil
+}
+
+// Number of producers opened and closed so far
+func (producer *Producer) Opened() (opened int, closed int) {
+	producer.mu.Lock()
+	defer producer.mu.Unlock()
+	return producer.opened, producer.closed
+}
+
+// The messages produced on the topic, in order
+func (producer *Producer) Messages(topic string) []*sarama.ProducerMessage {
+	producer.mu.Lock()
+	defer producer.mu.Unlock()
+
+	var messages []*sarama.ProducerMessage
+	for _, msg := range producer.messages {
+		if msg.Topic == topic {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// The notifications produced on the topic, in order. Values that aren't a notification are left out
+func (producer *Producer) Notifications(topic string) []models.Notification {
+	var notifications []models.Notification
+	for _, msg := range producer.Messages(topic) {
+		value, err := msg.Value.Encode()
+		if err != nil {
+			continue
+		}
+		var notification models.Notification
+		if err := json.Unmarshal(value, &notification); err != nil {
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications
+}
+
+// The value of the message's header, and whether it has it
+func Header(msg *sarama.ProducerMessage, key string) (string, bool) {
+	for _, header := range msg.Headers {
+		if string(header.Key) == key {
+			return string(header.Value), true
+		}
+	}
+	return "", false
+}
@@ -20,28 +20,49 @@ package kafkawrapper
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"runtime/debug"
+	"sync"
 	"time"
 
+	"example.com/projectsolution/project/config"
 	"example.com/projectsolution/project/models"
 	"github.com/IBM/sarama"
 )
 
-const (
-	producerPort       = ":8080"
-	kafkaServerAddress = "localhost:9092"
-	consumerGroup      = "notifications-group"
-)
-
 // ============== PRODUCER RELATED FUNCTIONS ==============
 
-// Setup the samara producer
-func setupProducer() (sarama.SyncProducer, error) {
+// Toggle for the idempotent producer. On unless NS_KAFKA_IDEMPOTENT_PRODUCER=false
+var IdempotentProducer = os.Getenv("NS_KAFKA_IDEMPOTENT_PRODUCER") != "false"
+
+// The samara producer config
+// An idempotent producer lets sarama retry a produce internally without writing duplicates,
+// which only holds with acks from all in-sync replicas and a single in-flight request
+func producerConfig() *sarama.Config {
 	config := sarama.NewConfig()
 	config.Producer.Return.Successes = true
-	producer, err := sarama.NewSyncProducer([]string{kafkaServerAddress},
-		config)
+
+	if IdempotentProducer {
+		config.Producer.Idempotent = true
+		config.Producer.RequiredAcks = sarama.WaitForAll
+		config.Producer.Retry.Max = 5
+		config.Net.MaxOpenRequests = 1
+		if !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+			config.Version = sarama.V0_11_0_0
+		}
+	}
+	return config
+}
+
+// Creates the producer of every send. Replaceable, e.g. with a kafkatest.Producer in tests
+var NewProducer = setupProducer
+
+// Setup the samara producer
+func setupProducer() (sarama.SyncProducer, error) {
+	producer, err := sarama.NewSyncProducer(config.Current().KafkaBrokers, producerConfig())
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup producer: %w", err)
 	}
@@ -51,21 +72,16 @@ func setupProducer() (sarama.SyncProducer, error) {
 // Push a notification to a certain kafka topic
 func SendKafkaMessage(topic string, notification models.Notification) error {
 
-	producer, err := setupProducer()
+	msg, err := producerMessage(topic, notification)
 	if err != nil {
-		return fmt.Errorf("failed to setup producer: %w", err)
+		return err
 	}
 
-	notificationJSON, err := json.Marshal(notification)
+	producer, err := NewProducer()
 	if err != nil {
-		return fmt.Errorf("failed to marshal notification: %w", err)
-	}
-
-	msg := &sarama.ProducerMessage{
-		Topic: topic,
-		Key:   sarama.StringEncoder(notification.MessageID.String()),
-		Value: sarama.StringEncoder(notificationJSON),
+		return fmt.Errorf("failed to setup producer: %w", err)
 	}
+	defer producer.Close()
 
 	_, _, err = producer.SendMessage(msg)
 	if err != nil {
@@ -75,18 +91,101 @@ func SendKafkaMessage(topic string, notification models.Notification) error {
 	return nil
 }
 
+// Push notifications to a certain kafka topic with a single producer and one batched produce
+// Returns an error per notification, in the same order, nil for the ones that were sent
+func SendKafkaMessages(topic string, notifications []models.Notification) []error {
+	errs := make([]error, len(notifications))
+
+	msgs := make([]*sarama.ProducerMessage, 0, len(notifications))
+	for i, notification := range notifications {
+		msg, err := producerMessage(topic, notification)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		// Ties a failed message back to its notification
+		msg.Metadata = i
+		msgs = append(msgs, msg)
+	}
+	if len(msgs) == 0 {
+		return errs
+	}
+
+	producer, err := NewProducer()
+	if err != nil {
+		for _, msg := range msgs {
+			errs[msg.Metadata.(int)] = fmt.Errorf("failed to setup producer: %w", err)
+		}
+		return errs
+	}
+	defer producer.Close()
+
+	err = producer.SendMessages(msgs)
+	var producerErrs sarama.ProducerErrors
+	switch {
+	case err == nil:
+	case errors.As(err, &producerErrs):
+		for _, producerErr := range producerErrs {
+			errs[producerErr.Msg.Metadata.(int)] = fmt.Errorf("failed to sent on kafka topic: %w", producerErr.Err)
+		}
+	default:
+		for _, msg := range msgs {
+			errs[msg.Metadata.(int)] = fmt.Errorf("failed to sent on kafka topic: %w", err)
+		}
+	}
+	return errs
+}
+
+// The kafka message for a notification, refusing oversized or (with ValidateSchema) malformed ones
+func producerMessage(topic string, notification models.Notification) (*sarama.ProducerMessage, error) {
+	if err := models.CheckMessageSize(notification.Message); err != nil {
+		return nil, fmt.Errorf("refusing to produce notification: %w", err)
+	}
+
+	notificationJSON, err := json.Marshal(notification)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal notification: %w", err)
+	}
+
+	// Reject malformed messages before they reach the topic
+	if ValidateSchema {
+		if err := validateNotificationJSON(notificationJSON); err != nil {
+			return nil, err
+		}
+	}
+
+	return &sarama.ProducerMessage{
+		Topic:   topic,
+		Key:     sarama.StringEncoder(messageKey(topic, notification)),
+		Value:   sarama.StringEncoder(notificationJSON),
+		Headers: analyticsHeaders(notification),
+	}, nil
+}
+
+// Messages are keyed by the notification's ID, except on the processed topic where a client supplied
+// correlation ID takes its place so external consumers of the results can join on their own IDs
+func messageKey(topic string, notification models.Notification) string {
+	if topic == config.Current().Topics.Processed && notification.CorrelationID != "" {
+		return notification.CorrelationID
+	}
+	return notification.MessageID.String()
+}
+
 // ============== CONSUMER RELATED FUNCTIONS ==============
 
-// Creates a new samara consumer group
-func initializeConsumerGroup() (sarama.ConsumerGroup, error) {
-	config := sarama.NewConfig()
+// Creates a new samara consumer group, with the fetch tuning of the topic it will consume
+func initializeConsumerGroup(kafkaTopic string) (sarama.ConsumerGroup, error) {
+	saramaConfig := sarama.NewConfig()
+	TopicFetchConfig(kafkaTopic).apply(saramaConfig)
 
-	// CAUTION: These constants make it so the `processed` topic doesn't return and we don't get called back in time
-	config.Consumer.Offsets.AutoCommit.Enable = true
-	config.Consumer.Offsets.AutoCommit.Interval = 1 * time.Second
+	// Auto-commit only commits what ConsumeClaim() marked, and it marks a message once its callback
+	// succeeded, so a rebalance or restart can't skip a message whose callback never ran. At worst
+	// the messages since the last commit are consumed again
+	saramaConfig.Consumer.Offsets.AutoCommit.Enable = true
+	saramaConfig.Consumer.Offsets.AutoCommit.Interval = 1 * time.Second
 
 	consumerGroup, err := sarama.NewConsumerGroup(
-		[]string{kafkaServerAddress}, consumerGroup, config)
+		config.Current().KafkaBrokers, config.Current().ConsumerGroup, saramaConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize consumer group: %w", err)
 	}
@@ -94,14 +193,89 @@ func initializeConsumerGroup() (sarama.ConsumerGroup, error) {
 	return consumerGroup, nil
 }
 
+// Number of joined consumers per topic, see ConsumerReady(). A count rather than a flag so a
+// paused consumer still shutting down doesn't mark its freshly resumed replacement as not ready
+var (
+	readyConsumers   = map[string]int{}
+	readyConsumersMu sync.Mutex
+)
+
+// Whether a consumer of the topic has joined its group. False while it waits for the broker
+func ConsumerReady(kafkaTopic string) bool {
+	readyConsumersMu.Lock()
+	defer readyConsumersMu.Unlock()
+	return readyConsumers[kafkaTopic] > 0
+}
+
+func setConsumerReady(kafkaTopic string, ready bool) {
+	readyConsumersMu.Lock()
+	defer readyConsumersMu.Unlock()
+	if ready {
+		readyConsumers[kafkaTopic]++
+	} else {
+		readyConsumers[kafkaTopic]--
+	}
+}
+
+// Every ReceiveKafkaMessage() loop still running, see WaitForConsumers()
+var runningConsumers sync.WaitGroup
+
+// Wait for the consumer loops, whose contexts have been cancelled, to close their consumer groups
+// so their offsets get committed. Returns false if some are still running after `timeout`
+func WaitForConsumers(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		runningConsumers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Keep trying to create the consumer group, backing off between attempts, until it succeeds or `ctx` is done
+// The broker may be momentarily unavailable at startup, e.g. when started alongside it
+func joinConsumerGroup(ctx context.Context, kafkaTopic string) (sarama.ConsumerGroup, error) {
+	for attempt := 1; ; attempt++ {
+		consumerGroup, err := initializeConsumerGroup(kafkaTopic)
+		if err == nil {
+			return consumerGroup, nil
+		}
+
+		ConsumerErrorMetrics.Add("join_retried", 1)
+		backoff := retryBackoff(attempt)
+		log.Printf("initialization error, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
 // Samara's ConsumerGroupHandler interface implementation
 // Function callback used in the Consumer
 type Consumer struct {
 	messageCallbackFunction msgCallback
 }
 
-func (*Consumer) Setup(sarama.ConsumerGroupSession) error   { return nil }
-func (*Consumer) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+// A Consumer handing every message it consumes to the callback
+func NewConsumer(messageCallbackFunction msgCallback) *Consumer {
+	return &Consumer{messageCallbackFunction: messageCallbackFunction}
+}
+
+func (*Consumer) Setup(sarama.ConsumerGroupSession) error { return nil }
+
+// Commit the marked offsets before the partitions go to another member, rather than leave the last
+// second of them to the auto-commit, which the new owner would consume again
+func (*Consumer) Cleanup(sess sarama.ConsumerGroupSession) error {
+	sess.Commit()
+	return nil
+}
 
 // Hook/callback for the sarama.ConsumerGroup's Consume() method
 // It gets called on every message on the subscribed topic
@@ -111,46 +285,207 @@ func (consumer *Consumer) ConsumeClaim(
 
 	for msg := range claim.Messages() {
 
-		var notification models.Notification
-		err := json.Unmarshal(msg.Value, &notification)
+		// Messages can still be handed out after the session ended, leave them to the next one
+		if sess.Context().Err() != nil {
+			return nil
+		}
+
+		// Undecodable messages are skipped or dead-lettered as configured
+		// Decoding the same bytes again would fail the same way, so "retry" dead-letters right away like "dlq"
+		notification, err := decodeMessage(msg)
 		if err != nil {
-			log.Printf("failed to unmarshal notification: %v", err)
+			if !giveUpOnMessage(msg, err) {
+				// Returning ends the session, the rejoined one consumes the message again
+				return nil
+			}
+			sess.MarkMessage(msg, "")
 			continue
 		}
-		// Set the message as consumed
-		sess.MarkMessage(msg, "")
 
-		// Callback whatever function was given
-		consumer.messageCallbackFunction(&notification)
+		// Analytics context travels in the headers, not in the notification JSON
+		notification.AnalyticsContext = analyticsContextFromHeaders(msg.Headers)
+		if len(notification.AnalyticsContext) > 0 {
+			AnalyticsSink(msg.Topic, &notification)
+		}
+
+		// Callback whatever function was given, applying the error policy if it fails
+		if !deliverWithRedelivery(sess.Context(), consumer.messageCallbackFunction, msg, &notification) {
+			// The session ended mid-redelivery or the message couldn't be dead-lettered, leave it
+			// unmarked so it is consumed again
+			return nil
+		}
+
+		// Set the message as consumed, only now that its callback succeeded
+		sess.MarkMessage(msg, "")
 	}
 	return nil
 }
 
+// Run the callback, recovering from a panic so one bad message doesn't kill the consumer
+// A panic is reported as an error, so the message gets redelivered like any other failure
+func invokeCallback(messageCallbackFunction msgCallback, notification *models.Notification) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			ConsumerErrorMetrics.Add("callback_panics", 1)
+			log.Printf("recovered from panic in callback for notification %s: %v\n%s",
+				notification.MessageID, recovered, debug.Stack())
+			err = fmt.Errorf("callback panicked: %v", recovered)
+		}
+	}()
+
+	return messageCallbackFunction(notification)
+}
+
 // The function signature for the information receiver in ReceiveKafkaMessage()
-type msgCallback func(*models.Notification)
+// Returning an error has the message redelivered, skipped or dead-lettered, see deliverWithRedelivery()
+type msgCallback func(*models.Notification) error
 
 // Receive Kafka messages on a certain topic. Upon reception of a message the `messageCallbackFunction`
 // gets called with the notification struct filled from the topic
 func ReceiveKafkaMessage(ctx context.Context, kafkaTopic string, messageCallbackFunction msgCallback) {
+	runningConsumers.Add(1)
+	defer runningConsumers.Done()
 
-	// Initialize a Consumer Group
-	consumerGroup, err := initializeConsumerGroup()
+	// Initialize a Consumer Group, waiting for the broker if it isn't up yet
+	consumerGroup, err := joinConsumerGroup(ctx, kafkaTopic)
 	if err != nil {
-		log.Printf("initialization error: %v", err)
+		log.Printf("gave up joining the consumer group for topic %s: %v", kafkaTopic, err)
+		return
 	}
 	defer consumerGroup.Close()
 
-	consumer := &Consumer{
-		messageCallbackFunction: messageCallbackFunction,
-	}
+	setConsumerReady(kafkaTopic, true)
+	defer setConsumerReady(kafkaTopic, false)
 
+	consumer := NewConsumer(messageCallbackFunction)
+
+	// Back off on consecutive errors rather than hammering the broker
+	consecutiveErrors := 0
 	for {
 		err = consumerGroup.Consume(ctx, []string{kafkaTopic}, consumer)
-		if err != nil {
-			log.Printf("error from consumer: %v", err)
-		}
 		if ctx.Err() != nil {
 			return
 		}
+		if err == nil {
+			consecutiveErrors = 0
+			continue
+		}
+
+		consecutiveErrors++
+		ConsumerErrorMetrics.Add("consume_retried", 1)
+		backoff := retryBackoff(consecutiveErrors)
+		log.Printf("error from consumer, retrying in %s: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// Run ReceiveKafkaMessage() in its own goroutine. It counts for WaitForConsumers() as soon as this returns,
+// whereas `go ReceiveKafkaMessage()` only counts once the goroutine gets to run
+func StartReceivingKafkaMessages(ctx context.Context, kafkaTopic string, messageCallbackFunction msgCallback) {
+	runningConsumers.Add(1)
+	go func() {
+		defer runningConsumers.Done()
+		ReceiveKafkaMessage(ctx, kafkaTopic, messageCallbackFunction)
+	}()
+}
+
+// ============== REPLAY RELATED FUNCTIONS ==============
+
+// One-shot read of a topic, outside of the consumer group so no offsets get committed.
+// Every partition is read from the oldest message still inside `window` (or from the very
+// beginning if `window` is 0) up to the newest offset at call time, and each message is handed
+// to `messageCallbackFunction`. Returns the number of replayed notifications
+func ReplayKafkaTopic(ctx context.Context, kafkaTopic string, window time.Duration,
+	messageCallbackFunction msgCallback) (int, error) {
+
+	client, err := sarama.NewClient(config.Current().KafkaBrokers, sarama.NewConfig())
+	if err != nil {
+		return 0, fmt.Errorf("failed to setup replay client: %w", err)
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return 0, fmt.Errorf("failed to setup replay consumer: %w", err)
+	}
+	defer consumer.Close()
+
+	partitions, err := client.Partitions(kafkaTopic)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list partitions of topic %s: %w", kafkaTopic, err)
+	}
+
+	replayed := 0
+	for _, partition := range partitions {
+		count, err := replayPartition(ctx, client, consumer, kafkaTopic, partition, window, messageCallbackFunction)
+		replayed += count
+		if err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// Replay a single partition of the topic, see ReplayKafkaTopic()
+func replayPartition(ctx context.Context, client sarama.Client, consumer sarama.Consumer, kafkaTopic string,
+	partition int32, window time.Duration, messageCallbackFunction msgCallback) (int, error) {
+
+	// The high water mark is the offset of the next message, so the last message to read is one before
+	newestOffset, err := client.GetOffset(kafkaTopic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get newest offset: %w", err)
+	}
+	oldestOffset, err := client.GetOffset(kafkaTopic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get oldest offset: %w", err)
+	}
+
+	startOffset := oldestOffset
+	if window > 0 {
+		startOffset, err = client.GetOffset(kafkaTopic, partition, time.Now().Add(-window).UnixMilli())
+		if err != nil {
+			return 0, fmt.Errorf("failed to get offset for the replay window: %w", err)
+		}
+	}
+
+	// Nothing inside the window, or the partition is empty
+	if startOffset == sarama.OffsetNewest || startOffset >= newestOffset {
+		return 0, nil
+	}
+
+	partitionConsumer, err := consumer.ConsumePartition(kafkaTopic, partition, startOffset)
+	if err != nil {
+		return 0, fmt.Errorf("failed to consume partition %d: %w", partition, err)
+	}
+	defer partitionConsumer.Close()
+
+	replayed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return replayed, ctx.Err()
+		case msg, ok := <-partitionConsumer.Messages():
+			if !ok {
+				return replayed, fmt.Errorf("partition %d closed before offset %d was replayed", partition, newestOffset-1)
+			}
+			var notification models.Notification
+			err := json.Unmarshal(msg.Value, &notification)
+			if err != nil {
+				log.Printf("failed to unmarshal replayed notification: %v", err)
+			} else {
+				if err := messageCallbackFunction(&notification); err != nil {
+					log.Printf("failed to process replayed notification %s: %v", notification.MessageID, err)
+				}
+				replayed++
+			}
+
+			if msg.Offset >= newestOffset-1 {
+				return replayed, nil
+			}
+		}
 	}
 }
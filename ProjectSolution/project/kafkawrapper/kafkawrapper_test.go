@@ -0,0 +1,258 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package kafkawrapper
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/kafkawrapper/kafkatest"
+	"example.com/projectsolution/project/models"
+	"github.com/IBM/sarama"
+	"github.com/google/uuid"
+)
+
+// Points the process at a mock broker for the duration of the test
+func useMockBroker(t *testing.T) *sarama.MockBroker {
+	broker := sarama.NewMockBroker(t, 1)
+	previous := config.Current()
+	current := previous
+	current.KafkaBrokers = []string{broker.Addr()}
+	config.SetCurrent(current)
+	t.Cleanup(func() {
+		config.SetCurrent(previous)
+		broker.Close()
+	})
+	return broker
+}
+
+func notificationEncoder(t *testing.T, notification models.Notification) sarama.Encoder {
+	notificationJSON, err := json.Marshal(notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sarama.ByteEncoder(notificationJSON)
+}
+
+func TestReplayKafkaTopicReadsUpToTheNewestOffset(t *testing.T) {
+	broker := useMockBroker(t)
+
+	first := models.Notification{Mode: "email", Message: "first", MessageID: uuid.New(), IsSent: true}
+	second := models.Notification{Mode: "sms", Message: "second", MessageID: uuid.New()}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("processed", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("processed", 0, sarama.OffsetOldest, 0).
+			SetOffset("processed", 0, sarama.OffsetNewest, 3),
+		"FetchRequest": sarama.NewMockFetchResponse(t, 3).
+			SetMessage("processed", 0, 0, notificationEncoder(t, first)).
+			SetMessage("processed", 0, 1, sarama.StringEncoder("not json")).
+			SetMessage("processed", 0, 2, notificationEncoder(t, second)).
+			SetHighWaterMark("processed", 0, 3),
+	})
+
+	var received []models.Notification
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	replayed, err := ReplayKafkaTopic(ctx, "processed", 0, func(notification *models.Notification) error {
+		received = append(received, *notification)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+
+	// The undecodable message is skipped, not counted
+	if replayed != 2 || len(received) != 2 {
+		t.Fatalf("expected 2 replayed notifications, got %d (%d received)", replayed, len(received))
+	}
+	if received[0].MessageID != first.MessageID || !received[0].IsSent || received[1].MessageID != second.MessageID {
+		t.Fatalf("replayed notifications don't match the topic: %+v", received)
+	}
+}
+
+func TestReplayKafkaTopicOnEmptyPartition(t *testing.T) {
+	broker := useMockBroker(t)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("processed", 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset("processed", 0, sarama.OffsetOldest, 5).
+			SetOffset("processed", 0, sarama.OffsetNewest, 5),
+	})
+
+	replayed, err := ReplayKafkaTopic(context.Background(), "processed", 0, func(*models.Notification) error {
+		t.Fatal("callback called for an empty partition")
+		return nil
+	})
+	if err != nil || replayed != 0 {
+		t.Fatalf("expected nothing to replay, got %d, %v", replayed, err)
+	}
+}
+
+func TestOversizedMessagesAreRefusedOnBothSides(t *testing.T) {
+	oversized := validNotification()
+	oversized.Message = strings.Repeat("a", models.MaxMessageSize+1)
+
+	// Producer side
+	if _, err := producerMessage("email", oversized); err == nil {
+		t.Fatalf("expected the producer to refuse the oversized notification")
+	}
+
+	// Consumer side, for a message that got past a producer with a larger limit
+	notificationJSON, _ := json.Marshal(oversized)
+	if _, err := decodeMessage(&sarama.ConsumerMessage{Value: notificationJSON}); err == nil {
+		t.Fatalf("expected the consumer to reject the oversized notification")
+	}
+}
+
+// Records what gets produced for the duration of the test
+func useFakeProducer(t *testing.T) *kafkatest.Producer {
+	producer := kafkatest.NewProducer()
+	previous := NewProducer
+	NewProducer = producer.Open
+	t.Cleanup(func() { NewProducer = previous })
+	return producer
+}
+
+func TestSendResultSurvivesTheTopic(t *testing.T) {
+	notification := validNotification()
+	notification.IsSent = true
+	notification.Result = models.SendResult{ProviderMessageID: "abc", LatencyMillis: 42, Attempts: 3, ResponseCode: "250"}
+
+	msg, err := producerMessage("processed", notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := msg.Value.Encode()
+	consumed, err := decodeMessage(&sarama.ConsumerMessage{Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consumed.Result != notification.Result {
+		t.Fatalf("expected %+v after the round trip, got %+v", notification.Result, consumed.Result)
+	}
+}
+
+func TestIdempotentProducerConfig(t *testing.T) {
+	config := producerConfig()
+	if !config.Producer.Idempotent {
+		t.Fatalf("expected the producer to be idempotent by default")
+	}
+	if config.Producer.RequiredAcks != sarama.WaitForAll || config.Net.MaxOpenRequests != 1 ||
+		config.Producer.Retry.Max < 1 || !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		t.Fatalf("idempotent producer config doesn't hold its invariants: acks %d, in-flight %d, retries %d, version %s",
+			config.Producer.RequiredAcks, config.Net.MaxOpenRequests, config.Producer.Retry.Max, config.Version)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected sarama to accept the config: %v", err)
+	}
+
+	IdempotentProducer = false
+	t.Cleanup(func() { IdempotentProducer = true })
+	if config := producerConfig(); config.Producer.Idempotent {
+		t.Fatalf("expected NS_KAFKA_IDEMPOTENT_PRODUCER=false to turn it off")
+	}
+}
+
+// With a producer ID from the broker, a produce retried by sarama carries the same sequence number
+// and the broker drops the duplicate
+func TestIdempotentProducerGetsAProducerID(t *testing.T) {
+	broker := useMockBroker(t)
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("email", 0, broker.BrokerID()),
+		"InitProducerIDRequest": sarama.NewMockInitProducerIDResponse(t).
+			SetProducerID(1000).
+			SetProducerEpoch(0),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+	})
+
+	if err := SendKafkaMessage("email", validNotification()); err != nil {
+		t.Fatal(err)
+	}
+
+	var initialized bool
+	var produce *sarama.ProduceRequest
+	for _, exchange := range broker.History() {
+		switch request := exchange.Request.(type) {
+		case *sarama.InitProducerIDRequest:
+			initialized = true
+		case *sarama.ProduceRequest:
+			produce = request
+		}
+	}
+	if !initialized {
+		t.Fatalf("expected the producer to ask the broker for a producer ID")
+	}
+	if produce == nil {
+		t.Fatalf("expected the notification to be produced")
+	}
+	if produce.RequiredAcks != sarama.WaitForAll || produce.Version < 3 {
+		t.Fatalf("expected an idempotent produce, got acks %d on version %d", produce.RequiredAcks, produce.Version)
+	}
+}
+
+func TestProcessedMessageIsKeyedByCorrelationID(t *testing.T) {
+	producer := useFakeProducer(t)
+	topics := config.Current().Topics
+
+	correlated := validNotification()
+	correlated.CorrelationID = "order-1234"
+	uncorrelated := validNotification()
+	for _, notification := range []models.Notification{correlated, uncorrelated} {
+		if err := SendKafkaMessage(topics.Processed, notification); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only the processed topic is keyed by it
+	if err := SendKafkaMessage(topics.Email, correlated); err != nil {
+		t.Fatal(err)
+	}
+
+	key := func(msg *sarama.ProducerMessage) string {
+		key, err := msg.Key.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(key)
+	}
+	processed := producer.Messages(topics.Processed)
+	if key(processed[0]) != "order-1234" {
+		t.Fatalf("expected the result to be keyed by the correlation ID, got %q", key(processed[0]))
+	}
+	if key(processed[1]) != uncorrelated.MessageID.String() {
+		t.Fatalf("expected a result without a correlation ID to be keyed by its message ID, got %q", key(processed[1]))
+	}
+	if email := producer.Messages(topics.Email); key(email[0]) != correlated.MessageID.String() {
+		t.Fatalf("expected the mode topic to be keyed by the message ID, got %q", key(email[0]))
+	}
+
+	// And it travels with the notification for the consumers
+	if results := producer.Notifications(topics.Processed); results[0].CorrelationID != "order-1234" {
+		t.Fatalf("expected the correlation ID in the result, got %q", results[0].CorrelationID)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package kafkawrapper
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Schema every notification must satisfy before it gets produced on a topic
+//
+//go:embed notification.schema.json
+var notificationSchemaJSON string
+
+// Toggle for the producer side schema validation. Off unless NS_KAFKA_VALIDATE_SCHEMA=true
+var ValidateSchema = os.Getenv("NS_KAFKA_VALIDATE_SCHEMA") == "true"
+
+var (
+	notificationSchema     *jsonschema.Schema
+	notificationSchemaErr  error
+	notificationSchemaOnce sync.Once
+)
+
+// Compile the embedded schema once and reuse it for every message
+func loadNotificationSchema() (*jsonschema.Schema, error) {
+	notificationSchemaOnce.Do(func() {
+		notificationSchema, notificationSchemaErr = jsonschema.CompileString(
+			"notification.schema.json", notificationSchemaJSON)
+	})
+	return notificationSchema, notificationSchemaErr
+}
+
+// Validate a marshaled notification against the embedded JSON schema
+func validateNotificationJSON(notificationJSON []byte) error {
+	schema, err := loadNotificationSchema()
+	if err != nil {
+		return fmt.Errorf("failed to compile notification schema: %w", err)
+	}
+
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(notificationJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&document); err != nil {
+		return fmt.Errorf("failed to decode notification: %w", err)
+	}
+
+	if err := schema.Validate(document); err != nil {
+		return fmt.Errorf("notification does not match schema: %w", err)
+	}
+	return nil
+}
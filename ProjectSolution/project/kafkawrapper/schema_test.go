@@ -0,0 +1,96 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package kafkawrapper
+
+import (
+	"encoding/json"
+	"testing"
+
+	"example.com/projectsolution/project/models"
+	"github.com/google/uuid"
+)
+
+func validNotification() models.Notification {
+	return models.Notification{
+		Mode:      "email",
+		Message:   "Hello",
+		Recipient: "jane@example.com",
+		MessageID: uuid.New(),
+	}
+}
+
+func TestValidateNotificationJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(document map[string]interface{})
+		valid  bool
+	}{
+		{"valid", func(map[string]interface{}) {}, true},
+		{"unknown mode", func(document map[string]interface{}) { document["mode"] = "fax" }, false},
+		{"blank message", func(document map[string]interface{}) { document["message"] = "" }, false},
+		{"missing messageID", func(document map[string]interface{}) { delete(document, "MessageID") }, false},
+		{"malformed messageID", func(document map[string]interface{}) { document["MessageID"] = "not-a-uuid" }, false},
+		{"negative retries", func(document map[string]interface{}) { document["max_retry_attempts"] = -1 }, false},
+		{"subject with a line break", func(document map[string]interface{}) { document["subject"] = "a\r\nBcc: x" }, false},
+		{"unknown field", func(document map[string]interface{}) { document["priority"] = "high" }, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			notificationJSON, _ := json.Marshal(validNotification())
+			var document map[string]interface{}
+			if err := json.Unmarshal(notificationJSON, &document); err != nil {
+				t.Fatal(err)
+			}
+			test.modify(document)
+			notificationJSON, _ = json.Marshal(document)
+
+			err := validateNotificationJSON(notificationJSON)
+			if test.valid && err != nil {
+				t.Fatalf("expected the notification to be valid, got %v", err)
+			}
+			if !test.valid && err == nil {
+				t.Fatalf("expected the notification to be rejected")
+			}
+		})
+	}
+}
+
+func TestProducerMessageValidatesSchemaWhenEnabled(t *testing.T) {
+	defer func(enabled bool) { ValidateSchema = enabled }(ValidateSchema)
+
+	invalid := validNotification()
+	invalid.Mode = "fax"
+
+	ValidateSchema = false
+	if _, err := producerMessage("email", invalid); err != nil {
+		t.Fatalf("expected no validation with NS_KAFKA_VALIDATE_SCHEMA off, got %v", err)
+	}
+
+	ValidateSchema = true
+	if _, err := producerMessage("email", invalid); err == nil {
+		t.Fatalf("expected an invalid notification to be refused")
+	}
+	msg, err := producerMessage("email", validNotification())
+	if err != nil {
+		t.Fatalf("expected a valid notification to be produced, got %v", err)
+	}
+	if msg.Topic != "email" {
+		t.Fatalf("expected topic 'email', got %q", msg.Topic)
+	}
+}
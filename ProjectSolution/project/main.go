@@ -19,18 +19,35 @@ package main
 
 import (
 	"context"
+	"log"
+	"time"
 
 	"example.com/projectsolution/project/endpoints"
+	"example.com/projectsolution/project/kafkawrapper"
 	"example.com/projectsolution/project/services"
 )
 
+const consumerShutdownTimeout = 10 * time.Second
+
 func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Start the services
 	services.StartService(ctx)
+	services.StartHeartbeat(ctx)
 
-	// Start the server
+	// Start the server, returns once it has drained after SIGINT/SIGTERM
 	endpoints.SetupEndpoints()
+
+	// Stop consuming and let the consumer groups commit their offsets
+	cancel()
+	if !kafkawrapper.WaitForConsumers(consumerShutdownTimeout) {
+		log.Printf("consumers still running after %s, exiting anyway", consumerShutdownTimeout)
+	}
+
+	// Let the sends already handed to the services publish their results, none retries past the deadline
+	if !services.WaitForSends(services.RetryDeadline) {
+		log.Printf("sends still running after %s, exiting anyway", services.RetryDeadline)
+	}
 }
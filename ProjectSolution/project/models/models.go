@@ -18,19 +18,109 @@
 package models
 
 import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+const defaultMaxMessageSize = 64 * 1024
+
+// Largest accepted notification message in bytes, configured with NS_MAX_MESSAGE_SIZE
+// Enforced at the endpoint, before producing onto Kafka and again in the consumers
+var MaxMessageSize = maxMessageSizeFromEnv()
+
+func maxMessageSizeFromEnv() int {
+	value := os.Getenv("NS_MAX_MESSAGE_SIZE")
+	if value == "" {
+		return defaultMaxMessageSize
+	}
+
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 {
+		log.Printf("ignoring invalid NS_MAX_MESSAGE_SIZE %q", value)
+		return defaultMaxMessageSize
+	}
+	return size
+}
+
+// Error for a message over MaxMessageSize
+type MessageTooLargeError struct {
+	Size int
+}
+
+func (err *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message is %d bytes, over the maximum of %d bytes", err.Size, MaxMessageSize)
+}
+
+// Check the message against MaxMessageSize
+func CheckMessageSize(message string) error {
+	if len(message) > MaxMessageSize {
+		return &MessageTooLargeError{Size: len(message)}
+	}
+	return nil
+}
+
+// Provider level detail of a notification's send attempts
+type SendResult struct {
+	ProviderMessageID string `json:"provider_message_id,omitempty"`
+	LatencyMillis     int64  `json:"latency_ms"`
+	Attempts          int    `json:"attempts"`
+	ResponseCode      string `json:"response_code,omitempty"`
+}
+
+// Outcome for one recipient of a notification sent to several
+type RecipientResult struct {
+	Recipient        string `json:"recipient"`
+	IsSent           bool   `json:"is_sent"`
+	NumOfRepetitions int    `json:"num_of_repetitions"`
+	FailReason       string `json:"fail_reason,omitempty"`
+}
+
+// The recipients of a comma-separated 'recipient', ignoring blanks around and between them
+func SplitRecipients(recipient string) []string {
+	var recipients []string
+	for _, single := range strings.Split(recipient, ",") {
+		if single = strings.TrimSpace(single); single != "" {
+			recipients = append(recipients, single)
+		}
+	}
+	return recipients
+}
+
 type Notification struct {
 	Mode             string `json:"mode"`
 	Message          string `json:"message"`
+	Subject          string `json:"subject"`
+	ContentType      string `json:"content_type"`
 	MaxRetryAttempts int    `json:"max_retry_attempts"`
 	Recipient        string `json:"recipient"`
+	Locale           string `json:"locale"`
+	Provider         string `json:"provider"`
+	CorrelationID    string `json:"correlation_id"`
+	Sign             bool   `json:"sign"`
+	// Set on a scheduled notification, the time it is sent
+	SendAt           time.Time `json:"send_at"`
 	TimeStamp        time.Time
 	MessageID        uuid.UUID
+	ParentID         uuid.UUID
 	NumOfRepetitions int
 	IsSent           bool
 	FailReason       string
+	Result           SendResult
+	// Per recipient outcome when the notification went to several recipients
+	RecipientResults []RecipientResult `json:"recipient_results,omitempty"`
+	// Analytics only (campaign ID, source system, ...). Carried in Kafka headers, never affects delivery
+	AnalyticsContext map[string]string `json:"-"`
+}
+
+// A user's recipient per channel (mode), e.g. {"email": "jane@example.com", "slack": "#jane"}
+// and the channels they opted out of
+type UserProfile struct {
+	Channels map[string]string `json:"channels"`
+	OptOut   []string          `json:"opt_out"`
 }
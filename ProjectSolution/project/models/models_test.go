@@ -0,0 +1,59 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package models
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCheckMessageSize(t *testing.T) {
+	if err := CheckMessageSize(strings.Repeat("a", MaxMessageSize)); err != nil {
+		t.Fatalf("expected a message of exactly MaxMessageSize to pass, got %v", err)
+	}
+
+	err := CheckMessageSize(strings.Repeat("a", MaxMessageSize+1))
+	var tooLarge *MessageTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Size != MaxMessageSize+1 {
+		t.Fatalf("expected a MessageTooLargeError for the oversized message, got %v", err)
+	}
+}
+
+func TestMaxMessageSizeFromEnv(t *testing.T) {
+	t.Setenv("NS_MAX_MESSAGE_SIZE", "1024")
+	if size := maxMessageSizeFromEnv(); size != 1024 {
+		t.Fatalf("expected 1024, got %d", size)
+	}
+	for _, invalid := range []string{"big", "0", "-5"} {
+		t.Setenv("NS_MAX_MESSAGE_SIZE", invalid)
+		if size := maxMessageSizeFromEnv(); size != defaultMaxMessageSize {
+			t.Fatalf("%q: expected the default, got %d", invalid, size)
+		}
+	}
+}
+
+func TestSplitRecipients(t *testing.T) {
+	recipients := SplitRecipients(" a@example.com,, b@example.com ,")
+	if len(recipients) != 2 || recipients[0] != "a@example.com" || recipients[1] != "b@example.com" {
+		t.Fatalf("expected the two addresses, got %q", recipients)
+	}
+	if recipients := SplitRecipients(" , "); len(recipients) != 0 {
+		t.Fatalf("expected no recipients in a list of separators, got %q", recipients)
+	}
+}
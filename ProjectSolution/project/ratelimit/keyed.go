@@ -0,0 +1,93 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Smallest number of buckets before a KeyedLimiter bothers pruning
+const minPruneSize = 1024
+
+// A TokenBucket per key, e.g. per recipient, created on first use
+// Full buckets are pruned as the map grows, they are the same as the new bucket a key would get,
+// so the map only holds the keys limited in the last burst/rate seconds
+type KeyedLimiter struct {
+	rate      float64
+	burst     int
+	now       Clock
+	buckets   map[string]*TokenBucket
+	pruneSize int
+	mu        sync.Mutex
+}
+
+// Create a limiter giving every key its own bucket of `rate` tokens per second up to `burst`
+// A nil clock means time.Now
+func NewKeyedLimiter(rate float64, burst int, now Clock) *KeyedLimiter {
+	return &KeyedLimiter{
+		rate:      rate,
+		burst:     burst,
+		now:       now,
+		buckets:   make(map[string]*TokenBucket),
+		pruneSize: minPruneSize,
+	}
+}
+
+// Take a token from the key's bucket if there is one. Otherwise returns false and how long until the next token
+func (kl *KeyedLimiter) Allow(key string) (bool, time.Duration) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	bucket, exists := kl.buckets[key]
+	if !exists {
+		if len(kl.buckets) >= kl.pruneSize {
+			kl.prune()
+		}
+		bucket = NewTokenBucket(kl.rate, kl.burst, kl.now)
+		kl.buckets[key] = bucket
+	}
+	return bucket.Allow()
+}
+
+// Give back a token taken from the key's bucket by Allow. A pruned bucket is already full
+func (kl *KeyedLimiter) Refund(key string) {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+
+	if bucket, exists := kl.buckets[key]; exists {
+		bucket.Refund()
+	}
+}
+
+// Number of buckets currently held
+func (kl *KeyedLimiter) Len() int {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	return len(kl.buckets)
+}
+
+// Drop the full buckets, and only prune again once the map has doubled. Callers hold the lock
+func (kl *KeyedLimiter) prune() {
+	for key, bucket := range kl.buckets {
+		if bucket.Full() {
+			delete(kl.buckets, key)
+		}
+	}
+	kl.pruneSize = max(minPruneSize, 2*len(kl.buckets))
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package ratelimit
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestKeyedLimiterLimitsEachKeyOnItsOwn(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewKeyedLimiter(1.0/60, 2, clock.Now)
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := limiter.Allow("+15550100"); !allowed {
+			t.Fatalf("expected send %d to be allowed", i+1)
+		}
+	}
+	allowed, wait := limiter.Allow("+15550100")
+	if allowed || wait != time.Minute {
+		t.Fatalf("expected the recipient to wait a minute, got %v after %s", allowed, wait)
+	}
+
+	// Another recipient has its own bucket
+	if allowed, _ := limiter.Allow("+15550101"); !allowed {
+		t.Fatalf("expected another recipient to be allowed")
+	}
+
+	clock.Advance(time.Minute)
+	if allowed, _ := limiter.Allow("+15550100"); !allowed {
+		t.Fatalf("expected the recipient to be allowed again after a minute")
+	}
+}
+
+func TestKeyedLimiterRefundsTheKeysBucket(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewKeyedLimiter(1.0/60, 1, clock.Now)
+
+	limiter.Allow("+15550100")
+	limiter.Allow("+15550101")
+	limiter.Refund("+15550100")
+	if allowed, _ := limiter.Allow("+15550100"); !allowed {
+		t.Fatalf("expected the refunded recipient to be allowed")
+	}
+	if allowed, _ := limiter.Allow("+15550101"); allowed {
+		t.Fatalf("expected the other recipient to stay limited")
+	}
+}
+
+func TestKeyedLimiterPrunesOneOffKeys(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewKeyedLimiter(1, 1, clock.Now)
+
+	// Lots of one-off recipients, each refilled by the time the next batch comes
+	for round := 0; round < 10; round++ {
+		for i := 0; i < minPruneSize; i++ {
+			limiter.Allow(strconv.Itoa(round) + "-" + strconv.Itoa(i))
+		}
+		clock.Advance(time.Second)
+	}
+	if size := limiter.Len(); size > 2*minPruneSize {
+		t.Fatalf("expected the full buckets to be pruned, the limiter holds %d", size)
+	}
+
+	// A key that is still limited is not pruned
+	limiter.Allow("busy")
+	for i := 0; i < 2*minPruneSize; i++ {
+		limiter.Allow("one-off-" + strconv.Itoa(i))
+	}
+	if allowed, _ := limiter.Allow("busy"); allowed {
+		t.Fatalf("expected the limited key to keep its bucket through a prune")
+	}
+}
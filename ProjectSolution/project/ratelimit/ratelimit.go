@@ -0,0 +1,99 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Source of the current time, replaceable to drive a limiter with a fake clock
+type Clock func() time.Time
+
+// Token bucket refilling `rate` tokens per second up to `burst`. Every allowed event takes one token
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    Clock
+	mu     sync.Mutex
+}
+
+// Create a full bucket. A nil clock means time.Now
+func NewTokenBucket(rate float64, burst int, now Clock) *TokenBucket {
+	if now == nil {
+		now = time.Now
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now(),
+		now:    now,
+	}
+}
+
+// Take a token if there is one. Otherwise returns false and how long until the next token
+func (tb *TokenBucket) Allow() (bool, time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill()
+	if tb.tokens >= 1 {
+		tb.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - tb.tokens) / tb.rate * float64(time.Second))
+	return false, wait
+}
+
+// Give back a token taken by Allow, for an event that didn't happen after all. Never fills past the burst
+func (tb *TokenBucket) Refund() {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill()
+	tb.tokens = math.Min(tb.burst, tb.tokens+1)
+}
+
+// Whether the bucket has refilled to its burst, i.e. it is no different from a new one
+func (tb *TokenBucket) Full() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.refill()
+	return tb.tokens >= tb.burst
+}
+
+// Add the tokens accumulated since the last refill. Callers hold the lock
+func (tb *TokenBucket) refill() {
+	now := tb.now()
+	elapsed := now.Sub(tb.last).Seconds()
+	tb.last = now
+	if elapsed > 0 {
+		tb.tokens = math.Min(tb.burst, tb.tokens+elapsed*tb.rate)
+	}
+}
+
+// Seconds to put in a Retry-After header, rounded up so the client doesn't come back too early
+func RetryAfterSeconds(wait time.Duration) int {
+	return max(1, int(math.Ceil(wait.Seconds())))
+}
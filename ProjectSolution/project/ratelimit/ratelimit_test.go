@@ -0,0 +1,104 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// Clock that only moves when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func (clock *fakeClock) Now() time.Time                { return clock.now }
+func (clock *fakeClock) Advance(elapsed time.Duration) { clock.now = clock.now.Add(elapsed) }
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func TestTokenBucketAllowsTheBurstThenRefills(t *testing.T) {
+	clock := newFakeClock()
+	bucket := NewTokenBucket(2, 3, clock.Now)
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := bucket.Allow(); !allowed {
+			t.Fatalf("expected event %d of the burst to be allowed", i+1)
+		}
+	}
+	allowed, wait := bucket.Allow()
+	if allowed || wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms for the next token, got %v after %s", allowed, wait)
+	}
+
+	clock.Advance(250 * time.Millisecond)
+	if allowed, wait := bucket.Allow(); allowed || wait != 250*time.Millisecond {
+		t.Fatalf("expected to wait the remaining 250ms, got %v after %s", allowed, wait)
+	}
+	clock.Advance(250 * time.Millisecond)
+	if allowed, _ := bucket.Allow(); !allowed {
+		t.Fatalf("expected a token after 500ms")
+	}
+
+	// Never refills past the burst
+	clock.Advance(time.Hour)
+	if !bucket.Full() {
+		t.Fatalf("expected the bucket to be full after an hour")
+	}
+	for i := 0; i < 3; i++ {
+		bucket.Allow()
+	}
+	if allowed, _ := bucket.Allow(); allowed {
+		t.Fatalf("expected the bucket to hold no more than its burst")
+	}
+}
+
+func TestRefundedTokenCanBeTakenAgain(t *testing.T) {
+	clock := newFakeClock()
+	bucket := NewTokenBucket(1, 1, clock.Now)
+
+	bucket.Allow()
+	bucket.Refund()
+	if allowed, _ := bucket.Allow(); !allowed {
+		t.Fatalf("expected the refunded token to be allowed")
+	}
+
+	// Never refunds past the burst
+	bucket.Refund()
+	bucket.Refund()
+	bucket.Allow()
+	if allowed, _ := bucket.Allow(); allowed {
+		t.Fatalf("expected the bucket to hold no more than its burst")
+	}
+}
+
+func TestRetryAfterSecondsRoundsUp(t *testing.T) {
+	for wait, expected := range map[time.Duration]int{
+		0:                        1,
+		time.Millisecond:         1,
+		time.Second:              1,
+		1001 * time.Millisecond:  2,
+		59500 * time.Millisecond: 60,
+	} {
+		if seconds := RetryAfterSeconds(wait); seconds != expected {
+			t.Errorf("expected %s to be %d seconds, got %d", wait, expected, seconds)
+		}
+	}
+}
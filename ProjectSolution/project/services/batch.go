@@ -0,0 +1,124 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/models"
+)
+
+// Separates the batched notifications in the combined Slack message
+const slackBatchSeparator = "\n\n"
+
+// Accumulates notifications for the same destination and provider within a short window, so they
+// can go out in a single provider call. Keeps throughput up and us under rate limits
+type notificationBatcher struct {
+	window  time.Duration
+	send    func(batch []*models.Notification)
+	pending map[string][]*models.Notification
+	mu      sync.Mutex
+}
+
+// Slack batching, enabled by setting NS_SLACK_BATCH_WINDOW (e.g. "500ms")
+var slackBatcher = newNotificationBatcher(config.DurationFromEnv("NS_SLACK_BATCH_WINDOW", 0), sendSlackBatch)
+
+func newNotificationBatcher(window time.Duration, send func(batch []*models.Notification)) *notificationBatcher {
+	return &notificationBatcher{
+		window:  window,
+		send:    send,
+		pending: make(map[string][]*models.Notification),
+	}
+}
+
+// Queue the notification. The first one for a destination opens the window, which flushes when it closes
+// Queued notifications count as in-flight sends until their batch was sent
+func (batcher *notificationBatcher) add(notification *models.Notification) {
+	batcher.mu.Lock()
+	defer batcher.mu.Unlock()
+
+	// Only notifications for the same provider can share its call
+	key := notification.Provider + " " + notification.Recipient
+	inFlightSends.Add(1)
+	if len(batcher.pending[key]) == 0 {
+		time.AfterFunc(batcher.window, func() { batcher.flush(key) })
+	}
+	batcher.pending[key] = append(batcher.pending[key], notification)
+}
+
+// Hand everything queued for the destination to the sender
+func (batcher *notificationBatcher) flush(key string) {
+	batcher.mu.Lock()
+	batch := batcher.pending[key]
+	delete(batcher.pending, key)
+	batcher.mu.Unlock()
+
+	if len(batch) > 0 {
+		batcher.send(batch)
+		inFlightSends.Add(-len(batch))
+	}
+}
+
+// Post every batched notification for the channel as one Slack message, through the provider they asked for
+// The one exception to runService() sending and publishing: the combined message gets a single attempt
+// and its result is published for each notification. A lone notification, or a batch that can't be sent
+// together, goes through runService() one by one with its retries
+func sendSlackBatch(batch []*models.Notification) {
+	if len(batch) == 1 {
+		runService(batch[0])
+		return
+	}
+
+	messages := make([]string, 0, len(batch))
+	for _, notification := range batch {
+		messages = append(messages, messageWithSignatureFooter(notification))
+	}
+	combined := *batch[0]
+	combined.Message = strings.Join(messages, slackBatchSeparator)
+	combined.Sign = false
+	combined.Result = models.SendResult{}
+
+	sender, err := providerSender(&combined)
+	if err == nil {
+		// The whole batch is a single send to the channel
+		err = waitForRecipientInterval(&combined)
+	}
+	if err == nil {
+		if sendOnce(&combined, sender); !combined.IsSent {
+			err = errors.New(combined.FailReason)
+		}
+	}
+	if err != nil {
+		log.Printf("failed to send batch of %d slack messages, sending them one by one: %v", len(batch), err)
+		for _, notification := range batch {
+			startSend(notification)
+		}
+		return
+	}
+
+	for _, notification := range batch {
+		notification.Result = combined.Result
+		notification.IsSent = true
+		publishResult(notification)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/models"
+)
+
+func newSlackNotification(channel string, message string) *models.Notification {
+	notification := newTestNotification("slack", 1)
+	notification.Provider = "fake"
+	notification.Recipient = channel
+	notification.Message = message
+	return notification
+}
+
+func TestBatchedSlackMessagesShareOneProviderCall(t *testing.T) {
+	producer := useFakeProducer(t)
+	sender := &fakeSender{}
+	useProvider(t, "slack", "fake", sender)
+
+	batcher := newNotificationBatcher(20*time.Millisecond, sendSlackBatch)
+	batcher.add(newSlackNotification("#ops", "one"))
+	batcher.add(newSlackNotification("#ops", "two"))
+	batcher.add(newSlackNotification("#ops", "three"))
+	batcher.add(newSlackNotification("#dev", "four"))
+
+	results := waitForResults(t, producer, 4)
+	if sender.callCount() != 2 {
+		t.Fatalf("expected a provider call per channel, got %d", sender.callCount())
+	}
+	for _, result := range results {
+		if !result.IsSent {
+			t.Fatalf("expected every batched notification to be sent, got %q", result.FailReason)
+		}
+	}
+}
+
+func TestBatchIsSentAsOneMessage(t *testing.T) {
+	useFakeProducer(t)
+	var sent []string
+	useProvider(t, "slack", "fake", SenderFunc(func(notification *models.Notification) error {
+		sent = append(sent, notification.Message)
+		return nil
+	}))
+
+	sendSlackBatch([]*models.Notification{newSlackNotification("#ops", "one"), newSlackNotification("#ops", "two")})
+
+	if len(sent) != 1 || sent[0] != strings.Join([]string{"one", "two"}, slackBatchSeparator) {
+		t.Fatalf("expected a single combined message, got %q", sent)
+	}
+}
+
+func TestFailedBatchFallsBackToSingleSends(t *testing.T) {
+	fastRetries(t)
+	producer := useFakeProducer(t)
+	sender := &fakeSender{failures: 1}
+	useProvider(t, "slack", "fake", sender)
+
+	sendSlackBatch([]*models.Notification{
+		newSlackNotification("#ops", "one"),
+		newSlackNotification("#ops", "two"),
+		newSlackNotification("#ops", "three"),
+	})
+
+	results := waitForResults(t, producer, 3)
+	// The failed batch, then each one on its own
+	if sender.callCount() != 4 {
+		t.Fatalf("expected the batch and 3 single sends, got %d calls", sender.callCount())
+	}
+	for _, result := range results {
+		if !result.IsSent {
+			t.Fatalf("expected the single sends to succeed, got %q", result.FailReason)
+		}
+	}
+}
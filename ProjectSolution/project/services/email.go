@@ -18,12 +18,19 @@
 package services
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"math/rand/v2"
+	"mime"
+	"net"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"os"
+	"strconv"
+	"time"
 
-	"example.com/projectsolution/project/kafkawrapper"
 	"example.com/projectsolution/project/models"
 )
 
@@ -33,52 +40,14 @@ const (
 )
 
 // Hook called to spawn an email thread
-func EmailNotificationRequest(notification *models.Notification) {
-	go emailService(notification)
+// A comma-separated list of recipients gets one email each
+func EmailNotificationRequest(notification *models.Notification) error {
+	startSend(notification)
+	return nil
 }
 
-// Send an email and attempt retries according to user spec/max retries set in the server
-func emailService(notification *models.Notification) {
-
-	// Send emails until the maxEmailRetries or notification.NumOfRepetitions, whichever occurs first
-	for emailSendCount := 0; emailSendCount <= maxEmailRetries; emailSendCount++ {
-
-		// Send email and update the 'notification' object
-		notification = sendEmail(notification)
-
-		if notification.IsSent {
-			// Send success
-			err := kafkawrapper.SendKafkaMessage(kafkaTopicProcessed, *notification)
-			if err != nil {
-				return
-			}
-			return
-		}
-
-		// If we are above the number of retries set by the user
-		if !notification.IsSent && notification.NumOfRepetitions >= notification.MaxRetryAttempts {
-			notification.IsSent = false
-
-			notification.FailReason =
-				"Too many failed attempts. Last attempt failed with: " + notification.FailReason
-			kafkawrapper.SendKafkaMessage(kafkaTopicProcessed, *notification)
-			return
-		}
-
-		// If we are at the max number of retries constant set by our program (last loop iteration)
-		if !notification.IsSent && notification.NumOfRepetitions == maxEmailRetries {
-			notification.IsSent = false
-
-			notification.FailReason =
-				"Too many failed attempts. Max number of retries reached. Last attempt failed with: " + notification.FailReason
-			kafkawrapper.SendKafkaMessage(kafkaTopicProcessed, *notification)
-			return
-		}
-	}
-}
-
-// Send the email message and return the updated 'notification' object with pass/fail
-func sendEmail(notification *models.Notification) *models.Notification {
+// Send the email message
+func sendEmail(notification *models.Notification) error {
 
 	// Choose auth method and set it up
 	var tempGmailToken string = os.Getenv("NS_EMAIL_TOKEN")
@@ -89,30 +58,32 @@ func sendEmail(notification *models.Notification) *models.Notification {
 	gmailSmtp := "smtp.gmail.com"
 	auth := smtp.PlainAuth(gmailUsername, emailUsername, tempGmailToken, gmailSmtp)
 
-	// Here we do it all: connect to our server, set up a message and send it
-	emailRecipient := notification.Recipient
-	to := []string{emailRecipient}
+	// The envelope-from (MAIL FROM) gets the bounces, the header 'From:' is what the recipient sees
+	// and what DMARC aligns against. They default to the account's address
+	envelopeFrom, headerFrom, err := emailFromAddresses(fullEmail)
+	if err != nil {
+		return fmt.Errorf("failed to send email with following error %s", err)
+	}
 
-	// Form email message
-	emailSubject := "Subject: Email Notification System\r\n"
-	emailBody := notification.Message
-	// Hardcoded for non-spam / Otherwise we get 'undisclosed recipients'
-	emailRecipientDisclosed := "To: " + emailRecipient + "\r\n"
-	msg := []byte(emailRecipientDisclosed + emailSubject + "\r\n" + emailBody)
+	// Here we do it all: connect to our server, set up a message and send it
+	to := []string{notification.Recipient}
+	msg := emailMessage(notification, headerFrom)
 
 	// Fire email
 	smtpPort := "587"
-	err := smtp.SendMail(gmailSmtp+":"+smtpPort, auth, fullEmail, to, msg)
+	timeout := providerTimeout(notification.Mode)
+	start := time.Now()
+	err = sendMail(gmailSmtp, smtpPort, auth, envelopeFrom, to, msg, timeout)
+	recordSendResult(notification, "", smtpResponseCode(err), time.Since(start))
 	if err != nil {
-		notification.IsSent = false
-		notification.NumOfRepetitions = notification.NumOfRepetitions + 1
-		notification.FailReason = fmt.Sprintf("failed to send email with following error %s", err)
-		return notification
+		if isTimeout(err) {
+			return timeoutError("email", time.Since(start), timeout, err)
+		}
+		return fmt.Errorf("failed to send email with following error %s", err)
 	}
 
 	// Success
-	notification.IsSent = true
-	return notification
+	return nil
 
 	// // ==== Test code ====
 	// notification.IsSent = true
@@ -128,6 +99,114 @@ func sendEmail(notification *models.Notification) *models.Notification {
 	// return notification
 }
 
+// Form the email message, headers and body, as it goes over SMTP
+func emailMessage(notification *models.Notification, headerFrom string) []byte {
+	emailFrom := "From: " + headerFrom + "\r\n"
+	// Non-ASCII subjects are encoded, ASCII ones go as they are
+	emailSubject := "Subject: " + mime.QEncoding.Encode("utf-8", notificationSubject(notification)) + "\r\n"
+	// Without a content type the body goes without MIME headers, as it always has
+	emailContentType := ""
+	if notification.ContentType != "" {
+		emailContentType = "MIME-Version: 1.0\r\nContent-Type: " + notification.ContentType + "; charset=UTF-8\r\n"
+	}
+	emailBody := notification.Message
+	// Hardcoded for non-spam / Otherwise we get 'undisclosed recipients'
+	emailRecipientDisclosed := "To: " + notification.Recipient + "\r\n"
+	// Signed notifications carry the signature of the body in a header
+	emailSignature := ""
+	if signature := messageSignature(notification); signature != "" {
+		emailSignature = "X-Notification-Signature: " + signature + "\r\n"
+	}
+	return []byte(emailFrom + emailRecipientDisclosed + emailSubject + emailContentType + emailSignature + "\r\n" + emailBody)
+}
+
+// Same as smtp.SendMail(), but the whole SMTP conversation has to finish within `timeout`
+func sendMail(host string, port string, auth smtp.Auth, from string, to []string, msg []byte,
+	timeout time.Duration) error {
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if err := client.Auth(auth); err != nil {
+		return err
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(msg); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// The envelope-from from NS_EMAIL_ENVELOPE_FROM and the header 'From:' from NS_EMAIL_HEADER_FROM
+// (which may carry a display name, e.g. "Alerts <alerts@example.com>"). Unset, they fall back to the
+// account's address and the envelope-from respectively
+func emailFromAddresses(accountAddress string) (envelopeFrom string, headerFrom string, err error) {
+	envelopeFrom = os.Getenv("NS_EMAIL_ENVELOPE_FROM")
+	if envelopeFrom == "" {
+		envelopeFrom = accountAddress
+	}
+	envelopeAddress, err := mail.ParseAddress(envelopeFrom)
+	if err != nil || envelopeAddress.Name != "" {
+		return "", "", fmt.Errorf("invalid envelope-from address %q", envelopeFrom)
+	}
+
+	headerFrom = os.Getenv("NS_EMAIL_HEADER_FROM")
+	if headerFrom == "" {
+		headerFrom = envelopeFrom
+	}
+	headerAddress, err := mail.ParseAddress(headerFrom)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid header from address %q", headerFrom)
+	}
+
+	return envelopeAddress.Address, headerAddress.String(), nil
+}
+
+// The SMTP reply code of the send, "250" on success or "" if the server never replied
+func smtpResponseCode(err error) string {
+	if err == nil {
+		return "250"
+	}
+	var protocolErr *textproto.Error
+	if errors.As(err, &protocolErr) {
+		return strconv.Itoa(protocolErr.Code)
+	}
+	return ""
+}
+
 // DEBUG: function to generate random numbers
 func randRange(min, max int) int {
 	return rand.IntN(max-min) + min
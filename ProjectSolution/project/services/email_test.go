@@ -0,0 +1,217 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/models"
+)
+
+func TestEnvelopeAndHeaderFromCanDiffer(t *testing.T) {
+	tests := []struct {
+		envelope, header                 string
+		expectedEnvelope, expectedHeader string
+	}{
+		{"", "", "account@example.com", "<account@example.com>"},
+		{"bounces@example.com", "", "bounces@example.com", "<bounces@example.com>"},
+		{"bounces@example.com", "Alerts <alerts@example.com>", "bounces@example.com", `"Alerts" <alerts@example.com>`},
+		{"", "alerts@example.com", "account@example.com", "<alerts@example.com>"},
+	}
+	for _, test := range tests {
+		t.Setenv("NS_EMAIL_ENVELOPE_FROM", test.envelope)
+		t.Setenv("NS_EMAIL_HEADER_FROM", test.header)
+		envelopeFrom, headerFrom, err := emailFromAddresses("account@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if envelopeFrom != test.expectedEnvelope || headerFrom != test.expectedHeader {
+			t.Fatalf("%q/%q: expected %q/%q, got %q/%q", test.envelope, test.header,
+				test.expectedEnvelope, test.expectedHeader, envelopeFrom, headerFrom)
+		}
+	}
+}
+
+func TestInvalidFromAddresses(t *testing.T) {
+	// The envelope carries a bare address, no display name
+	t.Setenv("NS_EMAIL_ENVELOPE_FROM", "Bounces <bounces@example.com>")
+	if _, _, err := emailFromAddresses("account@example.com"); err == nil {
+		t.Fatalf("expected an envelope-from with a display name to be rejected")
+	}
+	t.Setenv("NS_EMAIL_ENVELOPE_FROM", "")
+	t.Setenv("NS_EMAIL_HEADER_FROM", "not an address")
+	if _, _, err := emailFromAddresses("account@example.com"); err == nil {
+		t.Fatalf("expected an invalid header from to be rejected")
+	}
+}
+
+// An SMTP server taking one email, returning its MAIL FROM and data
+func fakeSMTPServer(t *testing.T) (string, <-chan [2]string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan [2]string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+
+		var mailFrom, data string
+		text.PrintfLine("220 localhost ready")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch {
+			case command == "EHLO":
+				text.PrintfLine("250-localhost")
+				text.PrintfLine("250 AUTH PLAIN")
+			case command == "AUTH":
+				text.PrintfLine("235 authenticated")
+			case command == "MAIL":
+				mailFrom = strings.TrimSuffix(strings.TrimPrefix(line, "MAIL FROM:<"), ">")
+				text.PrintfLine("250 ok")
+			case command == "RCPT":
+				text.PrintfLine("250 ok")
+			case command == "DATA":
+				text.PrintfLine("354 go ahead")
+				lines, err := text.ReadDotLines()
+				if err != nil {
+					return
+				}
+				data = strings.Join(lines, "\n")
+				text.PrintfLine("250 queued")
+			case command == "QUIT":
+				text.PrintfLine("221 bye")
+				received <- [2]string{mailFrom, data}
+				return
+			default:
+				text.PrintfLine("502 unknown")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSendMailUsesTheEnvelopeFrom(t *testing.T) {
+	address, received := fakeSMTPServer(t)
+	host, port, _ := net.SplitHostPort(address)
+
+	msg := "From: \"Alerts\" <alerts@example.com>\r\nTo: someone@example.com\r\nSubject: Hi\r\n\r\nHello"
+	auth := smtp.PlainAuth("", "account", "token", host)
+	if err := sendMail(host, port, auth, "bounces@example.com", []string{"someone@example.com"}, []byte(msg), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case email := <-received:
+		if email[0] != "bounces@example.com" {
+			t.Fatalf("expected MAIL FROM the envelope-from, got %q", email[0])
+		}
+		header, _ := textproto.NewReader(bufio.NewReader(strings.NewReader(email[1] + "\n\n"))).ReadMIMEHeader()
+		if from := header.Get("From"); from != `"Alerts" <alerts@example.com>` {
+			t.Fatalf("expected the header From to stay as it is, got %q", from)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the server to receive the email")
+	}
+}
+
+// Parse the email as it would go over SMTP
+func parseEmailMessage(t *testing.T, notification *models.Notification) *mail.Message {
+	t.Helper()
+	message, err := mail.ReadMessage(bytes.NewReader(emailMessage(notification, "<alerts@example.com>")))
+	if err != nil {
+		t.Fatalf("failed to parse the email: %v", err)
+	}
+	return message
+}
+
+func TestEmailWithoutSubjectOrContentTypeIsUnchanged(t *testing.T) {
+	t.Setenv("NS_EMAIL_SUBJECT_TEMPLATE", "")
+	notification := newTestNotification("email", 1)
+	notification.Recipient = "ops@example.com"
+
+	message := parseEmailMessage(t, notification)
+	if subject := message.Header.Get("Subject"); subject != defaultSubject {
+		t.Fatalf("expected the default subject, got %q", subject)
+	}
+	if message.Header.Get("Content-Type") != "" || message.Header.Get("MIME-Version") != "" {
+		t.Fatalf("expected no MIME headers without a content type, got %v", message.Header)
+	}
+	if to := message.Header.Get("To"); to != "ops@example.com" {
+		t.Fatalf("expected the recipient in 'To:', got %q", to)
+	}
+	body, _ := io.ReadAll(message.Body)
+	if string(body) != "Hello" {
+		t.Fatalf("expected the message as the body, got %q", body)
+	}
+}
+
+func TestEmailCarriesSubjectAndContentType(t *testing.T) {
+	notification := newTestNotification("email", 1)
+	notification.Recipient = "ops@example.com"
+	notification.Subject = "Your invoice"
+	notification.ContentType = "text/html"
+	notification.Message = "<p>Hello</p>"
+
+	message := parseEmailMessage(t, notification)
+	if subject := message.Header.Get("Subject"); subject != "Your invoice" {
+		t.Fatalf("expected the request's subject, got %q", subject)
+	}
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/html" || params["charset"] != "UTF-8" {
+		t.Fatalf("expected an html body in UTF-8, got %q", message.Header.Get("Content-Type"))
+	}
+	if version := message.Header.Get("MIME-Version"); version != "1.0" {
+		t.Fatalf("expected MIME-Version 1.0, got %q", version)
+	}
+}
+
+func TestNonASCIISubjectIsEncoded(t *testing.T) {
+	notification := newTestNotification("email", 1)
+	notification.Subject = "Facture réglée"
+
+	message := parseEmailMessage(t, notification)
+	raw := message.Header.Get("Subject")
+	if !strings.HasPrefix(raw, "=?utf-8?q?") {
+		t.Fatalf("expected a Q-encoded subject, got %q", raw)
+	}
+	decoded, err := new(mime.WordDecoder).DecodeHeader(raw)
+	if err != nil || decoded != "Facture réglée" {
+		t.Fatalf("expected the subject to decode back, got %q, %v", decoded, err)
+	}
+}
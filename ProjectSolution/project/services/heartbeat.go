@@ -0,0 +1,80 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+
+	"example.com/projectsolution/project/kafkawrapper"
+	"example.com/projectsolution/project/models"
+)
+
+const heartbeatMessage = "Notification system heartbeat"
+
+// Dead-man's-switch. When NS_HEARTBEAT_INTERVAL (e.g. "5m") is set, a heartbeat notification goes through the
+// whole pipeline to NS_HEARTBEAT_MODE/NS_HEARTBEAT_RECIPIENT at that cadence. Its absence means we are down
+func StartHeartbeat(ctx context.Context) {
+	value := os.Getenv("NS_HEARTBEAT_INTERVAL")
+	if value == "" {
+		return
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		log.Printf("heartbeat disabled, invalid NS_HEARTBEAT_INTERVAL %q: %v", value, err)
+		return
+	}
+
+	mode := os.Getenv("NS_HEARTBEAT_MODE")
+	consumer, exists := modeConsumers[mode]
+	if !exists {
+		log.Printf("heartbeat disabled, NS_HEARTBEAT_MODE %q is not a supported mode", mode)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		runHeartbeat(ctx, ticker.C, consumer.topic, mode, os.Getenv("NS_HEARTBEAT_RECIPIENT"))
+	}()
+}
+
+// Send a heartbeat on every tick until the context is cancelled
+func runHeartbeat(ctx context.Context, ticks <-chan time.Time, topic string, mode string, recipient string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tick := <-ticks:
+			heartbeat := models.Notification{
+				Mode:      mode,
+				Message:   heartbeatMessage + " at " + tick.UTC().Format(time.RFC3339),
+				Recipient: recipient,
+				TimeStamp: tick,
+				MessageID: uuid.New(),
+			}
+			if err := kafkawrapper.SendKafkaMessage(topic, heartbeat); err != nil {
+				log.Printf("failed to send heartbeat: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatOnEveryTick(t *testing.T) {
+	producer := useFakeProducer(t)
+
+	ticks := make(chan time.Time)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runHeartbeat(ctx, ticks, "slack", "slack", "#ops")
+		close(done)
+	}()
+
+	// Fake clock, five minutes apart
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		ticks <- start.Add(time.Duration(i) * 5 * time.Minute)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the heartbeat to stop with its context")
+	}
+
+	heartbeats := producer.Notifications("slack")
+	if len(heartbeats) != 3 {
+		t.Fatalf("expected a heartbeat per tick, got %d", len(heartbeats))
+	}
+	for i, heartbeat := range heartbeats {
+		expected := start.Add(time.Duration(i) * 5 * time.Minute)
+		if !heartbeat.TimeStamp.Equal(expected) {
+			t.Fatalf("heartbeat %d: expected the tick time %s, got %s", i, expected, heartbeat.TimeStamp)
+		}
+		if heartbeat.Mode != "slack" || heartbeat.Recipient != "#ops" {
+			t.Fatalf("heartbeat %d: expected slack to #ops, got %s to %q", i, heartbeat.Mode, heartbeat.Recipient)
+		}
+	}
+	if heartbeats[0].MessageID == heartbeats[1].MessageID {
+		t.Fatalf("expected every heartbeat to have its own message ID")
+	}
+}
+
+func TestHeartbeatDisabledByConfig(t *testing.T) {
+	producer := useFakeProducer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	for _, env := range []map[string]string{
+		{"NS_HEARTBEAT_INTERVAL": ""},
+		{"NS_HEARTBEAT_INTERVAL": "soon", "NS_HEARTBEAT_MODE": "slack"},
+		{"NS_HEARTBEAT_INTERVAL": "1ms", "NS_HEARTBEAT_MODE": "fax"},
+	} {
+		for key, value := range env {
+			t.Setenv(key, value)
+		}
+		StartHeartbeat(ctx)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if opened, _ := producer.Opened(); opened != 0 {
+		t.Fatalf("expected no heartbeat to be sent, %d were", opened)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/models"
+)
+
+// Spaces out sends to the same recipient, per mode, so one person doesn't get flooded
+// Unlike a quota this doesn't drop anything, a notification arriving too soon is deferred
+type recipientPacer struct {
+	nextSend map[string]map[string]time.Time
+	mu       sync.Mutex
+}
+
+var pacer = recipientPacer{
+	nextSend: make(map[string]map[string]time.Time),
+}
+
+// Per-mode minimum interval between sends to one recipient, e.g. NS_SMS_RECIPIENT_MIN_INTERVAL=30s
+func recipientMinInterval(mode string) time.Duration {
+	return config.DurationFromEnv("NS_"+strings.ToUpper(mode)+"_RECIPIENT_MIN_INTERVAL", 0)
+}
+
+// Reserve the recipient's next send slot and return how long to wait for it
+// A slot after `deadline` isn't reserved, and false is returned instead
+func (rp *recipientPacer) reserve(mode string, recipient string, interval time.Duration,
+	deadline time.Time) (time.Duration, bool) {
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	now := time.Now()
+	modeSends, exists := rp.nextSend[mode]
+	if !exists {
+		modeSends = make(map[string]time.Time)
+		rp.nextSend[mode] = modeSends
+	}
+
+	// Forget recipients whose slot is long gone so the map doesn't grow unbounded
+	for otherRecipient, next := range modeSends {
+		if now.Sub(next) > interval {
+			delete(modeSends, otherRecipient)
+		}
+	}
+
+	slot := now
+	if next, exists := modeSends[recipient]; exists && next.After(now) {
+		slot = next
+	}
+	if slot.After(deadline) {
+		return 0, false
+	}
+	modeSends[recipient] = slot.Add(interval)
+	return slot.Sub(now), true
+}
+
+// Defer the send until the mode's minimum interval since the previous send to the recipient has passed
+// The deferral counts against the retry deadline, a notification that would be deferred past it fails
+// right away instead, while the client is still waiting on the result
+func waitForRecipientInterval(notification *models.Notification) error {
+	interval := recipientMinInterval(notification.Mode)
+	if interval == 0 {
+		return nil
+	}
+
+	wait, reserved := pacer.reserve(notification.Mode, notification.Recipient, interval, retryDeadline(notification))
+	if !reserved {
+		return fmt.Errorf("Not sent. Too many notifications to '%s', the minimum interval of %s between them "+
+			"would defer it past the retry deadline", notification.Recipient, interval)
+	}
+	time.Sleep(wait)
+	return nil
+}
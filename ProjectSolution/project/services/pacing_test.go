@@ -0,0 +1,117 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestPacer() *recipientPacer {
+	return &recipientPacer{nextSend: make(map[string]map[string]time.Time)}
+}
+
+// Forget the sends of earlier tests
+func resetPacer() {
+	pacer.mu.Lock()
+	defer pacer.mu.Unlock()
+	pacer.nextSend = make(map[string]map[string]time.Time)
+}
+
+func TestPacerDefersSendsToTheSameRecipient(t *testing.T) {
+	pacer := newTestPacer()
+	deadline := time.Now().Add(time.Hour)
+
+	if wait, reserved := pacer.reserve("sms", "+15555550100", time.Minute, deadline); !reserved || wait != 0 {
+		t.Fatalf("expected the first send to go right away, got %s, %v", wait, reserved)
+	}
+	wait, reserved := pacer.reserve("sms", "+15555550100", time.Minute, deadline)
+	if !reserved || wait < 59*time.Second || wait > time.Minute {
+		t.Fatalf("expected the second send to wait the interval, got %s, %v", wait, reserved)
+	}
+	wait, reserved = pacer.reserve("sms", "+15555550100", time.Minute, deadline)
+	if !reserved || wait < 119*time.Second || wait > 2*time.Minute {
+		t.Fatalf("expected the third send to wait two intervals, got %s, %v", wait, reserved)
+	}
+
+	// Other recipients and other modes are paced on their own
+	if wait, _ := pacer.reserve("sms", "+15555550101", time.Minute, deadline); wait != 0 {
+		t.Fatalf("expected another recipient to go right away, got %s", wait)
+	}
+	if wait, _ := pacer.reserve("email", "+15555550100", time.Minute, deadline); wait != 0 {
+		t.Fatalf("expected another mode to go right away, got %s", wait)
+	}
+}
+
+func TestPacerRefusesSlotsPastTheDeadline(t *testing.T) {
+	pacer := newTestPacer()
+	deadline := time.Now().Add(90 * time.Second)
+
+	pacer.reserve("sms", "+15555550100", time.Minute, deadline)
+	pacer.reserve("sms", "+15555550100", time.Minute, deadline)
+	if _, reserved := pacer.reserve("sms", "+15555550100", time.Minute, deadline); reserved {
+		t.Fatalf("expected a slot past the deadline to be refused")
+	}
+	// A refused slot isn't taken, the next one is still two intervals out
+	wait, reserved := pacer.reserve("sms", "+15555550100", time.Minute, time.Now().Add(time.Hour))
+	if !reserved || wait > 2*time.Minute {
+		t.Fatalf("expected the refused slot to stay free, got %s, %v", wait, reserved)
+	}
+}
+
+func TestRapidSendsToTheSameRecipientAreDeferred(t *testing.T) {
+	t.Setenv("NS_SMS_RECIPIENT_MIN_INTERVAL", "30ms")
+	resetPacer()
+	recipient := "+15555550100"
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		notification := newTestNotification("sms", 1)
+		notification.Recipient = recipient
+		if err := waitForRecipientInterval(notification); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Fatalf("expected the second and third sends to be deferred, took %s", elapsed)
+	}
+}
+
+func TestDeferralPastTheRetryDeadlineFails(t *testing.T) {
+	fastRetries(t)
+	RetryDeadline = 50 * time.Millisecond
+	t.Setenv("NS_SMS_RECIPIENT_MIN_INTERVAL", "1h")
+	resetPacer()
+	recipient := "+15555550100"
+
+	first := newTestNotification("sms", 1)
+	first.Recipient = recipient
+	if err := waitForRecipientInterval(first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := newTestNotification("sms", 1)
+	second.Recipient = recipient
+	start := time.Now()
+	if err := waitForRecipientInterval(second); err == nil {
+		t.Fatalf("expected a deferral past the deadline to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Millisecond {
+		t.Fatalf("expected the failure right away, took %s", elapsed)
+	}
+}
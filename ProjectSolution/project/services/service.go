@@ -19,20 +19,554 @@ package services
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
+
+	"example.com/projectsolution/project/config"
 	"example.com/projectsolution/project/kafkawrapper"
+	"example.com/projectsolution/project/models"
+)
+
+const defaultProviderTimeout = 10 * time.Second
+
+var (
+	kafkaTopicEmail     = config.Current().Topics.Email
+	kafkaTopicSms       = config.Current().Topics.Sms
+	kafkaTopicSlack     = config.Current().Topics.Slack
+	kafkaTopicWebhook   = config.Current().Topics.Webhook
+	kafkaTopicProcessed = config.Current().Topics.Processed
 )
 
-const (
-	kafkaTopicEmail     = "email"
-	kafkaTopicSms       = "sms"
-	kafkaTopicSlack     = "slack"
-	kafkaTopicProcessed = "processed"
+// Backoff between send retries, see retryDelay()
+var (
+	BaseRetryDelay = 500 * time.Millisecond
+	MaxRetryDelay  = 10 * time.Second
+	// Measured from the notification's TimeStamp, kept under the endpoint's 60 second hard timeout
+	RetryDeadline = 55 * time.Second
+)
+
+// Most recipients of one notification sent to at the same time, see sendToEachRecipient()
+var MaxRecipientSends = 10
+
+// A mode's kafka listener. Pausing cancels its ReceiveKafkaMessage() loop so messages queue up
+// on the topic, resuming starts a new loop which picks up from the committed offsets
+type modeConsumer struct {
+	topic    string
+	callback func(*models.Notification) error
+	cancel   context.CancelFunc
+	paused   bool
+}
+
+var (
+	modeConsumers = map[string]*modeConsumer{
+		"email":   {topic: kafkaTopicEmail, callback: EmailNotificationRequest},
+		"sms":     {topic: kafkaTopicSms, callback: SmsNotificationRequest},
+		"slack":   {topic: kafkaTopicSlack, callback: SlackNotificationRequest},
+		"webhook": {topic: kafkaTopicWebhook, callback: WebhookNotificationRequest},
+	}
+	modeConsumersMu sync.Mutex
+	serviceCtx      = context.Background()
 )
 
+// A provider: makes a single send attempt and returns why it failed. Retries, FailReason and
+// publishing the result are left to runService()
+type Sender interface {
+	Send(notification *models.Notification) error
+}
+
+// A plain send function as a Sender
+type SenderFunc func(notification *models.Notification) error
+
+func (send SenderFunc) Send(notification *models.Notification) error {
+	return send(notification)
+}
+
+// The providers able to send each mode, by name
+var modeProviders = map[string]map[string]Sender{
+	"email":   {"smtp": SenderFunc(sendEmail)},
+	"sms":     {"nexmo": SenderFunc(sendSms)},
+	"slack":   {"slack": SenderFunc(sendSlack)},
+	"webhook": {"http": SenderFunc(sendWebhook)},
+}
+
+// The provider used when a notification doesn't ask for one
+var defaultProviders = map[string]string{
+	"email":   "smtp",
+	"sms":     "nexmo",
+	"slack":   "slack",
+	"webhook": "http",
+}
+
+// Add a provider for an existing mode, or replace one. Call it before StartService()
+func RegisterProvider(mode string, name string, sender Sender) error {
+	providers, exists := modeProviders[mode]
+	if !exists {
+		return fmt.Errorf("unknown mode '%s'", mode)
+	}
+	providers[name] = sender
+	return nil
+}
+
+// Names of the providers configured for the mode
+func ProviderNames(mode string) []string {
+	names := make([]string, 0, len(modeProviders[mode]))
+	for name := range modeProviders[mode] {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// The notification's provider, or the mode's default provider if none was requested
+func providerSender(notification *models.Notification) (Sender, error) {
+	provider := notification.Provider
+	if provider == "" {
+		provider = defaultProviders[notification.Mode]
+	}
+
+	sender, exists := modeProviders[notification.Mode][provider]
+	if !exists {
+		return nil, fmt.Errorf("provider '%s' is not configured for mode '%s'", provider, notification.Mode)
+	}
+	return sender, nil
+}
+
+// How runService() sends each mode
+type modeService struct {
+	maxRetries int
+	// Fails the notification before any attempt, for problems no retry can fix. Optional
+	check func(*models.Notification) error
+	// Whether a failed attempt will fail again no matter how often it is retried. Optional
+	permanentFailure func(*models.Notification) bool
+	// A comma-separated recipient gets a send of its own per recipient
+	perRecipient bool
+}
+
+var modeServices = map[string]modeService{
+	"email":   {maxRetries: maxEmailRetries, perRecipient: true},
+	"sms":     {maxRetries: maxSmsRetries, check: checkSmsRecipient},
+	"slack":   {maxRetries: maxSlackRetries},
+	"webhook": {maxRetries: maxWebhookRetries, permanentFailure: isPermanentWebhookFailure},
+}
+
+// The sends handed off by the consumers and not yet published, see WaitForSends()
+var inFlightSends sync.WaitGroup
+
+// Run the notification's send in the background, counted as in-flight until its result is published
+func startSend(notification *models.Notification) {
+	inFlightSends.Add(1)
+	go func() {
+		defer inFlightSends.Done()
+		runService(notification)
+	}()
+}
+
+// Wait for the in-flight sends, including queued batches and pacing delays, to publish their results
+// Call once the consumers have stopped. Returns false if some are still running after `timeout`
+func WaitForSends(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		inFlightSends.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Send the notification through its provider, retrying according to user spec/max retries of the
+// mode, and publish the result
+func runService(notification *models.Notification) {
+	service := modeServices[notification.Mode]
+
+	sender, err := providerSender(notification)
+	if err == nil && service.check != nil {
+		err = service.check(notification)
+	}
+	if err != nil {
+		notification.IsSent = false
+		notification.FailReason = err.Error()
+		publishResult(notification)
+		return
+	}
+
+	if recipients := models.SplitRecipients(notification.Recipient); service.perRecipient && len(recipients) > 1 {
+		notification = sendToEachRecipient(notification, recipients, sender, service.maxRetries)
+		publishResult(notification)
+		return
+	}
+
+	// Don't flood the recipient
+	if err := waitForRecipientInterval(notification); err != nil {
+		notification.IsSent = false
+		notification.FailReason = err.Error()
+		publishResult(notification)
+		return
+	}
+
+	// Send until the mode's max retries or notification.MaxRetryAttempts, whichever occurs first
+	notification = sendWithRetries(notification, sender, service.maxRetries)
+	publishResult(notification)
+}
+
+// Make a single send attempt and return the 'notification' object updated with pass/fail
+func sendOnce(notification *models.Notification, sender Sender) *models.Notification {
+	notification, _ = attemptSend(notification, sender)
+	return notification
+}
+
+// Like sendOnce(), also returning the provider's error so the caller can tell how it failed
+func attemptSend(notification *models.Notification, sender Sender) (*models.Notification, error) {
+	if err := sender.Send(notification); err != nil {
+		notification.IsSent = false
+		notification.NumOfRepetitions = notification.NumOfRepetitions + 1
+		notification.FailReason = err.Error()
+		return notification, err
+	}
+
+	// Success
+	notification.IsSent = true
+	return notification, nil
+}
+
+// A failed send where the provider said how long to wait before the next attempt
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryAfterError) Unwrap() error {
+	return e.err
+}
+
+// Send a synthetic message through the mode's provider right away, bypassing Kafka and retries
+// Meant for operators checking provider credentials. Returns the notification with the provider's result
+func SendTestNotification(mode string, provider string, recipient string) (*models.Notification, error) {
+	notification := &models.Notification{
+		Mode:      mode,
+		Message:   "Notification system test message",
+		Recipient: recipient,
+		Provider:  provider,
+		TimeStamp: time.Now(),
+		MessageID: uuid.New(),
+	}
+
+	sender, err := providerSender(notification)
+	if err != nil {
+		return nil, err
+	}
+	return sendOnce(notification, sender), nil
+}
+
 // Start all kafka listeners with respective callbacks
 func StartService(ctx context.Context) {
-	go kafkawrapper.ReceiveKafkaMessage(ctx, kafkaTopicEmail, EmailNotificationRequest)
-	go kafkawrapper.ReceiveKafkaMessage(ctx, kafkaTopicSms, SmsNotificationRequest)
-	go kafkawrapper.ReceiveKafkaMessage(ctx, kafkaTopicSlack, SlackNotificationRequest)
+	modeConsumersMu.Lock()
+	defer modeConsumersMu.Unlock()
+
+	serviceCtx = ctx
+	for _, consumer := range modeConsumers {
+		consumer.start()
+	}
+}
+
+// Run the consumer loop under its own cancellable context. Callers hold modeConsumersMu
+func (consumer *modeConsumer) start() {
+	consumerCtx, cancel := context.WithCancel(serviceCtx)
+	consumer.cancel = cancel
+	consumer.paused = false
+	kafkawrapper.StartReceivingKafkaMessages(consumerCtx, consumer.topic, consumer.callback)
+}
+
+// Stop consuming a mode's topic, leaving its messages queued. Pausing a paused mode does nothing
+func PauseMode(mode string) error {
+	modeConsumersMu.Lock()
+	defer modeConsumersMu.Unlock()
+
+	consumer, exists := modeConsumers[mode]
+	if !exists {
+		return fmt.Errorf("unknown mode '%s'", mode)
+	}
+	if consumer.paused {
+		return nil
+	}
+
+	if consumer.cancel != nil {
+		consumer.cancel()
+	}
+	consumer.paused = true
+	return nil
+}
+
+// Start consuming a paused mode's topic again. Resuming a running mode does nothing
+func ResumeMode(mode string) error {
+	modeConsumersMu.Lock()
+	defer modeConsumersMu.Unlock()
+
+	consumer, exists := modeConsumers[mode]
+	if !exists {
+		return fmt.Errorf("unknown mode '%s'", mode)
+	}
+	if !consumer.paused {
+		return nil
+	}
+
+	consumer.start()
+	return nil
+}
+
+// Returns "running", "joining" (waiting on the broker) or "paused" for every mode
+func ModeConsumerStatus() map[string]string {
+	modeConsumersMu.Lock()
+	defer modeConsumersMu.Unlock()
+
+	status := make(map[string]string, len(modeConsumers))
+	for mode, consumer := range modeConsumers {
+		switch {
+		case consumer.paused:
+			status[mode] = "paused"
+		case !kafkawrapper.ConsumerReady(consumer.topic):
+			status[mode] = "joining"
+		default:
+			status[mode] = "running"
+		}
+	}
+	return status
+}
+
+// Optional per-mode delay, e.g. NS_EMAIL_GRACE_WINDOW=5s, waited before the first retry and before the
+// last allowed attempt, so a momentary provider outage doesn't immediately burn the retry budget
+func graceWindow(mode string) time.Duration {
+	return config.DurationFromEnv("NS_"+strings.ToUpper(mode)+"_GRACE_WINDOW", 0)
+}
+
+// Sending past the deadline is pointless, the endpoint has given up on the notification by then
+func retryDeadline(notification *models.Notification) time.Time {
+	start := notification.TimeStamp
+	if start.IsZero() {
+		start = time.Now()
+	}
+	return start.Add(RetryDeadline)
+}
+
+// Send until it succeeds or until `maxRetries` or notification.MaxRetryAttempts attempts, whichever is fewer
+// Attempts are spaced out by retryDelay(), and no retry is started past RetryDeadline
+// The grace window is added to the wait before the first retry and before the last allowed attempt, as
+// far as the deadline allows
+// Returns the notification with pass/fail, ready to be published on the processed topic
+func sendWithRetries(notification *models.Notification, sender Sender, maxRetries int) *models.Notification {
+	deadline := retryDeadline(notification)
+	attempts := max(1, min(notification.MaxRetryAttempts, maxRetries))
+
+	for attempt := 1; ; attempt++ {
+
+		// Send and update the 'notification' object
+		var err error
+		notification, err = attemptSend(notification, sender)
+		if notification.IsSent {
+			return notification
+		}
+
+		// Some failures will happen again no matter how often we retry
+		if permanentFailure := modeServices[notification.Mode].permanentFailure; permanentFailure != nil &&
+			permanentFailure(notification) {
+			notification.FailReason = "Not retried. Attempt failed with: " + notification.FailReason
+			return notification
+		}
+
+		if attempt >= attempts {
+			// If we are at the number of retries set by the user
+			if notification.NumOfRepetitions >= notification.MaxRetryAttempts {
+				notification.FailReason =
+					"Too many failed attempts. Last attempt failed with: " + notification.FailReason
+				return notification
+			}
+
+			// Otherwise we are at the max number of retries constant set by our program
+			notification.FailReason =
+				"Too many failed attempts. Max number of retries reached. Last attempt failed with: " + notification.FailReason
+			return notification
+		}
+
+		// Back off before the next attempt, or wait as long as the provider asked, unless that would
+		// run past the deadline
+		delay := retryDelay(attempt)
+		var retryAfter *retryAfterError
+		providerDelay := errors.As(err, &retryAfter)
+		if providerDelay {
+			delay = retryAfter.after
+		}
+		if time.Now().Add(delay).After(deadline) {
+			notification.FailReason =
+				"Retry deadline reached. Last attempt failed with: " + notification.FailReason
+			return notification
+		}
+
+		// Give a momentary outage time to pass before the first retry and before the last chance
+		if !providerDelay && (attempt == 1 || attempt+1 == attempts) {
+			delay = min(delay+graceWindow(notification.Mode), time.Until(deadline))
+		}
+		time.Sleep(delay)
+	}
+}
+
+// Send a copy of the notification to each recipient in parallel, each with its own retries so one bad
+// address doesn't affect the others and a retry never re-sends to a recipient that already got it
+// The notification is sent if every recipient got it, the outcome per recipient is in RecipientResults
+// At most MaxRecipientSends recipients are sent to at a time
+func sendToEachRecipient(notification *models.Notification, recipients []string, sender Sender,
+	maxRetries int) *models.Notification {
+
+	start := time.Now()
+	results := make([]models.RecipientResult, len(recipients))
+	sendResults := make([]models.SendResult, len(recipients))
+	slots := make(chan struct{}, max(MaxRecipientSends, 1))
+	var wg sync.WaitGroup
+	for i, recipient := range recipients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			single := *notification
+			single.Recipient = recipient
+
+			// Don't flood the recipient
+			if err := waitForRecipientInterval(&single); err != nil {
+				results[i] = models.RecipientResult{Recipient: recipient, FailReason: err.Error()}
+				return
+			}
+			sent := sendWithRetries(&single, sender, maxRetries)
+			results[i] = models.RecipientResult{
+				Recipient:        recipient,
+				IsSent:           sent.IsSent,
+				NumOfRepetitions: sent.NumOfRepetitions,
+				FailReason:       sent.FailReason,
+			}
+			sendResults[i] = sent.Result
+		}()
+	}
+	wg.Wait()
+
+	var failed []string
+	for _, result := range results {
+		notification.NumOfRepetitions = max(notification.NumOfRepetitions, result.NumOfRepetitions)
+		if !result.IsSent {
+			failed = append(failed, result.Recipient)
+		}
+	}
+	notification.Result = aggregateSendResult(results, sendResults, time.Since(start))
+	notification.RecipientResults = results
+	notification.IsSent = len(failed) == 0
+	if !notification.IsSent {
+		notification.FailReason = fmt.Sprintf("failed to send to %d of %d recipients: %s",
+			len(failed), len(results), strings.Join(failed, ", "))
+	}
+	return notification
+}
+
+// The provider level outcome of a notification sent to several recipients: the provider calls made
+// for all of them, the time taken to send to all of them, their provider message IDs in recipient
+// order, and the response code of the first recipient that failed, or of the first one if none did
+func aggregateSendResult(recipients []models.RecipientResult, results []models.SendResult,
+	elapsed time.Duration) models.SendResult {
+
+	aggregate := models.SendResult{LatencyMillis: elapsed.Milliseconds()}
+	var providerMessageIDs []string
+	for _, result := range results {
+		aggregate.Attempts += result.Attempts
+		if result.ProviderMessageID != "" {
+			providerMessageIDs = append(providerMessageIDs, result.ProviderMessageID)
+		}
+	}
+	aggregate.ProviderMessageID = strings.Join(providerMessageIDs, ",")
+
+	responseFrom := slices.IndexFunc(recipients, func(recipient models.RecipientResult) bool {
+		return !recipient.IsSent
+	})
+	if responseFrom < 0 && len(results) > 0 {
+		responseFrom = 0
+	}
+	if responseFrom >= 0 {
+		aggregate.ResponseCode = results[responseFrom].ResponseCode
+	}
+	return aggregate
+}
+
+// Exponential backoff before the n-th retry (starting at 1): BaseRetryDelay * 2^(n-1), capped at
+// MaxRetryDelay, plus up to 10% of random jitter so failed notifications don't retry in lockstep
+func retryDelay(attempt int) time.Duration {
+	delay := BaseRetryDelay
+	for i := 1; i < attempt && delay < MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, MaxRetryDelay)
+
+	if jitter := int64(delay / 10); jitter > 0 {
+		delay += time.Duration(rand.Int64N(jitter))
+	}
+	return delay
+}
+
+// Publish the outcome of a notification on the processed topic. A terminal failure is also
+// published on the dead-letter topic, a durable record of it for inspection and retries
+func publishResult(notification *models.Notification) {
+	if err := kafkawrapper.SendKafkaMessage(kafkaTopicProcessed, *notification); err != nil {
+		log.Printf("failed to publish result of notification %s: %v", notification.MessageID, err)
+	}
+
+	if notification.IsSent {
+		return
+	}
+	if err := kafkawrapper.SendNotificationToDeadLetter(*notification); err != nil {
+		log.Printf("failed to dead-letter notification %s: %v", notification.MessageID, err)
+	}
+}
+
+// Per-mode timeout for a single provider call, e.g. NS_SMS_TIMEOUT=5s
+func providerTimeout(mode string) time.Duration {
+	return config.PositiveDurationFromEnv("NS_"+strings.ToUpper(mode)+"_TIMEOUT", defaultProviderTimeout)
+}
+
+// Whether a provider call failed because it ran out of time
+func isTimeout(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// Error for a provider call that timed out, so a short timeout can be told apart from a long one
+func timeoutError(provider string, elapsed time.Duration, timeout time.Duration, err error) error {
+	return fmt.Errorf("%s timed out after %s (configured timeout %s) with following error %s",
+		provider, elapsed.Round(time.Millisecond), timeout, err)
+}
+
+// Record the provider level outcome of a send attempt on the notification
+func recordSendResult(notification *models.Notification, providerMessageID string, responseCode string,
+	latency time.Duration) {
+
+	notification.Result.Attempts++
+	notification.Result.ProviderMessageID = providerMessageID
+	notification.Result.ResponseCode = responseCode
+	notification.Result.LatencyMillis = latency.Milliseconds()
 }
@@ -0,0 +1,553 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/config"
+	"example.com/projectsolution/project/kafkawrapper"
+	"example.com/projectsolution/project/kafkawrapper/kafkatest"
+	"example.com/projectsolution/project/models"
+	"github.com/google/uuid"
+)
+
+// A provider failing its first `failures` sends
+type fakeSender struct {
+	failures int
+	err      error
+	calls    []time.Time
+	mu       sync.Mutex
+}
+
+func (sender *fakeSender) Send(notification *models.Notification) error {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	sender.calls = append(sender.calls, time.Now())
+	if len(sender.calls) <= sender.failures {
+		if sender.err != nil {
+			return sender.err
+		}
+		return errors.New("provider unavailable")
+	}
+	return nil
+}
+
+func (sender *fakeSender) callCount() int {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	return len(sender.calls)
+}
+
+// Millisecond backoff for the duration of the test
+func fastRetries(t *testing.T) {
+	base, maxDelay, deadline := BaseRetryDelay, MaxRetryDelay, RetryDeadline
+	BaseRetryDelay, MaxRetryDelay, RetryDeadline = time.Millisecond, 5*time.Millisecond, 5*time.Second
+	t.Cleanup(func() { BaseRetryDelay, MaxRetryDelay, RetryDeadline = base, maxDelay, deadline })
+}
+
+func newTestNotification(mode string, maxRetryAttempts int) *models.Notification {
+	return &models.Notification{
+		Mode:             mode,
+		Message:          "Hello",
+		Recipient:        "recipient",
+		MaxRetryAttempts: maxRetryAttempts,
+		TimeStamp:        time.Now(),
+		MessageID:        uuid.New(),
+	}
+}
+
+func TestGraceWindowBeforeFirstRetryAndLastAttempt(t *testing.T) {
+	fastRetries(t)
+	t.Setenv("NS_SMS_GRACE_WINDOW", "50ms")
+
+	sender := &fakeSender{failures: 3}
+	notification := sendWithRetries(newTestNotification("sms", 4), sender, maxSmsRetries)
+
+	if !notification.IsSent {
+		t.Fatalf("expected the last attempt to succeed, got %q", notification.FailReason)
+	}
+	// The grace window delays attempts, it never adds one
+	if sender.callCount() != 4 {
+		t.Fatalf("expected 4 attempts, got %d", sender.callCount())
+	}
+	gaps := []time.Duration{
+		sender.calls[1].Sub(sender.calls[0]),
+		sender.calls[2].Sub(sender.calls[1]),
+		sender.calls[3].Sub(sender.calls[2]),
+	}
+	if gaps[0] < 50*time.Millisecond || gaps[2] < 50*time.Millisecond {
+		t.Fatalf("expected the grace window before the first retry and the last attempt, got gaps %v", gaps)
+	}
+	if gaps[1] >= 50*time.Millisecond {
+		t.Fatalf("expected no grace window between the other retries, got gaps %v", gaps)
+	}
+}
+
+func TestGraceWindowStopsAtTheRetryDeadline(t *testing.T) {
+	fastRetries(t)
+	RetryDeadline = 100 * time.Millisecond
+	t.Setenv("NS_SMS_GRACE_WINDOW", "10s")
+
+	sender := &fakeSender{failures: 5}
+	start := time.Now()
+	notification := sendWithRetries(newTestNotification("sms", 5), sender, maxSmsRetries)
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the grace window to be cut at the deadline, took %s", elapsed)
+	}
+	if notification.IsSent || !strings.HasPrefix(notification.FailReason, "Retry deadline reached") {
+		t.Fatalf("expected the deadline to end the retries, got %q", notification.FailReason)
+	}
+}
+
+func TestGraceWindowFromEnv(t *testing.T) {
+	t.Setenv("NS_EMAIL_GRACE_WINDOW", "2s")
+	if grace := graceWindow("email"); grace != 2*time.Second {
+		t.Fatalf("expected 2s, got %s", grace)
+	}
+	t.Setenv("NS_EMAIL_GRACE_WINDOW", "-2s")
+	if grace := graceWindow("email"); grace != 0 {
+		t.Fatalf("expected an invalid grace window to be ignored, got %s", grace)
+	}
+}
+
+// Records what the package produces instead of producing it, for the duration of the test
+func useFakeProducer(t *testing.T) *kafkatest.Producer {
+	producer := kafkatest.NewProducer()
+	previous := kafkawrapper.NewProducer
+	kafkawrapper.NewProducer = producer.Open
+	t.Cleanup(func() { kafkawrapper.NewProducer = previous })
+	return producer
+}
+
+// Registers the sender as the mode's provider for the duration of the test
+func useProvider(t *testing.T, mode string, name string, sender Sender) {
+	if err := RegisterProvider(mode, name, sender); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { delete(modeProviders[mode], name) })
+}
+
+// Wait for `count` results to be published
+func waitForResults(t *testing.T, producer *kafkatest.Producer, count int) []models.Notification {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		results := producer.Notifications(kafkaTopicProcessed)
+		if len(results) >= count {
+			return results
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d results to be published, got %d", count, len(results))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Points the process at a broker nobody listens on, so consumers keep failing to join without a Kafka
+func withoutBroker(t *testing.T) {
+	previous := config.Current()
+	current := previous
+	current.KafkaBrokers = []string{"127.0.0.1:1"}
+	config.SetCurrent(current)
+	t.Cleanup(func() { config.SetCurrent(previous) })
+}
+
+func TestPauseAndResumeMode(t *testing.T) {
+	withoutBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		kafkawrapper.WaitForConsumers(10 * time.Second)
+	})
+
+	modeConsumersMu.Lock()
+	serviceCtx = ctx
+	modeConsumers["sms"].start()
+	modeConsumersMu.Unlock()
+
+	// Running, but not joined to its group without a broker
+	if status := ModeConsumerStatus()["sms"]; status != "joining" {
+		t.Fatalf("expected the started consumer to be joining, got %q", status)
+	}
+
+	if err := PauseMode("sms"); err != nil {
+		t.Fatal(err)
+	}
+	if status := ModeConsumerStatus()["sms"]; status != "paused" {
+		t.Fatalf("expected the consumer to be paused, got %q", status)
+	}
+	// Pausing twice is fine
+	if err := PauseMode("sms"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResumeMode("sms"); err != nil {
+		t.Fatal(err)
+	}
+	if status := ModeConsumerStatus()["sms"]; status != "joining" {
+		t.Fatalf("expected the resumed consumer to be joining, got %q", status)
+	}
+	if err := PauseMode("sms"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPauseAndResumeUnknownMode(t *testing.T) {
+	if err := PauseMode("fax"); err == nil {
+		t.Fatalf("expected pausing an unknown mode to fail")
+	}
+	if err := ResumeMode("fax"); err == nil {
+		t.Fatalf("expected resuming an unknown mode to fail")
+	}
+}
+
+func TestRequestedProviderIsUsed(t *testing.T) {
+	producer := useFakeProducer(t)
+	primary, secondary := &fakeSender{}, &fakeSender{}
+	useProvider(t, "sms", "primary", primary)
+	useProvider(t, "sms", "secondary", secondary)
+
+	notification := newTestNotification("sms", 1)
+	notification.Recipient = "+15555550100"
+	notification.Provider = "secondary"
+	runService(notification)
+
+	if secondary.callCount() != 1 || primary.callCount() != 0 {
+		t.Fatalf("expected only the requested provider to be called, got %d and %d calls",
+			secondary.callCount(), primary.callCount())
+	}
+	if results := waitForResults(t, producer, 1); !results[0].IsSent {
+		t.Fatalf("expected the notification to be sent, got %q", results[0].FailReason)
+	}
+}
+
+func TestUnknownProviderFailsWithoutAnAttempt(t *testing.T) {
+	producer := useFakeProducer(t)
+
+	notification := newTestNotification("sms", 1)
+	notification.Provider = "nope"
+	runService(notification)
+
+	results := waitForResults(t, producer, 1)
+	if results[0].IsSent || !strings.Contains(results[0].FailReason, "provider 'nope' is not configured") {
+		t.Fatalf("expected the unknown provider to fail the notification, got %q", results[0].FailReason)
+	}
+	if results[0].NumOfRepetitions != 0 {
+		t.Fatalf("expected no attempt, got %d", results[0].NumOfRepetitions)
+	}
+}
+
+func TestRetryDelayGrowsWithJitterUpToTheMax(t *testing.T) {
+	for attempt, base := range []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second, 4 * time.Second} {
+		delay := retryDelay(attempt + 1)
+		if delay < base || delay >= base+base/10 {
+			t.Fatalf("retry %d: expected %s plus under 10%% jitter, got %s", attempt+1, base, delay)
+		}
+	}
+	if delay := retryDelay(30); delay < MaxRetryDelay || delay >= MaxRetryDelay+MaxRetryDelay/10 {
+		t.Fatalf("expected the delay to be capped at %s plus jitter, got %s", MaxRetryDelay, delay)
+	}
+
+	// Retries failing together don't retry in lockstep
+	delays := make(map[time.Duration]bool)
+	for i := 0; i < 20; i++ {
+		delays[retryDelay(1)] = true
+	}
+	if len(delays) == 1 {
+		t.Fatalf("expected the jitter to vary the delay")
+	}
+}
+
+func TestEmailRetriesBackOffAndStopOnSuccess(t *testing.T) {
+	fastRetries(t)
+	BaseRetryDelay, MaxRetryDelay = 10*time.Millisecond, time.Second
+
+	sender := &fakeSender{failures: 3}
+	notification := sendWithRetries(newTestNotification("email", 5), sender, maxEmailRetries)
+
+	if !notification.IsSent {
+		t.Fatalf("expected the fourth attempt to succeed, got %q", notification.FailReason)
+	}
+	// No attempt after the success
+	if sender.callCount() != 4 {
+		t.Fatalf("expected 4 attempts, got %d", sender.callCount())
+	}
+	for i := 1; i < len(sender.calls); i++ {
+		expected := BaseRetryDelay << (i - 1)
+		if gap := sender.calls[i].Sub(sender.calls[i-1]); gap < expected {
+			t.Fatalf("retry %d: expected to wait at least %s, waited %s", i, expected, gap)
+		}
+	}
+}
+
+// A provider failing the first `failures[recipient]` sends to each recipient, counting the sends per recipient
+type recipientSender struct {
+	failures map[string]int
+	calls    map[string]int
+	mu       sync.Mutex
+}
+
+func (sender *recipientSender) Send(notification *models.Notification) error {
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	sender.calls[notification.Recipient]++
+	if sender.calls[notification.Recipient] <= sender.failures[notification.Recipient] {
+		return errors.New("mailbox unavailable")
+	}
+	return nil
+}
+
+func TestEachRecipientIsSentAndRetriedOnItsOwn(t *testing.T) {
+	fastRetries(t)
+	producer := useFakeProducer(t)
+	sender := &recipientSender{
+		failures: map[string]int{"bad@example.com": 100, "flaky@example.com": 1},
+		calls:    make(map[string]int),
+	}
+	useProvider(t, "email", "fake", sender)
+
+	notification := newTestNotification("email", 3)
+	notification.Provider = "fake"
+	notification.Recipient = "ok@example.com, bad@example.com,flaky@example.com"
+	runService(notification)
+
+	result := waitForResults(t, producer, 1)[0]
+	// One bad address doesn't stop the others, and a retry never re-sends to one that got it
+	expectedCalls := map[string]int{"ok@example.com": 1, "bad@example.com": 3, "flaky@example.com": 2}
+	for recipient, calls := range expectedCalls {
+		if sender.calls[recipient] != calls {
+			t.Fatalf("%s: expected %d sends, got %d", recipient, calls, sender.calls[recipient])
+		}
+	}
+
+	if result.IsSent || !strings.Contains(result.FailReason, "1 of 3 recipients: bad@example.com") {
+		t.Fatalf("expected the bad address to fail the notification, got %q", result.FailReason)
+	}
+	if len(result.RecipientResults) != 3 {
+		t.Fatalf("expected a result per recipient, got %d", len(result.RecipientResults))
+	}
+	expectedRepetitions := map[string]int{"ok@example.com": 0, "bad@example.com": 3, "flaky@example.com": 1}
+	for _, recipientResult := range result.RecipientResults {
+		if recipientResult.IsSent != (recipientResult.Recipient != "bad@example.com") {
+			t.Fatalf("%s: unexpected outcome %+v", recipientResult.Recipient, recipientResult)
+		}
+		if recipientResult.NumOfRepetitions != expectedRepetitions[recipientResult.Recipient] {
+			t.Fatalf("%s: expected %d failed attempts, got %d", recipientResult.Recipient,
+				expectedRepetitions[recipientResult.Recipient], recipientResult.NumOfRepetitions)
+		}
+	}
+}
+
+// A provider answering after a pause, recording the most sends it had in flight at once
+type concurrentSender struct {
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (sender *concurrentSender) Send(notification *models.Notification) error {
+	sender.mu.Lock()
+	sender.inFlight++
+	sender.maxInFlight = max(sender.maxInFlight, sender.inFlight)
+	sender.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	sender.mu.Lock()
+	sender.inFlight--
+	sender.mu.Unlock()
+	if strings.HasPrefix(notification.Recipient, "bad") {
+		recordSendResult(notification, "", "550", time.Millisecond)
+		return errors.New("mailbox unavailable")
+	}
+	recordSendResult(notification, "id-"+notification.Recipient, "250", time.Millisecond)
+	return nil
+}
+
+func TestRecipientsAreSentToAFewAtATimeWithAnAggregateResult(t *testing.T) {
+	fastRetries(t)
+	producer := useFakeProducer(t)
+	sender := &concurrentSender{}
+	useProvider(t, "email", "fake", sender)
+	previous := MaxRecipientSends
+	MaxRecipientSends = 3
+	t.Cleanup(func() { MaxRecipientSends = previous })
+
+	recipients := []string{"bad@example.com"}
+	for i := range 11 {
+		recipients = append(recipients, fmt.Sprintf("user%d@example.com", i))
+	}
+	notification := newTestNotification("email", 2)
+	notification.Provider = "fake"
+	notification.Recipient = strings.Join(recipients, ",")
+	runService(notification)
+
+	result := waitForResults(t, producer, 1)[0]
+	if sender.maxInFlight > 3 {
+		t.Fatalf("expected at most 3 sends at a time, got %d", sender.maxInFlight)
+	}
+	// Two attempts for the bad address, one for each of the others
+	if result.Result.Attempts != 13 {
+		t.Fatalf("expected the attempts of every recipient, got %d", result.Result.Attempts)
+	}
+	if !strings.HasPrefix(result.Result.ProviderMessageID, "id-user0@example.com,id-user1@example.com,") ||
+		strings.Count(result.Result.ProviderMessageID, ",") != 10 {
+		t.Fatalf("expected the provider message IDs in recipient order, got %q", result.Result.ProviderMessageID)
+	}
+	if result.Result.ResponseCode != "550" {
+		t.Fatalf("expected the response code of the failed recipient, got %q", result.Result.ResponseCode)
+	}
+	if result.Result.LatencyMillis < 40 {
+		t.Fatalf("expected the time taken to send to every recipient, got %dms", result.Result.LatencyMillis)
+	}
+}
+
+// A notification for each mode, with a recipient the mode accepts, sent through the `provider`
+func notificationsForEachMode(provider string, maxRetryAttempts int) []*models.Notification {
+	recipients := map[string]string{
+		"email":   "ops@example.com",
+		"sms":     "+15555550100",
+		"slack":   "#ops",
+		"webhook": "https://example.com/hook",
+	}
+	var notifications []*models.Notification
+	for mode, recipient := range recipients {
+		notification := newTestNotification(mode, maxRetryAttempts)
+		notification.Recipient = recipient
+		notification.Provider = provider
+		notifications = append(notifications, notification)
+	}
+	return notifications
+}
+
+func TestWaitForSendsWaitsForHandedOffAndBatchedSends(t *testing.T) {
+	producer := useFakeProducer(t)
+	release := make(chan struct{})
+	blocked := SenderFunc(func(*models.Notification) error {
+		<-release
+		return nil
+	})
+	useProvider(t, "webhook", "fake", blocked)
+	useProvider(t, "slack", "fake", blocked)
+
+	webhook := newTestNotification("webhook", 1)
+	webhook.Provider = "fake"
+	if err := WebhookNotificationRequest(webhook); err != nil {
+		t.Fatal(err)
+	}
+	batcher := newNotificationBatcher(20*time.Millisecond, sendSlackBatch)
+	batcher.add(newSlackNotification("#ops", "one"))
+
+	if WaitForSends(50 * time.Millisecond) {
+		t.Fatalf("expected the blocked sends to be waited for")
+	}
+	close(release)
+	if !WaitForSends(5 * time.Second) {
+		t.Fatalf("expected the sends to finish once released")
+	}
+	// Published by the time the wait is over
+	if results := producer.Notifications(kafkaTopicProcessed); len(results) != 2 {
+		t.Fatalf("expected both results to be published, got %d", len(results))
+	}
+}
+
+func TestRunServiceSendsAndPublishesTheResult(t *testing.T) {
+	for _, notification := range notificationsForEachMode("fake", 3) {
+		producer := useFakeProducer(t)
+		sender := &fakeSender{}
+		useProvider(t, notification.Mode, "fake", sender)
+
+		runService(notification)
+
+		result := waitForResults(t, producer, 1)[0]
+		if !result.IsSent || result.FailReason != "" || sender.callCount() != 1 {
+			t.Fatalf("%s: expected one successful send, got %d sends and %q", notification.Mode,
+				sender.callCount(), result.FailReason)
+		}
+		if dead := producer.Messages(kafkawrapper.DeadLetterTopic); len(dead) != 0 {
+			t.Fatalf("%s: expected nothing dead-lettered, got %d", notification.Mode, len(dead))
+		}
+	}
+}
+
+func TestRunServiceRetriesUntilSuccess(t *testing.T) {
+	fastRetries(t)
+	// Every mode retries, sms included
+	for _, notification := range notificationsForEachMode("fake", 3) {
+		producer := useFakeProducer(t)
+		sender := &fakeSender{failures: 2}
+		useProvider(t, notification.Mode, "fake", sender)
+
+		runService(notification)
+
+		result := waitForResults(t, producer, 1)[0]
+		if !result.IsSent || sender.callCount() != 3 || result.NumOfRepetitions != 2 {
+			t.Fatalf("%s: expected success on the third attempt, got sent %v after %d sends (%d failed)",
+				notification.Mode, result.IsSent, sender.callCount(), result.NumOfRepetitions)
+		}
+	}
+}
+
+func TestRunServiceReportsTheProviderErrorOnceRetriesRunOut(t *testing.T) {
+	fastRetries(t)
+	for _, notification := range notificationsForEachMode("fake", 2) {
+		producer := useFakeProducer(t)
+		sender := &fakeSender{failures: 100, err: errors.New("quota exceeded")}
+		useProvider(t, notification.Mode, "fake", sender)
+
+		runService(notification)
+
+		result := waitForResults(t, producer, 1)[0]
+		if sender.callCount() != 2 {
+			t.Fatalf("%s: expected 2 attempts, got %d", notification.Mode, sender.callCount())
+		}
+		// The same reason for every mode, carrying the provider's own error
+		if result.IsSent || result.FailReason != "Too many failed attempts. Last attempt failed with: quota exceeded" {
+			t.Fatalf("%s: expected the provider's error in the fail reason, got %q", notification.Mode, result.FailReason)
+		}
+		dead := producer.Notifications(kafkawrapper.DeadLetterTopic)
+		if len(dead) != 1 || dead[0].MessageID != notification.MessageID {
+			t.Fatalf("%s: expected the failed notification to be dead-lettered, got %d", notification.Mode, len(dead))
+		}
+	}
+}
+
+func TestRunServiceCapsRetriesAtTheModesMax(t *testing.T) {
+	fastRetries(t)
+	producer := useFakeProducer(t)
+	sender := &fakeSender{failures: 100}
+	useProvider(t, "sms", "fake", sender)
+
+	notification := newTestNotification("sms", maxSmsRetries+10)
+	notification.Recipient = "+15555550100"
+	notification.Provider = "fake"
+	runService(notification)
+
+	result := waitForResults(t, producer, 1)[0]
+	if sender.callCount() != maxSmsRetries ||
+		!strings.HasPrefix(result.FailReason, "Too many failed attempts. Max number of retries reached.") {
+		t.Fatalf("expected %d attempts ending at the max, got %d and %q", maxSmsRetries, sender.callCount(), result.FailReason)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"example.com/projectsolution/project/models"
+	"example.com/projectsolution/project/signing"
+)
+
+// Signature of the notification's message, or "" if it didn't ask to be signed or there is no signing key
+func messageSignature(notification *models.Notification) string {
+	if !notification.Sign || !signing.Configured() {
+		return ""
+	}
+	return signing.Sign(signing.Key(), notification.Message)
+}
+
+// The message to send on modes without headers (sms, slack), with the signature as a footer if signed
+// Recipients verify signing.Verify(key, <text before the footer>, <signature in the footer>)
+func messageWithSignatureFooter(notification *models.Notification) string {
+	signature := messageSignature(notification)
+	if signature == "" {
+		return notification.Message
+	}
+	return notification.Message + "\n\n-- Signature: " + signature
+}
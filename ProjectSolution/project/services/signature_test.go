@@ -0,0 +1,58 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"example.com/projectsolution/project/signing"
+)
+
+func TestSignatureFooterVerifies(t *testing.T) {
+	t.Setenv("NS_SIGNING_KEY", "shared secret")
+	notification := newTestNotification("sms", 1)
+	notification.Message = "Your code is 123456"
+	notification.Sign = true
+
+	message, signature, found := strings.Cut(messageWithSignatureFooter(notification), "\n\n-- Signature: ")
+	if !found {
+		t.Fatalf("expected a signature footer")
+	}
+	if !signing.Verify([]byte("shared secret"), message, signature) {
+		t.Fatalf("expected the footer's signature to verify against the message")
+	}
+	if signing.Verify([]byte("shared secret"), message+"!", signature) {
+		t.Fatalf("expected a tampered message to fail verification")
+	}
+}
+
+func TestUnsignedMessageHasNoFooter(t *testing.T) {
+	t.Setenv("NS_SIGNING_KEY", "shared secret")
+	notification := newTestNotification("sms", 1)
+	if message := messageWithSignatureFooter(notification); message != notification.Message {
+		t.Fatalf("expected a notification that didn't ask to be signed to go as it is, got %q", message)
+	}
+
+	// Nor without a key
+	t.Setenv("NS_SIGNING_KEY", "")
+	notification.Sign = true
+	if signature := messageSignature(notification); signature != "" {
+		t.Fatalf("expected no signature without a key, got %q", signature)
+	}
+}
@@ -19,61 +19,136 @@ package services
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/slack-go/slack"
 
-	"example.com/projectsolution/project/kafkawrapper"
 	"example.com/projectsolution/project/models"
 )
 
+const (
+	maxSlackRetries         = 5
+	slackMaxMessageLength   = 40000
+	slackTruncatedIndicator = "… [truncated]"
+)
+
+// Slack's Web API, replaceable e.g. with a fake in tests
+var slackAPIURL = slack.APIURL
+
 // Hook called to spawn a slack thread
-func SlackNotificationRequest(notification *models.Notification) {
-	go slackService(notification)
+// With batching enabled the notification waits for others to the same channel instead
+func SlackNotificationRequest(notification *models.Notification) error {
+	if slackBatcher.window > 0 {
+		slackBatcher.add(notification)
+		return nil
+	}
+	startSend(notification)
+	return nil
 }
 
-func slackService(notification *models.Notification) {
+// Send the slack message
+func sendSlack(notification *models.Notification) error {
 
-	// Send email and update the 'notification' object
-	notification = sendSlack(notification)
+	// The request's channel, falling back to NS_SLACK_CHANNEL
+	var slackChannel string = notification.Recipient
+	if slackChannel == "" {
+		slackChannel = os.Getenv("NS_SLACK_CHANNEL")
+	}
+	if err := CheckSlackChannel(slackChannel); err != nil {
+		return fmt.Errorf("failed to send slack message with following error %s.", err)
+	}
 
-	if notification.IsSent {
-		// Send success
-		err := kafkawrapper.SendKafkaMessage(kafkaTopicProcessed, *notification)
-		if err != nil {
-			return
-		}
-		return
+	timeout := providerTimeout(notification.Mode)
+	slackApi := newSlackClient(timeout)
+
+	start := time.Now()
+	messageTimestamp, err := postSlackMessage(slackApi, slackChannel, messageWithSignatureFooter(notification))
+
+	// Slack identifies a message by its timestamp, and reports failures as an error string
+	responseCode := "ok"
+	if err != nil {
+		responseCode = err.Error()
 	}
+	recordSendResult(notification, messageTimestamp, responseCode, time.Since(start))
 
-	// If we are above the number of retries set by the user
-	if !notification.IsSent {
-		notification.FailReason = "Failed to send Slack with"
-		kafkawrapper.SendKafkaMessage(kafkaTopicProcessed, *notification)
-		return
+	if err != nil {
+		if isTimeout(err) {
+			return timeoutError("slack", time.Since(start), timeout, err)
+		}
+		if isSlackChannelNotFound(err) {
+			return fmt.Errorf(
+				"failed to send slack message: channel '%s' was not found or the bot is not a member of it (channel_not_found).",
+				slackChannel)
+		}
+		return fmt.Errorf("failed to send slack message with following error %s.", err)
 	}
-}
 
-// Send the slack message and return the updated 'notification' object with pass/fail
-func sendSlack(notification *models.Notification) *models.Notification {
+	// Success
+	return nil
+}
 
-	var slackChannel string = os.Getenv("NS_SLACK_CHANNEL")
+// Slack API client whose calls give up after `timeout`
+func newSlackClient(timeout time.Duration) *slack.Client {
 	var slackBotToken string = os.Getenv("NS_SLACK_BOT_TOKEN")
+	return slack.New(slackBotToken, slack.OptionHTTPClient(&http.Client{Timeout: timeout}), slack.OptionAPIURL(slackAPIURL))
+}
 
-	slackApi := slack.New(slackBotToken)
+// Post the text to the channel (ID or name), split or truncated as configured if it is over Slack's length limit
+// Returns the timestamp (Slack's message ID) of the first post
+func postSlackMessage(slackApi *slack.Client, slackChannel string, text string) (string, error) {
+	// Slack prefers channel IDs, resolve names to them
+	channelID := slackChannels.resolve(slackApi, slackChannel)
 
-	_, _, err := slackApi.PostMessage(
-		slackChannel,
-		slack.MsgOptionText(notification.Message, false),
-	)
-	if err != nil {
-		notification.IsSent = false
-		notification.NumOfRepetitions = notification.NumOfRepetitions + 1
-		notification.FailReason = fmt.Sprintf("failed to send slack message with following error %s.", err)
-		return notification
+	firstTimestamp := ""
+	for _, part := range slackMessageParts(text) {
+		_, messageTimestamp, err := slackApi.PostMessage(channelID, slack.MsgOptionText(part, false))
+		if err != nil {
+			return firstTimestamp, err
+		}
+		if firstTimestamp == "" {
+			firstTimestamp = messageTimestamp
+		}
 	}
+	return firstTimestamp, nil
+}
 
-	// Success
-	notification.IsSent = true
-	return notification
+// Break text over NS_SLACK_MAX_MESSAGE_LENGTH characters (Slack's 40k limit by default) into parts.
+// NS_SLACK_LONG_MESSAGE picks between "split" (default), posting consecutive parts cut at line breaks
+// where possible, and "truncate", posting only the start of the text with an indicator
+func slackMessageParts(text string) []string {
+	maxLength := slackMaxMessageLength
+	if value := os.Getenv("NS_SLACK_MAX_MESSAGE_LENGTH"); value != "" {
+		length, err := strconv.Atoi(value)
+		if err == nil && length > len(slackTruncatedIndicator) {
+			maxLength = length
+		}
+	}
+
+	runes := []rune(text)
+	if len(runes) <= maxLength {
+		return []string{text}
+	}
+
+	if os.Getenv("NS_SLACK_LONG_MESSAGE") == "truncate" {
+		indicatorLength := len([]rune(slackTruncatedIndicator))
+		return []string{string(runes[:maxLength-indicatorLength]) + slackTruncatedIndicator}
+	}
+
+	var parts []string
+	for len(runes) > maxLength {
+		cut := maxLength
+		// Prefer cutting after the last line break, unless it would leave a tiny part
+		for i := maxLength - 1; i > maxLength/2; i-- {
+			if runes[i] == '\n' {
+				cut = i + 1
+				break
+			}
+		}
+		parts = append(parts, string(runes[:cut]))
+		runes = runes[cut:]
+	}
+	return append(parts, string(runes))
 }
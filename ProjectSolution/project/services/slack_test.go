@@ -0,0 +1,205 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/slack-go/slack"
+)
+
+func TestSlackMessageUnderTheLimitIsPostedAsIs(t *testing.T) {
+	text := strings.Repeat("a", slackMaxMessageLength)
+	if parts := slackMessageParts(text); len(parts) != 1 || parts[0] != text {
+		t.Fatalf("expected a message at the limit to be left alone, got %d parts", len(parts))
+	}
+}
+
+func TestLongSlackMessageIsSplitAtLineBreaks(t *testing.T) {
+	t.Setenv("NS_SLACK_MAX_MESSAGE_LENGTH", "100")
+
+	line := strings.Repeat("b", 59) + "\n"
+	text := strings.Repeat(line, 4)
+	parts := slackMessageParts(text)
+
+	if strings.Join(parts, "") != text {
+		t.Fatalf("expected the parts to add up to the message")
+	}
+	if len(parts) != 4 {
+		t.Fatalf("expected a part per line, got %d", len(parts))
+	}
+	for i, part := range parts {
+		if part != line {
+			t.Fatalf("part %d: expected it to end at a line break, got %q", i, part)
+		}
+	}
+}
+
+func TestLongSlackMessageWithoutLineBreaksIsCutAtTheLimit(t *testing.T) {
+	t.Setenv("NS_SLACK_MAX_MESSAGE_LENGTH", "100")
+
+	// Multi-byte characters are counted as one, and never cut in half
+	text := strings.Repeat("é", 250)
+	parts := slackMessageParts(text)
+
+	if len(parts) != 3 || strings.Join(parts, "") != text {
+		t.Fatalf("expected 3 parts adding up to the message, got %d", len(parts))
+	}
+	for i, part := range parts {
+		if length := len([]rune(part)); length > 100 {
+			t.Fatalf("part %d: expected at most 100 characters, got %d", i, length)
+		}
+	}
+}
+
+func TestLongSlackMessageIsTruncated(t *testing.T) {
+	t.Setenv("NS_SLACK_MAX_MESSAGE_LENGTH", "100")
+	t.Setenv("NS_SLACK_LONG_MESSAGE", "truncate")
+
+	parts := slackMessageParts(strings.Repeat("c", 500))
+	if len(parts) != 1 {
+		t.Fatalf("expected a single truncated part, got %d", len(parts))
+	}
+	if length := len([]rune(parts[0])); length != 100 || !strings.HasSuffix(parts[0], slackTruncatedIndicator) {
+		t.Fatalf("expected 100 characters ending with the indicator, got %d: %q", length, parts[0])
+	}
+}
+
+// A chat.postMessage the fake Slack API received
+type slackPost struct {
+	channel string
+	text    string
+}
+
+// A Slack API recording every chat.postMessage, used by sendSlack() for the duration of the test
+// Posts to the channel "C0000000404" fail with channel_not_found
+func newFakeSlackAPI(t *testing.T) (*slack.Client, func() []slackPost) {
+	var posted []slackPost
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if err := request.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		if request.PostForm.Get("channel") == "C0000000404" {
+			writer.Write([]byte(`{"ok": false, "error": "channel_not_found"}`))
+			return
+		}
+
+		mu.Lock()
+		posted = append(posted, slackPost{channel: request.PostForm.Get("channel"), text: request.PostForm.Get("text")})
+		timestamp := len(posted)
+		mu.Unlock()
+		writer.Write([]byte(`{"ok": true, "channel": "C0123456789", "ts": "1700000000.00000` + strconv.Itoa(timestamp) + `"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	previous := slackAPIURL
+	slackAPIURL = server.URL + "/"
+	t.Cleanup(func() { slackAPIURL = previous })
+
+	return slack.New("token", slack.OptionAPIURL(slackAPIURL)), func() []slackPost {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]slackPost(nil), posted...)
+	}
+}
+
+// The texts of the posts, in order
+func postedTexts(posts []slackPost) []string {
+	texts := make([]string, 0, len(posts))
+	for _, post := range posts {
+		texts = append(texts, post.text)
+	}
+	return texts
+}
+
+func TestSplitSlackMessageIsPostedInParts(t *testing.T) {
+	t.Setenv("NS_SLACK_MAX_MESSAGE_LENGTH", "100")
+	slackApi, posted := newFakeSlackAPI(t)
+
+	text := strings.Repeat("d", 250)
+	timestamp, err := postSlackMessage(slackApi, "C0123456789", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parts := postedTexts(posted()); len(parts) != 3 || strings.Join(parts, "") != text {
+		t.Fatalf("expected the message posted in 3 parts, got %d", len(parts))
+	}
+	// The first post identifies the message
+	if timestamp != "1700000000.000001" {
+		t.Fatalf("expected the first post's timestamp, got %q", timestamp)
+	}
+}
+
+func TestSlackPostsToTheNotificationsChannel(t *testing.T) {
+	t.Setenv("NS_SLACK_CHANNEL", "C0000000001")
+	_, posted := newFakeSlackAPI(t)
+
+	notification := newTestNotification("slack", 1)
+	notification.Recipient = "C0000000002"
+	if err := sendSlack(notification); err != nil {
+		t.Fatal(err)
+	}
+	if posts := posted(); len(posts) != 1 || posts[0].channel != "C0000000002" || posts[0].text != notification.Message {
+		t.Fatalf("expected the message posted to the notification's channel, got %+v", posts)
+	}
+	if notification.Result.ProviderMessageID != "1700000000.000001" {
+		t.Fatalf("expected the message timestamp as the provider's ID, got %q", notification.Result.ProviderMessageID)
+	}
+}
+
+func TestSlackFallsBackToTheDefaultChannel(t *testing.T) {
+	t.Setenv("NS_SLACK_CHANNEL", "C0000000001")
+	_, posted := newFakeSlackAPI(t)
+
+	if err := sendSlack(newSlackNotification("", "Hello")); err != nil {
+		t.Fatal(err)
+	}
+	if posts := posted(); len(posts) != 1 || posts[0].channel != "C0000000001" {
+		t.Fatalf("expected the message posted to NS_SLACK_CHANNEL, got %+v", posts)
+	}
+}
+
+func TestSlackChannelNotFoundIsExplained(t *testing.T) {
+	_, posted := newFakeSlackAPI(t)
+
+	err := sendSlack(newSlackNotification("C0000000404", "Hello"))
+	if err == nil || !strings.Contains(err.Error(), "'C0000000404' was not found or the bot is not a member of it") {
+		t.Fatalf("expected channel_not_found to be explained, got %v", err)
+	}
+	if len(posted()) != 0 {
+		t.Fatalf("expected nothing to be posted")
+	}
+}
+
+func TestSlackRejectsWhatIsNotAChannel(t *testing.T) {
+	_, posted := newFakeSlackAPI(t)
+	if err := sendSlack(newSlackNotification("Not A Channel!", "Hello")); err == nil {
+		t.Fatalf("expected an invalid channel to be rejected")
+	}
+	if len(posted()) != 0 {
+		t.Fatalf("expected nothing to be posted")
+	}
+}
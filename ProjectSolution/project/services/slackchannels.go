@@ -0,0 +1,157 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Public, private and direct message channel IDs, e.g. "C024BE91L"
+var slackChannelIDPattern = regexp.MustCompile(`^[CGD][A-Z0-9]{8,}$`)
+
+// Channel names, optionally with their '#': lowercase letters, digits, '-', '_' and '.', at most 80 long
+var slackChannelNamePattern = regexp.MustCompile(`^#?[a-z0-9][a-z0-9._-]{0,79}$`)
+
+// Slack's error for a channel that doesn't exist or that the bot can't see
+const slackChannelNotFound = "channel_not_found"
+
+// Checks the channel looks like a Slack channel ID or name
+func CheckSlackChannel(channel string) error {
+	if !slackChannelIDPattern.MatchString(channel) && !slackChannelNamePattern.MatchString(channel) {
+		return fmt.Errorf("'%s' is not a slack channel name or ID", channel)
+	}
+	return nil
+}
+
+// Whether the error is Slack's channel_not_found
+func isSlackChannelNotFound(err error) bool {
+	var slackErr slack.SlackErrorResponse
+	return errors.As(err, &slackErr) && slackErr.Err == slackChannelNotFound
+}
+
+// Slack channel name to ID mapping, filled from conversations.list and refreshed on a miss
+// A name it can't resolve is used as it is, Slack's chat.postMessage accepts names too and only needs
+// chat:write, while listing needs channels:read and groups:read
+type slackChannelCache struct {
+	ids         map[string]string
+	refreshedAt time.Time
+	now         func() time.Time
+	mu          sync.Mutex
+	// Held for a whole refresh, so concurrent misses share one instead of each listing every channel
+	refreshMu sync.Mutex
+}
+
+// Least time between refreshes, so misses (typos, channels the bot can't list) don't hammer the API
+const slackChannelRefreshInterval = time.Minute
+
+var slackChannels = slackChannelCache{
+	ids: make(map[string]string),
+	now: time.Now,
+}
+
+// The part of the Slack API client listing channels
+type slackChannelLister interface {
+	GetConversations(params *slack.GetConversationsParameters) ([]slack.Channel, string, error)
+}
+
+// Returns the ID of the channel, which may be given as an ID, a name or a "#name"
+// Falls back to the channel as given if its name isn't in the listing or the listing failed
+func (cache *slackChannelCache) resolve(slackApi slackChannelLister, channel string) string {
+	if slackChannelIDPattern.MatchString(channel) {
+		return channel
+	}
+	name := strings.TrimPrefix(channel, "#")
+
+	if id, exists := cache.lookup(name); exists {
+		return id
+	}
+
+	cache.refreshMu.Lock()
+	defer cache.refreshMu.Unlock()
+
+	// Another miss may have refreshed while this one waited
+	if id, exists := cache.lookup(name); exists {
+		return id
+	}
+	if !cache.refreshDue() {
+		return channel
+	}
+
+	if err := cache.refresh(slackApi); err != nil {
+		log.Printf("sending to slack channel '%s' by name: %v", channel, err)
+		return channel
+	}
+	if id, exists := cache.lookup(name); exists {
+		return id
+	}
+	return channel
+}
+
+func (cache *slackChannelCache) lookup(name string) (string, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	id, exists := cache.ids[name]
+	return id, exists
+}
+
+// Whether the last refresh, successful or not, is at least slackChannelRefreshInterval old
+func (cache *slackChannelCache) refreshDue() bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.refreshedAt.IsZero() || cache.now().Sub(cache.refreshedAt) >= slackChannelRefreshInterval
+}
+
+// Reload the whole mapping from conversations.list. Callers hold refreshMu
+func (cache *slackChannelCache) refresh(slackApi slackChannelLister) error {
+	cache.mu.Lock()
+	cache.refreshedAt = cache.now()
+	cache.mu.Unlock()
+
+	ids := make(map[string]string)
+	params := &slack.GetConversationsParameters{
+		ExcludeArchived: true,
+		Limit:           1000,
+		Types:           []string{"public_channel", "private_channel"},
+	}
+	for {
+		channels, nextCursor, err := slackApi.GetConversations(params)
+		if err != nil {
+			return fmt.Errorf("failed to list slack channels: %w", err)
+		}
+		for _, channel := range channels {
+			ids[channel.Name] = channel.ID
+		}
+		if nextCursor == "" {
+			break
+		}
+		params.Cursor = nextCursor
+	}
+
+	cache.mu.Lock()
+	cache.ids = ids
+	cache.mu.Unlock()
+	return nil
+}
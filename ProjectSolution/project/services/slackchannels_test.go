@@ -0,0 +1,120 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+// Lists the channels in pages of one, counting the calls
+type fakeChannelLister struct {
+	channels []slack.Channel
+	err      error
+	calls    int
+}
+
+func (lister *fakeChannelLister) GetConversations(params *slack.GetConversationsParameters) ([]slack.Channel, string, error) {
+	lister.calls++
+	if lister.err != nil {
+		return nil, "", lister.err
+	}
+	page, _ := strconv.Atoi(params.Cursor)
+	nextCursor := ""
+	if page+1 < len(lister.channels) {
+		nextCursor = strconv.Itoa(page + 1)
+	}
+	return lister.channels[page : page+1], nextCursor, nil
+}
+
+func newSlackChannel(id string, name string) slack.Channel {
+	var channel slack.Channel
+	channel.ID = id
+	channel.Name = name
+	return channel
+}
+
+// A cache with a clock the test moves forward
+func newTestChannelCache() (*slackChannelCache, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &slackChannelCache{ids: make(map[string]string), now: func() time.Time { return now }}, &now
+}
+
+func TestSlackChannelNameIsResolvedAndCached(t *testing.T) {
+	cache, _ := newTestChannelCache()
+	lister := &fakeChannelLister{channels: []slack.Channel{
+		newSlackChannel("C0000000001", "general"),
+		newSlackChannel("C0000000002", "ops"),
+	}}
+
+	if id := cache.resolve(lister, "#ops"); id != "C0000000002" {
+		t.Fatalf("expected #ops to resolve to its ID, got %q", id)
+	}
+	// Every page is listed
+	if lister.calls != 2 {
+		t.Fatalf("expected both pages to be listed, got %d calls", lister.calls)
+	}
+
+	if id := cache.resolve(lister, "general"); id != "C0000000001" {
+		t.Fatalf("expected general to resolve to its ID, got %q", id)
+	}
+	if lister.calls != 2 {
+		t.Fatalf("expected the second name to come from the cache, got %d calls", lister.calls)
+	}
+}
+
+func TestSlackChannelIDIsUsedAsIs(t *testing.T) {
+	cache, _ := newTestChannelCache()
+	lister := &fakeChannelLister{}
+	if id := cache.resolve(lister, "C0000000003"); id != "C0000000003" || lister.calls != 0 {
+		t.Fatalf("expected an ID to be used without listing, got %q after %d calls", id, lister.calls)
+	}
+}
+
+func TestSlackChannelMissRefreshesAtMostOncePerInterval(t *testing.T) {
+	cache, now := newTestChannelCache()
+	lister := &fakeChannelLister{channels: []slack.Channel{newSlackChannel("C0000000001", "general")}}
+
+	// Unknown names fall back to the name
+	if id := cache.resolve(lister, "#new-channel"); id != "#new-channel" {
+		t.Fatalf("expected an unknown name to be used as it is, got %q", id)
+	}
+	cache.resolve(lister, "#new-channel")
+	if lister.calls != 1 {
+		t.Fatalf("expected a single refresh within the interval, got %d", lister.calls)
+	}
+
+	// The channel is created, and the next miss after the interval picks it up
+	lister.channels = append(lister.channels, newSlackChannel("C0000000004", "new-channel"))
+	*now = now.Add(slackChannelRefreshInterval)
+	if id := cache.resolve(lister, "#new-channel"); id != "C0000000004" {
+		t.Fatalf("expected the refresh on a miss to resolve the new channel, got %q", id)
+	}
+}
+
+func TestSlackChannelListingFailureFallsBackToTheName(t *testing.T) {
+	cache, _ := newTestChannelCache()
+	lister := &fakeChannelLister{err: errors.New("missing_scope")}
+	if id := cache.resolve(lister, "#ops"); id != "#ops" {
+		t.Fatalf("expected the name when listing fails, got %q", id)
+	}
+}
@@ -21,41 +21,50 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/nexmo-community/nexmo-go"
 
-	"example.com/projectsolution/project/kafkawrapper"
 	"example.com/projectsolution/project/models"
 )
 
+const maxSmsRetries = 5
+
+// A '+', a country code not starting with 0, and at most 15 digits in all
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+
 // Hook called to spawn a SMS thread
-func SmsNotificationRequest(notification *models.Notification) {
-	go smsService(notification)
+func SmsNotificationRequest(notification *models.Notification) error {
+	startSend(notification)
+	return nil
 }
 
-func smsService(notification *models.Notification) {
-
-	// Send email and update the 'notification' object
-	notification = sendSms(notification)
+// A number that can't be right won't become right on a retry, so it fails before any attempt
+func checkSmsRecipient(notification *models.Notification) error {
+	_, err := smsRecipient(notification)
+	return err
+}
 
-	if notification.IsSent {
-		// Send success
-		err := kafkawrapper.SendKafkaMessage(kafkaTopicProcessed, *notification)
-		if err != nil {
-			return
-		}
-		return
+// The number to text: the notification's recipient, or NS_SMS_RECEIVER_TELEPHONE if it has none
+// Returns an error unless it is a plausible E.164 number, e.g. +14155550123
+func smsRecipient(notification *models.Notification) (string, error) {
+	recipient := notification.Recipient
+	if recipient == "" {
+		recipient = os.Getenv("NS_SMS_RECEIVER_TELEPHONE")
 	}
-
-	// Send unsuccessful
-	if !notification.IsSent {
-		kafkawrapper.SendKafkaMessage(kafkaTopicProcessed, *notification)
-		return
+	if recipient == "" {
+		return "", fmt.Errorf("no telephone number to send the sms to")
 	}
+	if !e164Pattern.MatchString(recipient) {
+		return "", fmt.Errorf("'%s' is not an E.164 telephone number", recipient)
+	}
+	return recipient, nil
 }
 
-// Send the sms message and return the updated 'notification' object with pass/fail
-func sendSms(notification *models.Notification) *models.Notification {
+// Send the sms message
+func sendSms(notification *models.Notification) error {
 
 	var apiKey string = os.Getenv("NS_SMS_API_KEY")
 	var apiSecret string = os.Getenv("NS_SMS_API_SECRET")
@@ -65,26 +74,40 @@ func sendSms(notification *models.Notification) *models.Notification {
 	auth.SetAPISecret(apiKey, apiSecret)
 
 	// Init Nexmo
-	client := nexmo.NewClient(http.DefaultClient, auth)
+	timeout := providerTimeout(notification.Mode)
+	client := nexmo.NewClient(&http.Client{Timeout: timeout}, auth)
 
 	// SMS
 	SenderTelephone := os.Getenv("NS_SMS_SENDER_TELEPHONE")
-	RecipientTelephone := os.Getenv("NS_SMS_RECEIVER_TELEPHONE")
+	RecipientTelephone, err := smsRecipient(notification)
+	if err != nil {
+		return err
+	}
 	smsContent := nexmo.SendSMSRequest{
 		From: SenderTelephone,
 		To:   RecipientTelephone,
-		Text: notification.Message}
+		Text: messageWithSignatureFooter(notification)}
+
+	start := time.Now()
+	smsResponse, httpResponse, err := client.SMS.SendSMS(smsContent)
+
+	// Nexmo's per message status, or the HTTP status if the response has no messages
+	providerMessageID, responseCode := "", ""
+	if smsResponse != nil && len(smsResponse.Messages) > 0 {
+		providerMessageID = smsResponse.Messages[0].MessageID
+		responseCode = smsResponse.Messages[0].Status
+	} else if httpResponse != nil {
+		responseCode = strconv.Itoa(httpResponse.StatusCode)
+	}
+	recordSendResult(notification, providerMessageID, responseCode, time.Since(start))
 
-	smsResponse, _, err := client.SMS.SendSMS(smsContent)
 	if err != nil {
-		notification.IsSent = false
-		notification.NumOfRepetitions = notification.NumOfRepetitions + 1
-		notification.FailReason = fmt.Sprintf("failed to send sms with following error %s and status %s.",
-			err, smsResponse.Messages[0].Status)
-		return notification
+		if isTimeout(err) {
+			return timeoutError("sms", time.Since(start), timeout, err)
+		}
+		return fmt.Errorf("failed to send sms with following error %s and status %s.", err, responseCode)
 	}
 
 	// Success
-	notification.IsSent = true
-	return notification
+	return nil
 }
@@ -0,0 +1,110 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSmsRecipient(t *testing.T) {
+	t.Setenv("NS_SMS_RECEIVER_TELEPHONE", "+15555550199")
+	tests := []struct {
+		recipient, expected string
+		valid               bool
+	}{
+		{"+14155550123", "+14155550123", true},
+		{"", "+15555550199", true},
+		{"4155550123", "", false},
+		{"+04155550123", "", false},
+		{"+1415555012345678", "", false},
+		{"+1 415 555 0123", "", false},
+	}
+	for _, test := range tests {
+		notification := newTestNotification("sms", 1)
+		notification.Recipient = test.recipient
+		recipient, err := smsRecipient(notification)
+		if (err == nil) != test.valid || recipient != test.expected {
+			t.Fatalf("%q: expected %q (valid=%v), got %q, %v", test.recipient, test.expected, test.valid, recipient, err)
+		}
+	}
+
+	t.Setenv("NS_SMS_RECEIVER_TELEPHONE", "")
+	if _, err := smsRecipient(newTestNotification("sms", 1)); err == nil {
+		t.Fatalf("expected no number without a recipient or a default")
+	}
+}
+
+// An sms through a fake provider, returning the published result
+func runSms(t *testing.T, sender *fakeSender, recipient string, maxRetryAttempts int) string {
+	fastRetries(t)
+	producer := useFakeProducer(t)
+	useProvider(t, "sms", "fake", sender)
+
+	notification := newTestNotification("sms", maxRetryAttempts)
+	notification.Provider = "fake"
+	notification.Recipient = recipient
+	runService(notification)
+
+	result := waitForResults(t, producer, 1)[0]
+	if result.IsSent {
+		return ""
+	}
+	return result.FailReason
+}
+
+func TestSmsToAValidNumber(t *testing.T) {
+	sender := &fakeSender{}
+	if failReason := runSms(t, sender, "+14155550123", 3); failReason != "" {
+		t.Fatalf("expected the sms to be sent, got %q", failReason)
+	}
+	if sender.callCount() != 1 {
+		t.Fatalf("expected a single attempt, got %d", sender.callCount())
+	}
+}
+
+func TestSmsWithoutANumberFailsBeforeAnyAttempt(t *testing.T) {
+	t.Setenv("NS_SMS_RECEIVER_TELEPHONE", "")
+	sender := &fakeSender{}
+	if failReason := runSms(t, sender, "", 3); !strings.Contains(failReason, "no telephone number") {
+		t.Fatalf("expected the missing number to fail the sms, got %q", failReason)
+	}
+	if sender.callCount() != 0 {
+		t.Fatalf("expected no attempt, got %d", sender.callCount())
+	}
+}
+
+func TestSmsRetriesUntilExhausted(t *testing.T) {
+	sender := &fakeSender{failures: 100}
+	if failReason := runSms(t, sender, "+14155550123", 3); failReason == "" {
+		t.Fatalf("expected the sms to fail once out of retries")
+	}
+	if sender.callCount() != 3 {
+		t.Fatalf("expected MaxRetryAttempts attempts, got %d", sender.callCount())
+	}
+}
+
+func TestSmsSucceedsOnARetry(t *testing.T) {
+	sender := &fakeSender{failures: 2}
+	if failReason := runSms(t, sender, "+14155550123", 3); failReason != "" {
+		t.Fatalf("expected the third attempt to succeed, got %q", failReason)
+	}
+	if sender.callCount() != 3 {
+		t.Fatalf("expected 3 attempts, got %d", sender.callCount())
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"log"
+	"os"
+	"strings"
+	"text/template"
+
+	"example.com/projectsolution/project/models"
+)
+
+// Subject used by modes with subjects when neither the request nor NS_<MODE>_SUBJECT_TEMPLATE give one
+const defaultSubject = "Email Notification System"
+
+// The subject of the notification: the request's own subject if it has one, otherwise the mode's
+// NS_<MODE>_SUBJECT_TEMPLATE rendered with the notification's fields, e.g. "Alert for {{.Recipient}}"
+func notificationSubject(notification *models.Notification) string {
+	if notification.Subject != "" {
+		return notification.Subject
+	}
+
+	envVar := "NS_" + strings.ToUpper(notification.Mode) + "_SUBJECT_TEMPLATE"
+	subjectTemplate := os.Getenv(envVar)
+	if subjectTemplate == "" {
+		return defaultSubject
+	}
+
+	parsed, err := template.New("subject").Option("missingkey=zero").Parse(subjectTemplate)
+	if err != nil {
+		log.Printf("ignoring invalid %s %q: %v", envVar, subjectTemplate, err)
+		return defaultSubject
+	}
+
+	var subject strings.Builder
+	if err := parsed.Execute(&subject, notification); err != nil {
+		log.Printf("failed to render %s for notification %s: %v", envVar, notification.MessageID, err)
+		return defaultSubject
+	}
+	// A template can't be allowed to inject headers
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(subject.String())
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"testing"
+)
+
+func TestDefaultSubjectTemplateRenders(t *testing.T) {
+	t.Setenv("NS_EMAIL_SUBJECT_TEMPLATE", "Alert for {{.Recipient}} ({{.Locale}})")
+	notification := newTestNotification("email", 1)
+	notification.Recipient = "ops@example.com"
+	notification.Locale = "fr"
+
+	if subject := notificationSubject(notification); subject != "Alert for ops@example.com (fr)" {
+		t.Fatalf("expected the rendered template, got %q", subject)
+	}
+}
+
+func TestRequestSubjectOverridesTheTemplate(t *testing.T) {
+	t.Setenv("NS_EMAIL_SUBJECT_TEMPLATE", "Alert for {{.Recipient}}")
+	notification := newTestNotification("email", 1)
+	notification.Subject = "Your invoice"
+
+	if subject := notificationSubject(notification); subject != "Your invoice" {
+		t.Fatalf("expected the request's subject, got %q", subject)
+	}
+}
+
+func TestSubjectFallsBackToTheDefault(t *testing.T) {
+	notification := newTestNotification("email", 1)
+
+	t.Setenv("NS_EMAIL_SUBJECT_TEMPLATE", "")
+	if subject := notificationSubject(notification); subject != defaultSubject {
+		t.Fatalf("expected the default subject without a template, got %q", subject)
+	}
+	t.Setenv("NS_EMAIL_SUBJECT_TEMPLATE", "Alert for {{.Recipient")
+	if subject := notificationSubject(notification); subject != defaultSubject {
+		t.Fatalf("expected the default subject for an invalid template, got %q", subject)
+	}
+	t.Setenv("NS_EMAIL_SUBJECT_TEMPLATE", "{{.NoSuchField}}")
+	if subject := notificationSubject(notification); subject != defaultSubject {
+		t.Fatalf("expected the default subject for a template that fails to render, got %q", subject)
+	}
+}
+
+func TestSubjectTemplateCantInjectHeaders(t *testing.T) {
+	t.Setenv("NS_EMAIL_SUBJECT_TEMPLATE", "Hello {{.Recipient}}")
+	notification := newTestNotification("email", 1)
+	notification.Recipient = "ops@example.com\r\nBcc: someone@example.com"
+
+	if subject := notificationSubject(notification); subject != "Hello ops@example.com  Bcc: someone@example.com" {
+		t.Fatalf("expected line breaks to be replaced, got %q", subject)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSendWebhookTimeoutReportsElapsedAndConfiguredTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer server.Close()
+	defer close(unblock)
+	t.Setenv("NS_WEBHOOK_TIMEOUT", "50ms")
+
+	notification := newTestNotification("webhook", 1)
+	notification.Recipient = server.URL
+	err := sendWebhook(notification)
+
+	if err == nil {
+		t.Fatalf("expected the slow webhook to time out")
+	}
+	if !strings.Contains(err.Error(), "webhook timed out after") || !strings.Contains(err.Error(), "configured timeout 50ms") {
+		t.Fatalf("expected the elapsed and configured timeout in the error, got %q", err)
+	}
+}
+
+func TestIsTimeout(t *testing.T) {
+	tests := []struct {
+		err     error
+		timeout bool
+	}{
+		{context.DeadlineExceeded, true},
+		{fmt.Errorf("wrapped: %w", os.ErrDeadlineExceeded), true},
+		{&timeoutNetError{}, true},
+		{errors.New("connection refused"), false},
+	}
+	for _, test := range tests {
+		if isTimeout(test.err) != test.timeout {
+			t.Fatalf("%v: expected timeout=%v", test.err, test.timeout)
+		}
+	}
+}
+
+func TestProviderTimeoutFromEnv(t *testing.T) {
+	t.Setenv("NS_SMS_TIMEOUT", "")
+	if timeout := providerTimeout("sms"); timeout != defaultProviderTimeout {
+		t.Fatalf("expected the default timeout, got %s", timeout)
+	}
+	t.Setenv("NS_SMS_TIMEOUT", "3s")
+	if timeout := providerTimeout("sms"); timeout != 3*time.Second {
+		t.Fatalf("expected 3s, got %s", timeout)
+	}
+	t.Setenv("NS_SMS_TIMEOUT", "0s")
+	if timeout := providerTimeout("sms"); timeout != defaultProviderTimeout {
+		t.Fatalf("expected a zero timeout to be ignored, got %s", timeout)
+	}
+}
+
+// A net.Error that timed out
+type timeoutNetError struct{}
+
+func (*timeoutNetError) Error() string   { return "i/o timeout" }
+func (*timeoutNetError) Timeout() bool   { return true }
+func (*timeoutNetError) Temporary() bool { return true }
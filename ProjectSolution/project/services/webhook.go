@@ -0,0 +1,117 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+
+	"example.com/projectsolution/project/models"
+)
+
+const maxWebhookRetries = 5
+
+// Body POSTed to the webhook URL
+type webhookPayload struct {
+	Message   string    `json:"message"`
+	MessageID uuid.UUID `json:"message_id"`
+	TimeStamp time.Time `json:"timestamp"`
+}
+
+// Hook called to spawn a webhook thread
+func WebhookNotificationRequest(notification *models.Notification) error {
+	startSend(notification)
+	return nil
+}
+
+// POST the message as JSON to the URL in the recipient. Any 2xx is a success
+func sendWebhook(notification *models.Notification) error {
+
+	body, err := json.Marshal(webhookPayload{
+		Message:   notification.Message,
+		MessageID: notification.MessageID,
+		TimeStamp: notification.TimeStamp,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload with following error %s", err)
+	}
+
+	timeout := providerTimeout(notification.Mode)
+	client := &http.Client{Timeout: timeout}
+
+	start := time.Now()
+	response, err := client.Post(notification.Recipient, "application/json", bytes.NewReader(body))
+	responseCode := ""
+	if response != nil {
+		response.Body.Close()
+		responseCode = strconv.Itoa(response.StatusCode)
+	}
+	recordSendResult(notification, "", responseCode, time.Since(start))
+
+	if err != nil {
+		if isTimeout(err) {
+			return timeoutError("webhook", time.Since(start), timeout, err)
+		}
+		return fmt.Errorf("failed to call webhook with following error %s", err)
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		err := fmt.Errorf("webhook responded with status %s", response.Status)
+		// A rate limited webhook knows best when it can take the next attempt
+		if response.StatusCode == http.StatusTooManyRequests {
+			if after, ok := parseRetryAfter(response.Header.Get("Retry-After"), time.Now()); ok {
+				return &retryAfterError{err: err, after: after}
+			}
+		}
+		return err
+	}
+
+	// Success
+	return nil
+}
+
+// The wait asked for by a Retry-After header, given either in seconds or as an HTTP date
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0), true
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// A webhook rejecting the request with a 4xx (other than timeout and rate limiting) will do so again,
+// only server errors and connection errors are worth a retry
+func isPermanentWebhookFailure(notification *models.Notification) bool {
+	status, err := strconv.Atoi(notification.Result.ResponseCode)
+	if err != nil {
+		return false
+	}
+	return status >= 400 && status <= 499 &&
+		status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
+}
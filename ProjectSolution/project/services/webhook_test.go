@@ -0,0 +1,205 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSendWebhookRecordsProviderResult(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	notification := newTestNotification("webhook", 1)
+	notification.Recipient = server.URL
+	if err := sendWebhook(notification); err != nil {
+		t.Fatalf("expected the webhook to succeed, got %v", err)
+	}
+	if notification.Result.ResponseCode != "202" || notification.Result.Attempts != 1 {
+		t.Fatalf("expected the response code and attempt recorded, got %+v", notification.Result)
+	}
+
+	// Every attempt counts
+	sendWebhook(notification)
+	if notification.Result.Attempts != 2 {
+		t.Fatalf("expected 2 attempts recorded, got %d", notification.Result.Attempts)
+	}
+}
+
+// A webhook answering with the statuses in turn, then 200, decoding what it is posted
+func newFakeWebhook(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32, chan webhookPayload) {
+	var calls atomic.Int32
+	payloads := make(chan webhookPayload, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(calls.Add(1))
+		var payload webhookPayload
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("expected a JSON POST, got %s %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("expected a JSON payload: %v", err)
+		}
+		payloads <- payload
+		if call <= len(statuses) {
+			w.WriteHeader(statuses[call-1])
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls, payloads
+}
+
+// A webhook notification through runService(), returning the published result
+func runWebhook(t *testing.T, url string) string {
+	fastRetries(t)
+	producer := useFakeProducer(t)
+
+	notification := newTestNotification("webhook", 3)
+	notification.Recipient = url
+	runService(notification)
+
+	result := waitForResults(t, producer, 1)[0]
+	if result.IsSent {
+		return ""
+	}
+	return result.FailReason
+}
+
+func TestWebhookPostsTheNotification(t *testing.T) {
+	server, _, payloads := newFakeWebhook(t)
+	notification := newTestNotification("webhook", 1)
+	notification.Recipient = server.URL
+
+	if err := sendWebhook(notification); err != nil {
+		t.Fatal(err)
+	}
+	payload := <-payloads
+	if payload.Message != notification.Message || payload.MessageID != notification.MessageID ||
+		!payload.TimeStamp.Equal(notification.TimeStamp) {
+		t.Fatalf("expected the message, messageID and timestamp, got %+v", payload)
+	}
+}
+
+func TestWebhookRetriesServerErrors(t *testing.T) {
+	server, calls, _ := newFakeWebhook(t, http.StatusBadGateway, http.StatusServiceUnavailable)
+	if failReason := runWebhook(t, server.URL); failReason != "" {
+		t.Fatalf("expected the third attempt to succeed, got %q", failReason)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls.Load())
+	}
+}
+
+func TestWebhookGivesUpOnClientErrors(t *testing.T) {
+	server, calls, _ := newFakeWebhook(t, http.StatusNotFound, http.StatusNotFound)
+	failReason := runWebhook(t, server.URL)
+	if !strings.HasPrefix(failReason, "Not retried") || !strings.Contains(failReason, "404") {
+		t.Fatalf("expected the 404 not to be retried, got %q", failReason)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected a single attempt, got %d", calls.Load())
+	}
+}
+
+func TestWebhookRetriesRateLimiting(t *testing.T) {
+	server, calls, _ := newFakeWebhook(t, http.StatusTooManyRequests)
+	if failReason := runWebhook(t, server.URL); failReason != "" {
+		t.Fatalf("expected the retry to succeed, got %q", failReason)
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("expected 2 attempts, got %d", calls.Load())
+	}
+}
+
+func TestWebhookFailsWithTheStatusOnceOutOfRetries(t *testing.T) {
+	server, calls, _ := newFakeWebhook(t, 500, 500, 500, 500)
+	failReason := runWebhook(t, server.URL)
+	if !strings.Contains(failReason, "500 Internal Server Error") {
+		t.Fatalf("expected the status in the fail reason, got %q", failReason)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("expected MaxRetryAttempts attempts, got %d", calls.Load())
+	}
+}
+
+// A webhook rate limiting the first call with the `retryAfter` header, recording when it was called
+func newRateLimitedWebhook(t *testing.T, retryAfter string) (*httptest.Server, chan time.Time) {
+	calls := make(chan time.Time, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- time.Now()
+		if len(calls) == 1 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, calls
+}
+
+func TestWebhookRetriesWhenTheRetryAfterHeaderSays(t *testing.T) {
+	server, calls := newRateLimitedWebhook(t, "1")
+	if failReason := runWebhook(t, server.URL); failReason != "" {
+		t.Fatalf("expected the retry to succeed, got %q", failReason)
+	}
+	if len(calls) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(calls))
+	}
+	first, retry := <-calls, <-calls
+	if wait := retry.Sub(first); wait < time.Second {
+		t.Fatalf("expected the retry a second later, as asked, got it %s later", wait)
+	}
+}
+
+func TestWebhookGivesUpWhenTheRetryAfterIsPastTheDeadline(t *testing.T) {
+	server, calls := newRateLimitedWebhook(t, "3600")
+	start := time.Now()
+	failReason := runWebhook(t, server.URL)
+	if !strings.HasPrefix(failReason, "Retry deadline reached") || !strings.Contains(failReason, "429") {
+		t.Fatalf("expected the deadline to be reached, got %q", failReason)
+	}
+	if len(calls) != 1 || time.Since(start) > time.Second {
+		t.Fatalf("expected a single attempt without waiting, got %d in %s", len(calls), time.Since(start))
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cases := map[string]struct {
+		after time.Duration
+		ok    bool
+	}{
+		"120":                           {2 * time.Minute, true},
+		"Wed, 01 May 2024 12:00:30 GMT": {30 * time.Second, true},
+		"Wed, 01 May 2024 11:00:00 GMT": {0, true},
+		"":                              {0, false},
+		"soon":                          {0, false},
+	}
+	for header, expected := range cases {
+		after, ok := parseRetryAfter(header, now)
+		if after != expected.after || ok != expected.ok {
+			t.Fatalf("%q: expected %s, %t, got %s, %t", header, expected.after, expected.ok, after, ok)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package signing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+)
+
+// Prefix naming the algorithm, so the scheme can change without breaking existing verifiers
+const signaturePrefix = "sha256="
+
+// ====== MESSAGE SIGNING ======
+
+// The signing key, configured with NS_SIGNING_KEY. Signing is unavailable without one
+func Key() []byte {
+	return []byte(os.Getenv("NS_SIGNING_KEY"))
+}
+
+// Whether a signing key is configured
+func Configured() bool {
+	return len(Key()) > 0
+}
+
+// HMAC-SHA256 of the message body under the key, as "sha256=<hex>"
+func Sign(key []byte, message string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Whether the signature was produced by Sign() for this exact message under the key
+// Recipients holding the shared key use this to check a notification came from us untampered
+func Verify(key []byte, message string, signature string) bool {
+	encoded, found := strings.CutPrefix(signature, signaturePrefix)
+	if !found {
+		return false
+	}
+	received, err := hex.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return hmac.Equal(received, mac.Sum(nil))
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package signing
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSignatureVerifies(t *testing.T) {
+	key := []byte("shared secret")
+	signature := Sign(key, "Your code is 123456")
+
+	if !strings.HasPrefix(signature, "sha256=") {
+		t.Fatalf("expected the signature to name its algorithm, got %q", signature)
+	}
+	if !Verify(key, "Your code is 123456", signature) {
+		t.Fatalf("expected the signature to verify")
+	}
+}
+
+func TestTamperingFailsVerification(t *testing.T) {
+	key := []byte("shared secret")
+	signature := Sign(key, "Your code is 123456")
+
+	tests := map[string]struct {
+		key       []byte
+		message   string
+		signature string
+	}{
+		"tampered message":   {key, "Your code is 654321", signature},
+		"other key":          {[]byte("other secret"), "Your code is 123456", signature},
+		"tampered signature": {key, "Your code is 123456", signature[:len(signature)-1] + "0"},
+		"no prefix":          {key, "Your code is 123456", strings.TrimPrefix(signature, "sha256=")},
+		"not hex":            {key, "Your code is 123456", "sha256=not-hex"},
+		"empty":              {key, "Your code is 123456", ""},
+	}
+	for name, test := range tests {
+		if Verify(test.key, test.message, test.signature) {
+			t.Fatalf("%s: expected verification to fail", name)
+		}
+	}
+}
+
+func TestConfiguredFromEnv(t *testing.T) {
+	t.Setenv("NS_SIGNING_KEY", "")
+	if Configured() {
+		t.Fatalf("expected signing to be unavailable without a key")
+	}
+	t.Setenv("NS_SIGNING_KEY", "shared secret")
+	if !Configured() || string(Key()) != "shared secret" {
+		t.Fatalf("expected the key from NS_SIGNING_KEY")
+	}
+}
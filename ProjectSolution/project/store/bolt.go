@@ -0,0 +1,179 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"example.com/projectsolution/project/models"
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+var notificationsBucket = []byte("notifications")
+
+// ====== BOLTDB STORE ======
+
+// Store persisted to a BoltDB file, so tracked notifications survive a restart
+// The file is locked by the process that opened it, so it can't be shared by several instances:
+// a second one opening it gives up after the open timeout
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// Open (or create) the BoltDB file at `path`
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open notification store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(notificationsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create notification bucket: %w", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
+
+func (bs *BoltStore) Add(notification models.Notification) (uuid.UUID, error) {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(notificationsBucket)
+		err := assignMessageID(&notification, func(messageID uuid.UUID) (bool, error) {
+			return bucket.Get(messageID[:]) != nil, nil
+		})
+		if err != nil {
+			return err
+		}
+		return putNotification(bucket, notification.MessageID, notification)
+	})
+	if err != nil {
+		return uuid.UUID{}, fmt.Errorf("failed to add notification: %w", err)
+	}
+	return notification.MessageID, nil
+}
+
+func (bs *BoltStore) Get(messageID uuid.UUID) (models.Notification, bool, error) {
+	var notification models.Notification
+	exists := false
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(notificationsBucket).Get(messageID[:])
+		if value == nil {
+			return nil
+		}
+		exists = true
+		return json.Unmarshal(value, &notification)
+	})
+	if err != nil {
+		return models.Notification{}, false, fmt.Errorf("failed to get notification %s: %w", messageID, err)
+	}
+	return notification, exists, nil
+}
+
+func (bs *BoltStore) Update(messageID uuid.UUID, notification models.Notification) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		return putNotification(tx.Bucket(notificationsBucket), messageID, notification)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update notification %s: %w", messageID, err)
+	}
+	return nil
+}
+
+func (bs *BoltStore) Delete(messageID uuid.UUID) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(notificationsBucket).Delete(messageID[:])
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete notification %s: %w", messageID, err)
+	}
+	return nil
+}
+
+func (bs *BoltStore) DeleteOlderThan(cutoff time.Time, keep func(uuid.UUID) bool) ([]uuid.UUID, error) {
+	var deleted []uuid.UUID
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(notificationsBucket)
+
+		// Deleting under a cursor can make it skip keys, so collect them first
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+			var notification models.Notification
+			if err := json.Unmarshal(value, &notification); err != nil {
+				return err
+			}
+
+			messageID, err := uuid.FromBytes(key)
+			if err != nil {
+				return err
+			}
+			if notification.TimeStamp.Before(cutoff) && !keep(messageID) {
+				deleted = append(deleted, messageID)
+			}
+		}
+
+		for _, messageID := range deleted {
+			if err := bucket.Delete(messageID[:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Nothing was deleted, the transaction rolled back
+		return nil, fmt.Errorf("failed to delete notifications older than %s: %w", cutoff, err)
+	}
+	return deleted, nil
+}
+
+func (bs *BoltStore) Find(match func(models.Notification) bool) ([]models.Notification, error) {
+	var found []models.Notification
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(notificationsBucket).ForEach(func(key, value []byte) error {
+			var notification models.Notification
+			if err := json.Unmarshal(value, &notification); err != nil {
+				return err
+			}
+			if match(notification) {
+				found = append(found, notification)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find notifications: %w", err)
+	}
+	return found, nil
+}
+
+func putNotification(bucket *bolt.Bucket, messageID uuid.UUID, notification models.Notification) error {
+	value, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+	return bucket.Put(messageID[:], value)
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"example.com/projectsolution/project/models"
+	"github.com/google/uuid"
+)
+
+// Attempts at finding an unused messageID before Add() gives up
+const maxAddChecks = 500
+
+// ====== NOTIFICATION STORE ======
+
+// Where notifications are tracked, by messageID, while they are processed
+type Store interface {
+	// Store the notification under a new messageID, setting its MessageID and TimeStamp
+	Add(notification models.Notification) (uuid.UUID, error)
+	// The notification, and whether it is in the store
+	Get(messageID uuid.UUID) (models.Notification, bool, error)
+	// Replace the notification, or store it if it isn't yet, e.g. when another instance created it
+	Update(messageID uuid.UUID, notification models.Notification) error
+	// Remove the notification. Deleting a missing messageID is not an error
+	Delete(messageID uuid.UUID) error
+	// Remove the notifications with a TimeStamp before `cutoff`, except those `keep` asks for, and
+	// return their messageIDs
+	DeleteOlderThan(cutoff time.Time, keep func(uuid.UUID) bool) ([]uuid.UUID, error)
+	// The notifications `match` asks for
+	Find(match func(models.Notification) bool) ([]models.Notification, error)
+}
+
+// Tag the notification with a messageID that `exists` doesn't know about and the current time
+func assignMessageID(notification *models.Notification, exists func(uuid.UUID) (bool, error)) error {
+	for attempt := 0; attempt <= maxAddChecks; attempt++ {
+		messageID := uuid.New()
+		taken, err := exists(messageID)
+		if err != nil {
+			return err
+		}
+		if !taken {
+			notification.TimeStamp = time.Now()
+			notification.MessageID = messageID
+			return nil
+		}
+	}
+	return fmt.Errorf("Could not find a free key to insert into map")
+}
+
+// ====== IN-MEMORY STORE ======
+
+// The default store, a map guarded by a mutex. Its contents are lost on restart
+type MemoryStore struct {
+	data map[uuid.UUID]models.Notification
+	mu   sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[uuid.UUID]models.Notification)}
+}
+
+func (ms *MemoryStore) Add(notification models.Notification) (uuid.UUID, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	err := assignMessageID(&notification, func(messageID uuid.UUID) (bool, error) {
+		_, exists := ms.data[messageID]
+		return exists, nil
+	})
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	ms.data[notification.MessageID] = notification
+	return notification.MessageID, nil
+}
+
+func (ms *MemoryStore) Get(messageID uuid.UUID) (models.Notification, bool, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	notification, exists := ms.data[messageID]
+	return notification, exists, nil
+}
+
+func (ms *MemoryStore) Update(messageID uuid.UUID, notification models.Notification) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.data[messageID] = notification
+	return nil
+}
+
+func (ms *MemoryStore) Delete(messageID uuid.UUID) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.data, messageID)
+	return nil
+}
+
+func (ms *MemoryStore) DeleteOlderThan(cutoff time.Time, keep func(uuid.UUID) bool) ([]uuid.UUID, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var deleted []uuid.UUID
+	for messageID, notification := range ms.data {
+		if notification.TimeStamp.Before(cutoff) && !keep(messageID) {
+			delete(ms.data, messageID)
+			deleted = append(deleted, messageID)
+		}
+	}
+	return deleted, nil
+}
+
+func (ms *MemoryStore) Find(match func(models.Notification) bool) ([]models.Notification, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var found []models.Notification
+	for _, notification := range ms.data {
+		if match(notification) {
+			found = append(found, notification)
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2024 Kliment Gueorguiev
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy of this software and
+// associated documentation files (the "Software"), to deal in the Software without restriction,
+// including without limitation the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the Software is furnished to do so,
+// subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all copies or substantial
+// portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR IMPLIED, INCLUDING BUT
+// NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER LIABILITY,
+// WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE
+// SOFTWARE OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package store
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/projectsolution/project/models"
+	"github.com/google/uuid"
+)
+
+// ====== CONFORMANCE SUITE ======
+
+// Behaviour every Store has to have, whatever it is backed by
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("AddAssignsIDAndTimestamp", func(t *testing.T) {
+		store := newStore(t)
+		before := time.Now()
+		messageID, err := store.Add(models.Notification{Mode: "sms", Message: "Hello", Recipient: "+15555550100"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		notification, exists, err := store.Get(messageID)
+		if err != nil || !exists {
+			t.Fatalf("expected the added notification, got exists=%v, %v", exists, err)
+		}
+		if notification.MessageID != messageID || notification.Message != "Hello" || notification.Recipient != "+15555550100" {
+			t.Fatalf("stored notification doesn't match: %+v", notification)
+		}
+		if notification.TimeStamp.Before(before) || notification.TimeStamp.After(time.Now()) {
+			t.Fatalf("expected the time of the add, got %s", notification.TimeStamp)
+		}
+	})
+
+	t.Run("GetMissing", func(t *testing.T) {
+		store := newStore(t)
+		if _, exists, err := store.Get(uuid.New()); exists || err != nil {
+			t.Fatalf("expected a missing notification not to exist, got exists=%v, %v", exists, err)
+		}
+	})
+
+	t.Run("Update", func(t *testing.T) {
+		store := newStore(t)
+		messageID, _ := store.Add(models.Notification{Mode: "sms", Message: "Hello"})
+		notification, _, _ := store.Get(messageID)
+		notification.IsSent = true
+		notification.Result = models.SendResult{ProviderMessageID: "abc", Attempts: 2}
+		if err := store.Update(messageID, notification); err != nil {
+			t.Fatal(err)
+		}
+
+		updated, _, _ := store.Get(messageID)
+		if !updated.IsSent || updated.Result != notification.Result || !updated.TimeStamp.Equal(notification.TimeStamp) {
+			t.Fatalf("expected the update to be stored, got %+v", updated)
+		}
+	})
+
+	t.Run("UpdateUnknownStoresIt", func(t *testing.T) {
+		store := newStore(t)
+		// Created by another instance
+		messageID := uuid.New()
+		if err := store.Update(messageID, models.Notification{MessageID: messageID, IsSent: true}); err != nil {
+			t.Fatal(err)
+		}
+		if notification, exists, _ := store.Get(messageID); !exists || !notification.IsSent {
+			t.Fatalf("expected the update to store the notification")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store := newStore(t)
+		messageID, _ := store.Add(models.Notification{Mode: "sms", Message: "Hello"})
+		if err := store.Delete(messageID); err != nil {
+			t.Fatal(err)
+		}
+		if _, exists, _ := store.Get(messageID); exists {
+			t.Fatalf("expected the notification to be deleted")
+		}
+		if err := store.Delete(messageID); err != nil {
+			t.Fatalf("expected deleting a missing notification not to be an error, got %v", err)
+		}
+	})
+
+	t.Run("DeleteOlderThan", func(t *testing.T) {
+		store := newStore(t)
+		now := time.Now()
+		old, kept, fresh := uuid.New(), uuid.New(), uuid.New()
+		store.Update(old, models.Notification{MessageID: old, TimeStamp: now.Add(-time.Hour)})
+		store.Update(kept, models.Notification{MessageID: kept, TimeStamp: now.Add(-time.Hour)})
+		store.Update(fresh, models.Notification{MessageID: fresh, TimeStamp: now})
+
+		deleted, err := store.DeleteOlderThan(now.Add(-time.Minute), func(messageID uuid.UUID) bool {
+			return messageID == kept
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deleted) != 1 || deleted[0] != old {
+			t.Fatalf("expected only the old notification to be deleted, got %v", deleted)
+		}
+		for messageID, expected := range map[uuid.UUID]bool{old: false, kept: true, fresh: true} {
+			if _, exists, _ := store.Get(messageID); exists != expected {
+				t.Fatalf("%s: expected exists=%v", messageID, expected)
+			}
+		}
+	})
+
+	t.Run("Find", func(t *testing.T) {
+		store := newStore(t)
+		sms, _ := store.Add(models.Notification{Mode: "sms", Message: "Hello"})
+		store.Add(models.Notification{Mode: "email", Message: "Hello"})
+
+		found, err := store.Find(func(notification models.Notification) bool {
+			return notification.Mode == "sms"
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 1 || found[0].MessageID != sms {
+			t.Fatalf("expected only the sms notification, got %+v", found)
+		}
+	})
+
+	t.Run("ConcurrentAdds", func(t *testing.T) {
+		store := newStore(t)
+		ids := make([]uuid.UUID, 50)
+		var wg sync.WaitGroup
+		for i := range ids {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				messageID, err := store.Add(models.Notification{Mode: "sms", Message: "Hello"})
+				if err != nil {
+					t.Error(err)
+				}
+				ids[i] = messageID
+			}()
+		}
+		wg.Wait()
+
+		unique := make(map[uuid.UUID]bool)
+		for _, messageID := range ids {
+			if _, exists, _ := store.Get(messageID); !exists {
+				t.Fatalf("expected %s to be stored", messageID)
+			}
+			unique[messageID] = true
+		}
+		if len(unique) != len(ids) {
+			t.Fatalf("expected %d distinct messageIDs, got %d", len(ids), len(unique))
+		}
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(*testing.T) Store { return NewMemoryStore() })
+}
+
+// A BoltStore in a fresh file, closed at the end of the test
+func openTestBoltStore(t *testing.T, path string) *BoltStore {
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestBoltStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return openTestBoltStore(t, filepath.Join(t.TempDir(), "notifications.db"))
+	})
+}
+
+func TestBoltStoreSurvivesARestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notifications.db")
+	store, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageID, err := store.Add(models.Notification{Mode: "email", Message: "Hello", Recipient: "ops@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openTestBoltStore(t, path)
+	notification, exists, err := reopened.Get(messageID)
+	if err != nil || !exists || notification.Recipient != "ops@example.com" {
+		t.Fatalf("expected the notification to survive the restart, got %+v, exists=%v, %v", notification, exists, err)
+	}
+}